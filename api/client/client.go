@@ -0,0 +1,355 @@
+// Package client is a typed client for the secretshare server's HTTP API, as
+// described by api/openapi.yaml.  It deals only in the API; encrypting, uploading to
+// and downloading from S3 are left to the caller (see commonlib for that).
+package client
+
+// secretshare - share secrets securely
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/waucka/secretshare/commonlib"
+)
+
+// operation is how to call one of the operations in api/openapi.yaml.  Paths use
+// gin's syntax for parameters, so ":id" is replaced by the object ID.
+type operation struct {
+	method string
+	path   string
+	// authenticated operations are signed with SecretKey or carry BearerToken.
+	authenticated bool
+}
+
+// operations is keyed by operationId.  client_test.go checks it against the spec.
+var operations = map[string]operation{
+	"getVersion":           {"GET", "/version", false},
+	"getHealth":            {"GET", "/healthz", false},
+	"getReadiness":         {"GET", "/readyz", false},
+	"getSpec":              {"GET", "/openapi.yaml", false},
+	"createUpload":         {"POST", "/upload", true},
+	"locateSecret":         {"GET", "/secrets/:id/location", false},
+	"reportRetrieval":      {"POST", "/secrets/:id/retrieved", false},
+	"completeUpload":       {"POST", "/secrets/:id/complete", true},
+	"createLoginChallenge": {"POST", "/login/challenge", false},
+	"login":                {"POST", "/login", false},
+	"listSecrets":          {"GET", "/admin/secrets", true},
+	"deleteSecret":         {"DELETE", "/admin/secrets/:id", true},
+	"purgeSecrets":         {"POST", "/admin/purge", true},
+	"backupDatabase":       {"GET", "/admin/db/backup", true},
+	"exportDatabase":       {"GET", "/admin/db/export", true},
+}
+
+// Client calls a secretshare server.  The zero value is not usable; use New.
+type Client struct {
+	// Endpoint is the server's base URL, e.g. "https://secretshare.example.com".
+	Endpoint string
+	// HTTPClient sends the requests.  It defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// SecretKey signs requests to operations that need authentication: use the
+	// server's secret_key for uploads, or its admin_key for the admin API.
+	SecretKey string
+	// BearerToken, if set, is sent instead of a signature.  It may be an OIDC ID
+	// token or a session token from Login.
+	BearerToken string
+}
+
+func New(endpoint string) *Client {
+	return &Client{
+		Endpoint:   strings.TrimSuffix(endpoint, "/"),
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+// Error is returned when the server responds with an unexpected status.
+type Error struct {
+	StatusCode int
+	// Code and Message are from the server's error response, if it sent one.
+	Code    string
+	Message string
+	// ReqId identifies the request in the server's logs.
+	ReqId string
+	// RetryAfter is how long the server asked the client to wait, if it did.
+	RetryAfter time.Duration
+}
+
+func (self *Error) Error() string {
+	message := self.Message
+	if message == "" {
+		message = http.StatusText(self.StatusCode)
+	}
+	if self.ReqId == "" {
+		return fmt.Sprintf("secretshare server: %s (HTTP %d)", message, self.StatusCode)
+	}
+	return fmt.Sprintf("secretshare server: %s (HTTP %d; reqId=%s)", message, self.StatusCode, self.ReqId)
+}
+
+func responseError(resp *http.Response) *Error {
+	apiErr := &Error{
+		StatusCode: resp.StatusCode,
+		ReqId:      resp.Header.Get("Secretshare-ReqId"),
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		apiErr.RetryAfter = time.Second * time.Duration(seconds)
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var errResp ErrorResponse
+	if json.Unmarshal(body, &errResp) == nil {
+		apiErr.Code = errResp.Code
+		apiErr.Message = errResp.Message
+	}
+	return apiErr
+}
+
+// send makes the request for an operation and checks that the response status is one
+// of expected.  The caller must close the response body.
+func (self *Client) send(ctx context.Context, operationId, id string, requestData interface{}, expected ...int) (*http.Response, error) {
+	op, ok := operations[operationId]
+	if !ok {
+		return nil, fmt.Errorf("unknown operation %s", operationId)
+	}
+	path := strings.Replace(op.path, ":id", url.PathEscape(id), 1)
+
+	var body []byte
+	if requestData != nil {
+		var err error
+		body, err = json.Marshal(requestData)
+		if err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(op.method, self.Endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if requestData != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if op.authenticated {
+		if self.BearerToken != "" {
+			req.Header.Set("Authorization", "Bearer "+self.BearerToken)
+		} else if self.SecretKey != "" {
+			if err = commonlib.SignRequest(req, body, self.SecretKey); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	httpClient := self.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	return nil, responseError(resp)
+}
+
+// call makes a request that is expected to succeed with 200 and decodes the JSON
+// response into responseData.
+func (self *Client) call(ctx context.Context, operationId, id string, requestData, responseData interface{}) error {
+	resp, err := self.send(ctx, operationId, id, requestData, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err = json.NewDecoder(resp.Body).Decode(responseData); err != nil {
+		return fmt.Errorf("malformed response from secretshare server: %s", err.Error())
+	}
+	return nil
+}
+
+// Version reports the server's version and capabilities.
+func (self *Client) Version(ctx context.Context) (*VersionResponse, error) {
+	var responseData VersionResponse
+	if err := self.call(ctx, "getVersion", "", nil, &responseData); err != nil {
+		return nil, err
+	}
+	return &responseData, nil
+}
+
+// Health checks that the server is running.
+func (self *Client) Health(ctx context.Context) (*Health, error) {
+	var responseData Health
+	if err := self.call(ctx, "getHealth", "", nil, &responseData); err != nil {
+		return nil, err
+	}
+	return &responseData, nil
+}
+
+// Readiness runs the server's readiness checks.  A server that isn't ready is not an
+// error; check the Status of the result.
+func (self *Client) Readiness(ctx context.Context) (*Readiness, error) {
+	resp, err := self.send(ctx, "getReadiness", "", nil, http.StatusOK, http.StatusServiceUnavailable)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var responseData Readiness
+	if err = json.NewDecoder(resp.Body).Decode(&responseData); err != nil {
+		return nil, fmt.Errorf("malformed response from secretshare server: %s", err.Error())
+	}
+	return &responseData, nil
+}
+
+// Spec fetches the server's copy of the OpenAPI document.
+func (self *Client) Spec(ctx context.Context) ([]byte, error) {
+	resp, err := self.send(ctx, "getSpec", "", nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Upload asks for presigned URLs to upload a secret to.
+func (self *Client) Upload(ctx context.Context, requestData *UploadRequest) (*UploadResponse, error) {
+	var responseData UploadResponse
+	if err := self.call(ctx, "createUpload", "", requestData, &responseData); err != nil {
+		return nil, err
+	}
+	return &responseData, nil
+}
+
+// Locate finds the bucket a secret was uploaded to.
+func (self *Client) Locate(ctx context.Context, id string) (*SecretLocation, error) {
+	var responseData SecretLocation
+	if err := self.call(ctx, "locateSecret", id, nil, &responseData); err != nil {
+		return nil, err
+	}
+	return &responseData, nil
+}
+
+// ReportRetrieval tells the server that a secret was received.
+func (self *Client) ReportRetrieval(ctx context.Context, id string) error {
+	resp, err := self.send(ctx, "reportRetrieval", id, nil, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// CompleteUpload asks the server to check that both of a secret's objects arrived at
+// the given sizes.  Check VersionResponse.Capabilities.Complete first.
+func (self *Client) CompleteUpload(ctx context.Context, id string, requestData *CompleteRequest) error {
+	resp, err := self.send(ctx, "completeUpload", id, requestData, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// LoginChallenge starts an SSH key login.
+func (self *Client) LoginChallenge(ctx context.Context, requestData *LoginChallengeRequest) (*LoginChallengeResponse, error) {
+	var responseData LoginChallengeResponse
+	if err := self.call(ctx, "createLoginChallenge", "", requestData, &responseData); err != nil {
+		return nil, err
+	}
+	return &responseData, nil
+}
+
+// Login finishes an SSH key login.  Put the token in BearerToken to use it.
+func (self *Client) Login(ctx context.Context, requestData *LoginRequest) (*LoginResponse, error) {
+	var responseData LoginResponse
+	if err := self.call(ctx, "login", "", requestData, &responseData); err != nil {
+		return nil, err
+	}
+	return &responseData, nil
+}
+
+// ListSecrets lists the secrets in every tenant's bucket.  It needs administrator
+// credentials.
+func (self *Client) ListSecrets(ctx context.Context) (*SecretList, error) {
+	var responseData SecretList
+	if err := self.call(ctx, "listSecrets", "", nil, &responseData); err != nil {
+		return nil, err
+	}
+	return &responseData, nil
+}
+
+// DeleteSecret revokes a secret.  It needs administrator credentials.
+func (self *Client) DeleteSecret(ctx context.Context, id string) (*DeleteResponse, error) {
+	var responseData DeleteResponse
+	if err := self.call(ctx, "deleteSecret", id, nil, &responseData); err != nil {
+		return nil, err
+	}
+	return &responseData, nil
+}
+
+// PurgeSecrets revokes every secret older than olderThan.  It needs administrator
+// credentials.
+func (self *Client) PurgeSecrets(ctx context.Context, olderThan time.Duration) (*DeleteResponse, error) {
+	requestData := &PurgeRequest{
+		OlderThanSeconds: int64(olderThan / time.Second),
+	}
+	var responseData DeleteResponse
+	if err := self.call(ctx, "purgeSecrets", "", requestData, &responseData); err != nil {
+		return nil, err
+	}
+	return &responseData, nil
+}
+
+// BackupDatabase copies the server's database file to w.  It needs administrator
+// credentials.
+func (self *Client) BackupDatabase(ctx context.Context, w io.Writer) (int64, error) {
+	resp, err := self.send(ctx, "backupDatabase", "", nil, http.StatusOK)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return io.Copy(w, resp.Body)
+}
+
+// ExportDatabase calls fn with each record in the server's database, stopping at the
+// first error.  It needs administrator credentials.
+func (self *Client) ExportDatabase(ctx context.Context, fn func(*SecretRecord) error) error {
+	resp, err := self.send(ctx, "exportDatabase", "", nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record SecretRecord
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("malformed record from secretshare server: %s", err.Error())
+		}
+		if err = fn(&record); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
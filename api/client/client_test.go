@@ -0,0 +1,132 @@
+package client
+
+// secretshare - share secrets securely
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/waucka/secretshare/api"
+	"github.com/waucka/secretshare/commonlib"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ClientSuite struct{}
+
+var _ = Suite(&ClientSuite{})
+
+func (s *ClientSuite) TestOperationsMatchSpec(c *C) {
+	doc, err := api.Load()
+	c.Assert(err, IsNil)
+	routes := doc.Routes()
+	for _, route := range routes {
+		op, ok := operations[route.OperationId]
+		if !c.Check(ok, Equals, true, Commentf("no client operation for %s", route.OperationId)) {
+			continue
+		}
+		c.Check(op, Equals, operation{route.Method, route.Path, route.Authenticated}, Commentf("%s", route.OperationId))
+	}
+	c.Assert(operations, HasLen, len(routes))
+}
+
+func (s *ClientSuite) TestTypesMatchSpec(c *C) {
+	doc, err := api.Load()
+	c.Assert(err, IsNil)
+	types := map[string]interface{}{
+		"Error":                  ErrorResponse{},
+		"VersionResponse":        VersionResponse{},
+		"Capabilities":           Capabilities{},
+		"UploadRequest":          UploadRequest{},
+		"UploadResponse":         UploadResponse{},
+		"CompleteRequest":        CompleteRequest{},
+		"Headers":                http.Header{},
+		"SecretLocation":         SecretLocation{},
+		"Health":                 Health{},
+		"Readiness":              Readiness{},
+		"CheckResult":            CheckResult{},
+		"LoginChallengeRequest":  LoginChallengeRequest{},
+		"LoginChallengeResponse": LoginChallengeResponse{},
+		"LoginRequest":           LoginRequest{},
+		"LoginResponse":          LoginResponse{},
+		"SecretList":             SecretList{},
+		"SecretInfo":             SecretInfo{},
+		"PurgeRequest":           PurgeRequest{},
+		"DeleteResponse":         DeleteResponse{},
+		"SecretRecord":           SecretRecord{},
+		"RetrievalEvent":         RetrievalEvent{},
+	}
+	c.Assert(types, HasLen, len(doc.Components.Schemas))
+	for name, v := range types {
+		c.Check(doc.Check(name, v), HasLen, 0, Commentf("%v", doc.Check(name, v)))
+	}
+}
+
+func (s *ClientSuite) TestUpload(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, Equals, "POST")
+		c.Check(r.URL.Path, Equals, "/upload")
+		body, _ := ioutil.ReadAll(r.Body)
+		sig, ok, err := commonlib.ParseSignatureHeader(r.Header.Get("Authorization"))
+		c.Assert(err, IsNil)
+		c.Assert(ok, Equals, true)
+		c.Check(sig.Verify("hunter2", r.Method, r.URL.Path, body), IsNil)
+		var requestData UploadRequest
+		c.Check(json.Unmarshal(body, &requestData), IsNil)
+		c.Check(requestData.ObjectId, Equals, "abc")
+		json.NewEncoder(w).Encode(&UploadResponse{PutURL: "https://example.com/abc"})
+	}))
+	defer server.Close()
+
+	cl := New(server.URL + "/")
+	cl.SecretKey = "hunter2"
+	resp, err := cl.Upload(context.Background(), &UploadRequest{TTL: 60, ObjectId: "abc"})
+	c.Assert(err, IsNil)
+	c.Assert(resp.PutURL, Equals, "https://example.com/abc")
+}
+
+func (s *ClientSuite) TestErrors(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Unauthenticated operations don't carry credentials.
+		c.Check(r.Header.Get("Authorization"), Equals, "")
+		c.Check(r.URL.EscapedPath(), Equals, "/secrets/a%2Fb/location")
+		w.Header().Set("Secretshare-ReqId", "req1")
+		w.Header().Set("Retry-After", "3")
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(&ErrorResponse{Code: "rate_limited", Message: "slow down"})
+	}))
+	defer server.Close()
+
+	cl := New(server.URL)
+	cl.BearerToken = "token"
+	_, err := cl.Locate(context.Background(), "a/b")
+	c.Assert(err, FitsTypeOf, &Error{})
+	apiErr := err.(*Error)
+	c.Assert(apiErr.StatusCode, Equals, http.StatusTooManyRequests)
+	c.Assert(apiErr.Code, Equals, "rate_limited")
+	c.Assert(apiErr.Message, Equals, "slow down")
+	c.Assert(apiErr.ReqId, Equals, "req1")
+	c.Assert(apiErr.RetryAfter, Equals, 3*time.Second)
+	c.Assert(apiErr.Error(), Equals, "secretshare server: slow down (HTTP 429; reqId=req1)")
+}
@@ -0,0 +1,167 @@
+package client
+
+// secretshare - share secrets securely
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"net/http"
+	"time"
+)
+
+// The types below mirror the schemas in api/openapi.yaml and are named after them,
+// except that the Error schema is ErrorResponse.  client_test.go checks that they
+// match.
+
+type ErrorResponse struct {
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+type VersionResponse struct {
+	ServerVersion        string        `json:"server_version"`
+	APIVersion           int           `json:"api_version"`
+	ServerSourceLocation string        `json:"server_source"`
+	Capabilities         *Capabilities `json:"capabilities,omitempty"`
+}
+
+type Capabilities struct {
+	Formats      []string `json:"formats"`
+	AuthSchemes  []string `json:"auth_schemes"`
+	DefaultTTL   int      `json:"default_ttl,omitempty"`
+	MaxTTL       int      `json:"max_ttl,omitempty"`
+	MaxSize      int64    `json:"max_size,omitempty"`
+	Storage      string   `json:"storage"`
+	Once         bool     `json:"once"`
+	MaxDownloads bool     `json:"max_downloads"`
+	Complete     bool     `json:"complete,omitempty"`
+}
+
+type UploadRequest struct {
+	// TTL is in minutes; 0 means the server's default.
+	TTL int `json:"ttl"`
+	// SecretKey is only for servers that allow legacy authentication.
+	SecretKey string `json:"secret_key,omitempty"`
+	ObjectId  string `json:"object_id"`
+	Filesize  int64  `json:"filesize,omitempty"`
+	// Complete promises a call to CompleteUpload once both objects are uploaded.
+	Complete bool `json:"complete,omitempty"`
+}
+
+type UploadResponse struct {
+	PutURL      string      `json:"put_url"`
+	Headers     http.Header `json:"headers"`
+	MetaPutURL  string      `json:"meta_put_url"`
+	MetaHeaders http.Header `json:"meta_headers"`
+}
+
+type CompleteRequest struct {
+	// Size and MetaSize are the sizes of the encrypted objects.
+	Size     int64 `json:"size"`
+	MetaSize int64 `json:"meta_size"`
+}
+
+type SecretLocation struct {
+	Bucket       string `json:"bucket"`
+	BucketRegion string `json:"bucket_region"`
+}
+
+type Health struct {
+	Status string `json:"status"`
+}
+
+type Readiness struct {
+	Status    string                  `json:"status"`
+	CheckedAt time.Time               `json:"checked_at"`
+	Checks    map[string]*CheckResult `json:"checks"`
+}
+
+type CheckResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type LoginChallengeRequest struct {
+	PublicKey string `json:"public_key"`
+}
+
+type LoginChallengeResponse struct {
+	ChallengeId string `json:"challenge_id"`
+	Challenge   []byte `json:"challenge"`
+}
+
+type LoginRequest struct {
+	ChallengeId     string `json:"challenge_id"`
+	SignatureFormat string `json:"signature_format"`
+	Signature       []byte `json:"signature"`
+}
+
+type LoginResponse struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+type SecretList struct {
+	Secrets []*SecretInfo `json:"secrets"`
+}
+
+type SecretInfo struct {
+	ObjectId   string     `json:"object_id"`
+	Size       int64      `json:"size"`
+	Created    time.Time  `json:"created"`
+	Expires    *time.Time `json:"expires,omitempty"`
+	Owner      string     `json:"owner,omitempty"`
+	Tenant     string     `json:"tenant"`
+	Retrievals int        `json:"retrievals"`
+	Verified   bool       `json:"verified,omitempty"`
+}
+
+type PurgeRequest struct {
+	OlderThanSeconds int64 `json:"older_than_seconds"`
+}
+
+type DeleteResponse struct {
+	Deleted []string `json:"deleted"`
+}
+
+// Flags in SecretRecord.
+const (
+	// FlagRevoked means an administrator deleted the secret.
+	FlagRevoked uint32 = 1 << iota
+	// FlagExpired means the server deleted the secret after its TTL passed.
+	FlagExpired
+	// FlagVerified means the uploader confirmed that the secret arrived.
+	FlagVerified
+	// FlagPending means the uploader promised to confirm the upload, so the secret
+	// can't be received until FlagVerified is set too.
+	FlagPending
+)
+
+type SecretRecord struct {
+	ObjectId   string           `json:"object_id"`
+	Owner      string           `json:"owner"`
+	AuthType   string           `json:"auth_type"`
+	Tenant     string           `json:"tenant,omitempty"`
+	Created    time.Time        `json:"created"`
+	TTL        int64            `json:"ttl_seconds"`
+	Flags      uint32           `json:"flags"`
+	Retrievals []RetrievalEvent `json:"retrievals,omitempty"`
+}
+
+type RetrievalEvent struct {
+	Time      time.Time `json:"time"`
+	ClientIP  string    `json:"client_ip"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
@@ -0,0 +1,273 @@
+package api
+
+// secretshare - share secrets securely
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	_ "embed"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Spec is the OpenAPI document describing the server's HTTP API.
+//
+//go:embed openapi.yaml
+var Spec []byte
+
+// Document is the part of an OpenAPI document that the tests check code against.
+type Document struct {
+	OpenAPI    string              `json:"openapi"`
+	Paths      map[string]PathItem `json:"paths"`
+	Components Components          `json:"components"`
+}
+
+// PathItem maps lower-case HTTP methods to operations.
+type PathItem map[string]*Operation
+
+type Components struct {
+	Schemas    map[string]*Schema    `json:"schemas"`
+	Responses  map[string]*Response  `json:"responses"`
+	Parameters map[string]*Parameter `json:"parameters"`
+}
+
+type Operation struct {
+	OperationId string                `json:"operationId"`
+	Security    []map[string][]string `json:"security"`
+	Parameters  []*Parameter          `json:"parameters"`
+	RequestBody *RequestBody          `json:"requestBody"`
+	Responses   map[string]*Response  `json:"responses"`
+}
+
+type Parameter struct {
+	Ref      string `json:"$ref"`
+	Name     string `json:"name"`
+	In       string `json:"in"`
+	Required bool   `json:"required"`
+}
+
+type RequestBody struct {
+	Required bool                  `json:"required"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+type Response struct {
+	Ref     string                `json:"$ref"`
+	Content map[string]*MediaType `json:"content"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 string             `json:"type"`
+	Format               string             `json:"format"`
+	Required             []string           `json:"required"`
+	Properties           map[string]*Schema `json:"properties"`
+	Enum                 []string           `json:"enum"`
+	Items                *Schema            `json:"items"`
+	AdditionalProperties *Schema            `json:"additionalProperties"`
+}
+
+// Route is an operation's method and path, in gin's syntax (":id" rather than "{id}").
+type Route struct {
+	Method      string
+	Path        string
+	OperationId string
+	// Authenticated is true if the operation lists any security requirements.
+	Authenticated bool
+}
+
+// Load parses Spec.
+func Load() (*Document, error) {
+	var doc Document
+	if err := yaml.Unmarshal(Spec, &doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// GinPath converts an OpenAPI path template to gin's syntax.
+func GinPath(path string) string {
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			parts[i] = ":" + part[1:len(part)-1]
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// Routes lists every operation in the document, sorted by path and method.
+func (self *Document) Routes() []Route {
+	routes := make([]Route, 0)
+	for path, item := range self.Paths {
+		for method, op := range item {
+			routes = append(routes, Route{
+				Method:        strings.ToUpper(method),
+				Path:          GinPath(path),
+				OperationId:   op.OperationId,
+				Authenticated: len(op.Security) > 0,
+			})
+		}
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Path != routes[j].Path {
+			return routes[i].Path < routes[j].Path
+		}
+		return routes[i].Method < routes[j].Method
+	})
+	return routes
+}
+
+// Schema returns a schema from components, following a "#/components/schemas/..."
+// reference if name is one.
+func (self *Document) Schema(name string) *Schema {
+	return self.Components.Schemas[strings.TrimPrefix(name, "#/components/schemas/")]
+}
+
+// Check compares the JSON encoding of v's type with a schema from components and
+// returns a description of each difference: properties missing on either side,
+// required properties that Go would omit (or optional ones it always sends), and
+// properties whose Go type doesn't match.
+func (self *Document) Check(name string, v interface{}) []string {
+	schema := self.Schema(name)
+	if schema == nil {
+		return []string{fmt.Sprintf("no schema named %s", name)}
+	}
+	problems := make([]string, 0)
+	self.check(name, schema, reflect.TypeOf(v), &problems)
+	return problems
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (self *Document) check(where string, schema *Schema, t reflect.Type, problems *[]string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if schema.Ref != "" {
+		resolved := self.Schema(schema.Ref)
+		if resolved == nil {
+			*problems = append(*problems, fmt.Sprintf("%s: unresolved reference %s", where, schema.Ref))
+			return
+		}
+		schema = resolved
+	}
+	problem := func(format string, args ...interface{}) {
+		*problems = append(*problems, where+": "+fmt.Sprintf(format, args...))
+	}
+
+	switch {
+	case t == timeType:
+		if schema.Type != "string" || schema.Format != "date-time" {
+			problem("Go type is time.Time but schema is %s/%s", schema.Type, schema.Format)
+		}
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		if schema.Type != "string" || schema.Format != "byte" {
+			problem("Go type is []byte but schema is %s/%s", schema.Type, schema.Format)
+		}
+	case t.Kind() == reflect.String:
+		if schema.Type != "string" {
+			problem("Go type is string but schema is %s", schema.Type)
+		}
+	case t.Kind() == reflect.Bool:
+		if schema.Type != "boolean" {
+			problem("Go type is bool but schema is %s", schema.Type)
+		}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		if schema.Type != "integer" {
+			problem("Go type is %s but schema is %s", t.Kind(), schema.Type)
+		}
+		if (t.Kind() == reflect.Int64) != (schema.Format == "int64") {
+			problem("Go type is %s but schema format is %q", t.Kind(), schema.Format)
+		}
+	case t.Kind() == reflect.Slice:
+		if schema.Type != "array" || schema.Items == nil {
+			problem("Go type is a slice but schema is %s", schema.Type)
+			return
+		}
+		self.check(where+"[]", schema.Items, t.Elem(), problems)
+	case t.Kind() == reflect.Map:
+		if schema.Type != "object" || schema.AdditionalProperties == nil {
+			problem("Go type is a map but schema isn't an object with additionalProperties")
+			return
+		}
+		self.check(where+"{}", schema.AdditionalProperties, t.Elem(), problems)
+	case t.Kind() == reflect.Struct:
+		if schema.Type != "object" {
+			problem("Go type is a struct but schema is %s", schema.Type)
+			return
+		}
+		self.checkStruct(where, schema, t, problem, problems)
+	default:
+		problem("Go type %s has no JSON schema equivalent", t)
+	}
+}
+
+func (self *Document) checkStruct(where string, schema *Schema, t reflect.Type, problem func(string, ...interface{}), problems *[]string) {
+	required := make(map[string]bool)
+	for _, name := range schema.Required {
+		required[name] = true
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(field.Tag.Get("json"), ",")
+		name := tag[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		omitempty := false
+		for _, option := range tag[1:] {
+			if option == "omitempty" {
+				omitempty = true
+			}
+		}
+		seen[name] = true
+
+		property, ok := schema.Properties[name]
+		if !ok {
+			problem("Go field %s (%q) is not in the schema", field.Name, name)
+			continue
+		}
+		if required[name] == omitempty {
+			if omitempty {
+				problem("%q is required, but Go omits it when empty", name)
+			} else {
+				problem("%q is optional, but Go always sends it", name)
+			}
+		}
+		self.check(where+"."+name, property, field.Type, problems)
+	}
+	for name := range schema.Properties {
+		if !seen[name] {
+			problem("property %q has no Go field", name)
+		}
+	}
+}
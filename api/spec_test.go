@@ -0,0 +1,119 @@
+package api
+
+// secretshare - share secrets securely
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"strings"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type SpecSuite struct{}
+
+var _ = Suite(&SpecSuite{})
+
+func (s *SpecSuite) TestOperations(c *C) {
+	doc, err := Load()
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(doc.OpenAPI, "3."), Equals, true)
+
+	ids := make(map[string]bool)
+	for _, route := range doc.Routes() {
+		c.Check(route.OperationId, Not(Equals), "", Commentf("%s %s", route.Method, route.Path))
+		c.Check(ids[route.OperationId], Equals, false, Commentf("duplicate operationId %s", route.OperationId))
+		ids[route.OperationId] = true
+	}
+	c.Assert(GinPath("/secrets/{id}/location"), Equals, "/secrets/:id/location")
+}
+
+// TestReferences checks that every $ref in the document points at something.
+func (s *SpecSuite) TestReferences(c *C) {
+	doc, err := Load()
+	c.Assert(err, IsNil)
+
+	var checkSchema func(where string, schema *Schema)
+	checkSchema = func(where string, schema *Schema) {
+		if schema == nil {
+			return
+		}
+		if schema.Ref != "" {
+			c.Check(doc.Schema(schema.Ref), NotNil, Commentf("%s: %s", where, schema.Ref))
+		}
+		for name, property := range schema.Properties {
+			checkSchema(where+"."+name, property)
+		}
+		checkSchema(where+"[]", schema.Items)
+		checkSchema(where+"{}", schema.AdditionalProperties)
+	}
+	checkResponse := func(where string, response *Response) {
+		if response.Ref != "" {
+			name := strings.TrimPrefix(response.Ref, "#/components/responses/")
+			response = doc.Components.Responses[name]
+			c.Assert(response, NotNil, Commentf("%s: %s", where, name))
+		}
+		for contentType, media := range response.Content {
+			checkSchema(where+" "+contentType, media.Schema)
+		}
+	}
+
+	for name, schema := range doc.Components.Schemas {
+		checkSchema(name, schema)
+	}
+	for path, item := range doc.Paths {
+		for method, op := range item {
+			where := method + " " + path
+			for _, param := range op.Parameters {
+				if param.Ref != "" {
+					name := strings.TrimPrefix(param.Ref, "#/components/parameters/")
+					c.Check(doc.Components.Parameters[name], NotNil, Commentf("%s: %s", where, name))
+				}
+			}
+			if op.RequestBody != nil {
+				for contentType, media := range op.RequestBody.Content {
+					checkSchema(where+" "+contentType, media.Schema)
+				}
+			}
+			for status, response := range op.Responses {
+				checkResponse(where+" "+status, response)
+			}
+		}
+	}
+}
+
+func (s *SpecSuite) TestCheck(c *C) {
+	doc, err := Load()
+	c.Assert(err, IsNil)
+
+	type location struct {
+		Bucket       string `json:"bucket"`
+		BucketRegion string `json:"bucket_region"`
+	}
+	c.Assert(doc.Check("SecretLocation", location{}), HasLen, 0)
+
+	type drifted struct {
+		Bucket string `json:"bucket,omitempty"`
+		Region int    `json:"region"`
+	}
+	c.Assert(doc.Check("SecretLocation", drifted{}), DeepEquals, []string{
+		`SecretLocation: "bucket" is required, but Go omits it when empty`,
+		`SecretLocation: Go field Region ("region") is not in the schema`,
+		`SecretLocation: property "bucket_region" has no Go field`,
+	})
+}
@@ -0,0 +1,231 @@
+package main
+
+// secretshare client - send and receive secrets securely
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/oauth2"
+
+	"github.com/waucka/secretshare/commonlib"
+)
+
+var ErrTokenExpired = errors.New("Cached login has expired")
+
+// cachedToken is what we store in ~/.secretshare.token after a successful login.
+//
+// Token is either an OIDC ID token or a session token from an SSH key login; either
+// way, it gets sent to the server as a bearer token.  It's stored as id_token, as it
+// was when only ID tokens were cached, so that existing logins keep working.
+type cachedToken struct {
+	Token  string    `json:"id_token"`
+	Expiry time.Time `json:"expiry"`
+	// OtherToken is where some versions stored Token.  It's only read.
+	OtherToken string `json:"token,omitempty"`
+}
+
+func tokenPath() string {
+	return filepath.Join(homeDir, ".secretshare.token")
+}
+
+// loadToken() returns the cached token, if there is one and it hasn't expired.
+func loadToken() (string, error) {
+	tokenBytes, err := ioutil.ReadFile(tokenPath())
+	if err != nil {
+		return "", err
+	}
+	var token cachedToken
+	if err = json.Unmarshal(tokenBytes, &token); err != nil {
+		return "", err
+	}
+	if time.Now().After(token.Expiry) {
+		return "", ErrTokenExpired
+	}
+	if token.Token == "" {
+		return token.OtherToken, nil
+	}
+	return token.Token, nil
+}
+
+// writeToken() caches the given token for use by later commands.
+func writeToken(token *cachedToken) error {
+	tokenBytes, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(tokenPath(), tokenBytes, 0600)
+}
+
+// login() logs in with an SSH key if asked to or if single sign-on isn't configured.
+// Otherwise, it uses single sign-on.
+func login(c *cli.Context) error {
+	if c.Bool("ssh") || c.IsSet("ssh-key") || config.OIDCIssuer == "" {
+		return sshLogin(c)
+	}
+	return oidcLogin(c)
+}
+
+// sshLogin() answers a login challenge from the secretshare server using a key held
+// by the local ssh-agent and caches the resulting session token.
+//
+// Unless --ssh-key is given, every key in the agent is tried in turn until the server
+// accepts one.
+func sshLogin(c *cli.Context) error {
+	if err := requireConfigs("endpoint"); err != nil {
+		return err
+	}
+	config.EndpointBaseURL = cleanUrl(c.Parent().String("endpoint"))
+	if err := useClientCert(); err != nil {
+		return err
+	}
+
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return e("SSH_AUTH_SOCK is not set; is ssh-agent running?")
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return e("Failed to connect to ssh-agent: %s", err.Error())
+	}
+	defer conn.Close()
+
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		return e("Failed to list keys in ssh-agent: %s", err.Error())
+	}
+	wanted := c.String("ssh-key")
+	var lastErr error
+	for _, signer := range signers {
+		fingerprint := ssh.FingerprintSHA256(signer.PublicKey())
+		if wanted != "" && wanted != fingerprint {
+			if agentKey, ok := signer.PublicKey().(*agent.Key); !ok || agentKey.Comment != wanted {
+				continue
+			}
+		}
+		commonlib.DEBUGPrintf("Trying SSH key %s\n", fingerprint)
+		resp, err := commonlib.SSHLogin(config.EndpointBaseURL, signer)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		err = writeToken(&cachedToken{
+			Token:  resp.Token,
+			Expiry: resp.Expires,
+		})
+		if err != nil {
+			return e("Failed to save login: %s", err.Error())
+		}
+		fmt.Printf("Logged in with SSH key %s until %s.\n", fingerprint, resp.Expires.Local().Format(time.RFC1123))
+		return nil
+	}
+	if lastErr != nil {
+		return ec(exitAuth, "SSH key login failed: %s", lastErr.Error())
+	}
+	if wanted != "" {
+		return ec(exitAuth, "ssh-agent has no key matching %s", wanted)
+	}
+	return ec(exitAuth, "ssh-agent has no keys; add one with ssh-add")
+}
+
+// oidcLogin() runs the OAuth 2.0 device authorization flow against the configured
+// OIDC issuer and caches the resulting ID token.
+func oidcLogin(c *cli.Context) error {
+	if config.OIDCIssuer == "" || config.OIDCClientID == "" {
+		return ec(exitUsage, `Single sign-on is not configured.
+
+Run "secretshare config --oidc-issuer <url> --oidc-client-id <id>" to fix this.`)
+	}
+
+	ctx := context.Background()
+	provider, err := oidc.NewProvider(ctx, config.OIDCIssuer)
+	if err != nil {
+		return e("Failed to contact identity provider: %s", err.Error())
+	}
+	var discovery struct {
+		DeviceAuthURL string `json:"device_authorization_endpoint"`
+	}
+	if err = provider.Claims(&discovery); err != nil {
+		return e("Malformed discovery document from identity provider: %s", err.Error())
+	}
+	if discovery.DeviceAuthURL == "" {
+		return e("Identity provider %s does not support the device authorization flow", config.OIDCIssuer)
+	}
+
+	endpoint := provider.Endpoint()
+	endpoint.DeviceAuthURL = discovery.DeviceAuthURL
+	oauthConfig := &oauth2.Config{
+		ClientID: config.OIDCClientID,
+		Endpoint: endpoint,
+		Scopes:   append([]string{oidc.ScopeOpenID, "profile", "email"}, c.StringSlice("scope")...),
+	}
+
+	deviceAuth, err := oauthConfig.DeviceAuth(ctx)
+	if err != nil {
+		return e("Failed to start login: %s", err.Error())
+	}
+	if deviceAuth.VerificationURIComplete != "" {
+		fmt.Printf("To log in, visit:\n\n    %s\n\n", deviceAuth.VerificationURIComplete)
+	} else {
+		fmt.Printf("To log in, visit:\n\n    %s\n\nand enter the code %s\n\n", deviceAuth.VerificationURI, deviceAuth.UserCode)
+	}
+	fmt.Println("Waiting for you to finish logging in...")
+
+	token, err := oauthConfig.DeviceAccessToken(ctx, deviceAuth)
+	if err != nil {
+		return ec(exitAuth, "Login failed: %s", err.Error())
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok || rawIDToken == "" {
+		return e("Identity provider did not return an ID token")
+	}
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: config.OIDCClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return e("Identity provider returned an invalid ID token: %s", err.Error())
+	}
+
+	err = writeToken(&cachedToken{
+		Token:  rawIDToken,
+		Expiry: idToken.Expiry,
+	})
+	if err != nil {
+		return e("Failed to save login: %s", err.Error())
+	}
+	fmt.Printf("Logged in as %s until %s.\n", idToken.Subject, idToken.Expiry.Local().Format(time.RFC1123))
+	return nil
+}
+
+// logout() removes the cached login token.
+func logout(c *cli.Context) error {
+	err := os.Remove(tokenPath())
+	if err != nil && !os.IsNotExist(err) {
+		return e("Failed to remove %s: %s", tokenPath(), err.Error())
+	}
+	fmt.Println("Logged out.")
+	return nil
+}
@@ -18,12 +18,14 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	homedir "github.com/mitchellh/go-homedir"
 	"io/ioutil"
-	"net/http"
 	"os"
+	"os/signal"
 	//"net/http/httputil"
 	"path/filepath"
 	"strings"
@@ -36,6 +38,10 @@ type clientConfig struct {
 	EndpointBaseURL string `json:"endpointBaseUrl"`
 	BucketRegion    string `json:"bucket_region"`
 	Bucket          string `json:"bucket"`
+	OIDCIssuer      string `json:"oidc_issuer,omitempty"`
+	OIDCClientID    string `json:"oidc_client_id,omitempty"`
+	ClientCert      string `json:"client_cert,omitempty"`
+	ClientKey       string `json:"client_key,omitempty"`
 }
 
 var (
@@ -44,10 +50,64 @@ var (
 	homeDir   string
 )
 
+// Exit codes, so that scripts can tell failures apart.  Don't renumber them.
+const (
+	exitFailed    = 1   // Anything not listed below
+	exitUsage     = 2   // Bad arguments or missing configuration
+	exitAuth      = 3   // Not logged in, or the server rejected the credentials
+	exitNotFound  = 4   // No such secret
+	exitRejected  = 5   // The server refused the upload (file too large, TTL too long)
+	exitTemporary = 6   // The server or S3 failed or couldn't be reached; try again later
+	exitLocalFile = 7   // A local file couldn't be read or written
+	exitGone      = 8   // The secret expired, was revoked, or was already retrieved
+	exitWrongKey  = 9   // The key doesn't decrypt the secret
+	exitCancelled = 130 // Interrupted by Ctrl-C, as if killed by SIGINT
+)
+
 // Returns a cli.ExitError with the given message, specified in a Printf-like way
 func e(format string, a ...interface{}) error {
+	return ec(exitFailed, format, a...)
+}
+
+// ec() is e() with a specific exit code.
+func ec(code int, format string, a ...interface{}) error {
 	msg := fmt.Sprintf(format, a...)
-	return cli.NewExitError(fmt.Sprintf("ERROR: %s", msg), 1)
+	return cli.NewExitError(fmt.Sprintf("ERROR: %s", msg), code)
+}
+
+// exitCode() picks the exit code for an error from commonlib.
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, commonlib.ErrCancelled):
+		return exitCancelled
+	case errors.Is(err, commonlib.ErrAuthFailed), errors.Is(err, commonlib.ErrForbidden):
+		return exitAuth
+	case errors.Is(err, commonlib.ErrNotFound):
+		return exitNotFound
+	case errors.Is(err, commonlib.ErrExpired), errors.Is(err, commonlib.ErrRevoked),
+		errors.Is(err, commonlib.ErrRetrieved):
+		return exitGone
+	case errors.Is(err, commonlib.ErrWrongKey):
+		return exitWrongKey
+	case errors.Is(err, commonlib.ErrTooLarge), errors.Is(err, commonlib.ErrInvalidTTL),
+		errors.Is(err, commonlib.ErrBadRequest), errors.Is(err, commonlib.ErrIncompatible):
+		return exitRejected
+	case errors.Is(err, commonlib.ErrConnectionFailed), errors.Is(err, commonlib.ErrServerFailed),
+		errors.Is(err, commonlib.ErrRateLimited), errors.Is(err, commonlib.ErrStorageFailed):
+		return exitTemporary
+	case errors.Is(err, commonlib.ErrLocalFile), errors.Is(err, commonlib.ErrFileExists):
+		return exitLocalFile
+	}
+	return exitFailed
+}
+
+// fail() returns a cli.ExitError for an error from commonlib, with the exit code for
+// its kind.
+func fail(err error) error {
+	if errors.Is(err, commonlib.ErrCancelled) {
+		return cli.NewExitError("Cancelled", exitCancelled)
+	}
+	return ec(exitCode(err), "%s", err.Error())
 }
 
 func loadConfig(configPath string) error {
@@ -95,7 +155,7 @@ func requireConfigs(configNames ...string) error {
 	}
 
 	if len(missingConfigs) > 0 {
-		return e(`The following required options are missing from your ".secretsharerc" file:
+		return ec(exitUsage, `The following required options are missing from your ".secretsharerc" file:
 
   - %s
 
@@ -129,6 +189,42 @@ func cleanUrl(url string) string {
 	return url
 }
 
+// useClientCert() sets up the client certificate from .secretsharerc, if there is one.
+func useClientCert() error {
+	if config.ClientCert == "" && config.ClientKey == "" {
+		return nil
+	}
+	if config.ClientCert == "" || config.ClientKey == "" {
+		return ec(exitUsage, "Both client_cert and client_key must be set in your \".secretsharerc\" file")
+	}
+	err := commonlib.UseClientCertificate(config.ClientCert, config.ClientKey)
+	if err != nil {
+		return e("Failed to load client certificate: %s", err.Error())
+	}
+	return nil
+}
+
+// interruptible() returns a context that is cancelled by Ctrl-C, so that a transfer
+// stops cleanly rather than leaving a partial file behind.  Call stop when the
+// transfer is over, so that Ctrl-C works normally again.
+func interruptible() (ctx context.Context, stop context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
+}
+
+// newClient() returns a client for the server and bucket from the configuration,
+// which retries as the global flags say.
+func newClient(c *cli.Context, creds *commonlib.Credentials) *commonlib.Client {
+	retry := commonlib.DefaultRetryPolicy
+	retry.Attempts = c.Parent().Int("retries") + 1
+	retry.Delay = c.Parent().Duration("retry-delay")
+	retry.MaxDelay = c.Parent().Duration("retry-max-delay")
+	return commonlib.NewClient(
+		commonlib.WithEndpoint(config.EndpointBaseURL),
+		commonlib.WithStorage(config.Bucket, config.BucketRegion),
+		commonlib.WithCredentials(creds),
+		commonlib.WithRetryPolicy(retry))
+}
+
 // writeKey() writes the given pre-shared key to the given file.
 func writeKey(psk, keyPath string) error {
 	return ioutil.WriteFile(keyPath, []byte(psk), 0600)
@@ -144,38 +240,56 @@ func sendSecret(c *cli.Context) error {
 	config.EndpointBaseURL = cleanUrl(c.Parent().String("endpoint"))
 	config.Bucket = cleanUrl(c.Parent().String("bucket"))
 	config.BucketRegion = cleanUrl(c.Parent().String("bucket-region"))
-	err = loadSecretKey(filepath.Join(homeDir, ".secretshare.key"))
-	if err != nil || secretKey == "" {
-		return e(`Failed to load secret key
+	if err = useClientCert(); err != nil {
+		return err
+	}
+
+	creds := &commonlib.Credentials{}
+	creds.BearerToken, err = loadToken()
+	if err == ErrTokenExpired {
+		return ec(exitAuth, "Your login has expired.  Run 'secretshare login' to log in again.")
+	}
+	if creds.BearerToken == "" {
+		err = loadSecretKey(filepath.Join(homeDir, ".secretshare.key"))
+		if (err != nil || secretKey == "") && config.ClientCert == "" {
+			if config.OIDCIssuer != "" {
+				return ec(exitAuth, "You are not logged in.  Run 'secretshare login' to log in.")
+			}
+			return ec(exitAuth, `Failed to load secret key
 
 $HOME/.secretshare.key must contain a key or $SECRETSHARE_KEY must be set.
 Try 'secretshare config --auth-key <key>' to fix this.`)
+		}
+		creds.SecretKey = secretKey
 	}
 
 	filename := c.Args().Get(0)
 	if filename == "" || len(c.Args()) > 1 {
-		return e("USAGE: secretshare send FILENAME")
+		return ec(exitUsage, "USAGE: secretshare send FILENAME")
 	}
 
-	keystr, idstr, senderr := commonlib.SendSecret(
-		config.EndpointBaseURL,
-		config.Bucket,
-		config.BucketRegion,
-		secretKey,
-		filename,
-		c.Int("ttl"),
-		nil)
-	if senderr != nil {
-		return e(senderr.Error())
+	ctx, stop := interruptible()
+	defer stop()
+	result, err := newClient(c, creds).SendContext(ctx, filename, c.Int("ttl"))
+	if err != nil {
+		return fail(err)
 	}
+	keystr, idstr := result.Key, result.Id
 
 	fmt.Println("File uploaded!")
+	if !result.Verified {
+		fmt.Fprintln(os.Stderr, "WARNING: the upload could not be checked; the server can't check uploads, and no bucket is configured")
+	}
 	commonlib.DEBUGPrintf("Key: %s\n", keystr)
 	commonlib.DEBUGPrintf("ID: %s\n", idstr)
 	commonlib.DEBUGPrintf("URL: https://s3-%s.amazonaws.com/%s/%s\n",
 		config.BucketRegion, config.Bucket, idstr)
 	fmt.Println("To receive this secret:")
 	fmt.Printf("secretshare receive %s\n", keystr)
+	if c.Bool("link") {
+		fmt.Println("or open this link in a browser:")
+		fmt.Println(commonlib.ReceiveLink(config.EndpointBaseURL, keystr))
+	}
 	return nil
 }
 
@@ -201,21 +315,17 @@ func getyn(prompt string) (bool, error) {
 func recvSecret(c *cli.Context) error {
 	var err error
 
-	if err = requireConfigs("bucket", "bucket-region"); err != nil {
-		return err
-	}
-
 	config.EndpointBaseURL = cleanUrl(c.Parent().String("endpoint"))
 	config.Bucket = cleanUrl(c.Parent().String("bucket"))
 	config.BucketRegion = cleanUrl(c.Parent().String("bucket-region"))
-	keystr := c.Args().Get(0)
+	keystr := commonlib.KeyFromLink(c.Args().Get(0))
 	if keystr == "" || len(c.Args()) > 1 {
-		return e("USAGE: secretshare receive KEY")
+		return ec(exitUsage, "USAGE: secretshare receive KEY|LINK")
 	}
 
 	key, err := commonlib.DecodeForHuman(keystr)
 	if err != nil {
-		return e("Invalid secret key given on command line: %s", err.Error())
+		return ec(exitUsage, "Invalid secret key given on command line: %s", err.Error())
 	}
 
 	cwd, err := os.Getwd()
@@ -223,32 +333,35 @@ func recvSecret(c *cli.Context) error {
 		return e("Could not determine current directory: %s", err.Error())
 	}
 
-	var newName *string
-	outputStr := c.String("output")
-	if outputStr != "" {
-		newName = &outputStr
-	} else {
-		newName = nil
+	// The server says which bucket the secret is in, since it may not be the one in
+	// the config file.  Older servers can't say, so the config file is the fallback.
+	client := newClient(c, nil)
+	options := &commonlib.ReceiveOptions{
+		Filename: c.String("output"),
 	}
-
-	filemeta, recverr := commonlib.RecvSecret(config.Bucket, config.BucketRegion, key, cwd, newName, false, nil)
-	if recverr != nil && recverr.Code == commonlib.RecvFileExists {
+	ctx, stop := interruptible()
+	filemeta, err := client.ReceiveContext(ctx, key, cwd, options)
+	stop()
+	if errors.Is(err, commonlib.ErrFileExists) {
 		// If the code is RecvFileExists, then filemeta will be non-nil.
 		prompt := fmt.Sprintf("File %s already exists!  Overwrite (y/n)? ", filemeta.Filename)
-		overwrite, err := getyn(prompt)
-		if err != nil {
-			return e(err.Error())
+		overwrite, ynerr := getyn(prompt)
+		if ynerr != nil {
+			return e(ynerr.Error())
 		}
-		if overwrite {
-			os.Remove(filemeta.Filename)
-			filemeta, recverr = commonlib.RecvSecret(config.Bucket, config.BucketRegion, key, cwd, newName, true, nil)
-		} else {
-			return e("Download aborted at user request")
+		if !overwrite {
+			return ec(exitLocalFile, "Download aborted at user request")
 		}
+		options.Overwrite = true
+		ctx, stop = interruptible()
+		filemeta, err = client.ReceiveContext(ctx, key, cwd, options)
+		stop()
 	}
-
-	if recverr != nil {
-		return e(recverr.Error())
+	if errors.Is(err, commonlib.ErrStorageUnknown) {
+		return requireConfigs("bucket", "bucket-region")
+	}
+	if err != nil {
+		return fail(err)
 	}
 
 	fmt.Printf("File downloaded as %s\n", filemeta.Filename)
@@ -262,6 +375,8 @@ func recvSecret(c *cli.Context) error {
 // having loading the config in the first place or having loaded defaults into the
 // global `config` struct.
 func editConfig(c *cli.Context) error {
+	var err error
+
 	// .secretsharerc
 	if c.IsSet("endpoint") {
 		config.EndpointBaseURL = cleanUrl(c.String("endpoint"))
@@ -272,9 +387,27 @@ func editConfig(c *cli.Context) error {
 	if c.IsSet("bucket-region") {
 		config.BucketRegion = c.String("bucket-region")
 	}
+	if c.IsSet("oidc-issuer") {
+		config.OIDCIssuer = cleanUrl(c.String("oidc-issuer"))
+	}
+	if c.IsSet("oidc-client-id") {
+		config.OIDCClientID = c.String("oidc-client-id")
+	}
+	if c.IsSet("client-cert") {
+		config.ClientCert, err = filepath.Abs(c.String("client-cert"))
+		if err != nil {
+			return e("Invalid client certificate path: %s", err.Error())
+		}
+	}
+	if c.IsSet("client-key") {
+		config.ClientKey, err = filepath.Abs(c.String("client-key"))
+		if err != nil {
+			return e("Invalid client key path: %s", err.Error())
+		}
+	}
 	confBytes, _ := json.Marshal(&config)
 	confPath := filepath.Join(homeDir, ".secretsharerc")
-	err := ioutil.WriteFile(confPath, confBytes, 0600)
+	err = ioutil.WriteFile(confPath, confBytes, 0600)
 	if err != nil {
 		return e("Failed to save config: %s", err.Error())
 	}
@@ -301,37 +434,31 @@ func printVersion(c *cli.Context) error {
 	fmt.Printf("Client API version: %d\n", commonlib.APIVersion)
 	fmt.Printf("Client source code: %s\n", commonlib.GetSourceLocation())
 
-	resp, err := http.Get(config.EndpointBaseURL + "/version")
-	if err != nil {
-		return e("Failed to connect to secretshare server: %s", err.Error())
-	}
-	if resp.Body == nil {
-		return e("No data received from secretshare server")
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusInternalServerError {
-		return e("The secretshare server encountered an internal error")
+	if err := useClientCert(); err != nil {
+		return err
 	}
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	info, err := newClient(c, nil).Version()
 	if err != nil {
-		return e("Error reading secretshare server response: %s", err.Error())
+		return fail(err)
 	}
-	var responseData commonlib.ServerVersionResponse
-	err = json.Unmarshal(bodyBytes, &responseData)
-	if err != nil {
-		return e(`Malformed response received from secretshare server: %s\n
 
-Response body:
+	fmt.Printf("Server version: %s\n", info.ServerVersion)
+	fmt.Printf("Server API version: %d\n", info.APIVersion)
+	fmt.Printf("Server source code: %s\n", info.ServerSourceLocation)
 
-%s`, err.Error(), bodyBytes)
+	caps := info.Caps()
+	fmt.Printf("Server formats: %s\n", strings.Join(caps.Formats, ", "))
+	fmt.Printf("Server authentication: %s\n", strings.Join(caps.AuthSchemes, ", "))
+	fmt.Printf("Server storage: %s\n", caps.Storage)
+	if caps.MaxTTL > 0 {
+		fmt.Printf("Server maximum TTL: %d minutes\n", caps.MaxTTL)
+	}
+	if caps.MaxSize > 0 {
+		fmt.Printf("Server maximum file size: %d bytes\n", caps.MaxSize)
 	}
 
-	fmt.Printf("Server version: %s\n", responseData.ServerVersion)
-	fmt.Printf("Server API version: %d\n", responseData.APIVersion)
-	fmt.Printf("Server source code: %s\n", responseData.ServerSourceLocation)
-
-	if commonlib.APIVersion != responseData.APIVersion {
-		return e("WARNING! Server and client APIs do not match!  Update your client.")
+	if _, err = commonlib.Negotiate(caps, nil); err != nil {
+		return ec(exitRejected, "WARNING! %s", err.Error())
 	}
 	return nil
 }
@@ -371,6 +498,21 @@ func main() {
 			Value: config.Bucket,
 			Usage: "S3 bucket to store files in",
 		},
+		cli.IntFlag{
+			Name:  "retries",
+			Value: commonlib.DefaultRetryPolicy.Attempts - 1,
+			Usage: "How many times to retry requests that fail for reasons that may pass",
+		},
+		cli.DurationFlag{
+			Name:  "retry-delay",
+			Value: commonlib.DefaultRetryPolicy.Delay,
+			Usage: "How long to wait before the first retry; each later retry waits twice as long",
+		},
+		cli.DurationFlag{
+			Name:  "retry-max-delay",
+			Value: commonlib.DefaultRetryPolicy.MaxDelay,
+			Usage: "Longest wait between retries",
+		},
 	}
 	app.Commands = []cli.Command{
 		{
@@ -381,7 +523,11 @@ func main() {
 				cli.IntFlag{
 					Name:  "ttl",
 					Value: 4 * 60,
-					Usage: "Time in minutes that the file should be available (doesn't work yet)",
+					Usage: "Time in minutes that the file should be available (only enforced if the server deletes expired secrets)",
+				},
+				cli.BoolFlag{
+					Name:  "link",
+					Usage: "Also print a link that can be opened in a browser",
 				},
 			},
 		},
@@ -402,6 +548,30 @@ func main() {
 			Usage:  "Print client and server version",
 			Action: printVersion,
 		},
+		{
+			Name:   "login",
+			Usage:  "Log in with single sign-on or a key from ssh-agent",
+			Action: login,
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "scope",
+					Usage: "Extra OAuth scope to request (e.g. \"groups\"); may be repeated",
+				},
+				cli.BoolFlag{
+					Name:  "ssh",
+					Usage: "Log in with a key from ssh-agent even if single sign-on is configured",
+				},
+				cli.StringFlag{
+					Name:  "ssh-key",
+					Usage: "Fingerprint (SHA256:...) or comment of the ssh-agent key to use",
+				},
+			},
+		},
+		{
+			Name:   "logout",
+			Usage:  "Forget the login saved by \"secretshare login\"",
+			Action: logout,
+		},
 		{
 			Name:   "config",
 			Usage:  "Configure the secretshare client by modifying ~/.secretsharerc and/or ~/.secretshare.key",
@@ -423,6 +593,22 @@ func main() {
 					Name:  "auth-key",
 					Usage: "Pre-shared authentication key for talking to secretshare server",
 				},
+				cli.StringFlag{
+					Name:  "oidc-issuer",
+					Usage: "OpenID Connect issuer URL used by \"secretshare login\"",
+				},
+				cli.StringFlag{
+					Name:  "oidc-client-id",
+					Usage: "OAuth client ID used by \"secretshare login\"",
+				},
+				cli.StringFlag{
+					Name:  "client-cert",
+					Usage: "PEM file containing a TLS client certificate to present to the secretshare server",
+				},
+				cli.StringFlag{
+					Name:  "client-key",
+					Usage: "PEM file containing the private key for --client-cert",
+				},
 			},
 		},
 	}
@@ -2,16 +2,11 @@ package commonlib
 
 import (
 	"bufio"
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
-	"net/url"
-	"os"
 	//"net/http/httputil"
-	"path/filepath"
 	"strings"
 
 	"crypto/aes"
@@ -32,74 +27,82 @@ func generateKey() ([]byte, string, error) {
 	return key, EncodeForHuman(key), nil
 }
 
-type ProgressRecord struct {
-	Value int64
-	Total int64
-}
-
-func uploadEncrypted(stream io.Reader, messageSize int64, putURL string, headers http.Header, key []byte, progressChan chan *ProgressRecord) error {
-	encrypter, err := NewEncrypter(stream, messageSize, key, progressChan)
-	if err != nil {
-		return err
-	}
-
-	DEBUGPrintf("Starting upload to %s\n", putURL)
-	uploadClient := &http.Client{}
-	req, err := http.NewRequest("PUT", putURL, bufio.NewReaderSize(encrypter, 4096))
-	if err != nil {
-		return err
-	}
+// uploadEncrypted encrypts what open returns and uploads it to putURL, returning the
+// size of the encrypted object.  open is called again for each try.
+func (self *Client) uploadEncrypted(ctx context.Context, open func() (io.ReadCloser, error), messageSize int64, putURL string, headers http.Header, key []byte, progress *progressTracker) (int64, error) {
+	var totalSize int64
 	headerStrings := make([]string, 0)
-	for k, v := range headers {
-		canonicalKey := http.CanonicalHeaderKey(k)
-		if len(v) == 1 {
-			DEBUGPrintf("Adding header %s (%s): %s\n", canonicalKey, k, v)
-			req.Header.Set(canonicalKey, v[0])
-			headerStrings = append(headerStrings, fmt.Sprintf(`-H "%s: %s"`, canonicalKey, v[0]))
-		} else {
-			items, ok := req.Header[canonicalKey]
-			if ok {
-				for _, item := range v {
-					DEBUGPrintf("Appending %s to header %s (%s)\n", item, canonicalKey, k)
-					items = append(items, item)
-				}
-				req.Header[canonicalKey] = items
+	self.logger.Printf("Starting upload to %s\n", putURL)
+	resp, err := self.do(ctx, true, func() (*http.Request, error) {
+		stream, err := open()
+		if err != nil {
+			return nil, err
+		}
+		encrypter, err := NewEncrypter(&progressReader{reader: stream, progress: progress}, messageSize, key, nil)
+		if err != nil {
+			stream.Close()
+			return nil, err
+		}
+		// The transport closes the body, and so the stream, when it's done.
+		req, err := http.NewRequest("PUT", putURL, &readCloser{bufio.NewReaderSize(encrypter, 4096), stream})
+		if err != nil {
+			stream.Close()
+			return nil, err
+		}
+		headerStrings = headerStrings[:0]
+		for k, v := range headers {
+			canonicalKey := http.CanonicalHeaderKey(k)
+			if len(v) == 1 {
+				self.logger.Printf("Adding header %s (%s): %s\n", canonicalKey, k, v)
+				req.Header.Set(canonicalKey, v[0])
+				headerStrings = append(headerStrings, fmt.Sprintf(`-H "%s: %s"`, canonicalKey, v[0]))
 			} else {
-				DEBUGPrintf("Adding header %s (%s): %s\n", canonicalKey, k, v[0])
-				req.Header[canonicalKey] = v
+				items, ok := req.Header[canonicalKey]
+				if ok {
+					for _, item := range v {
+						self.logger.Printf("Appending %s to header %s (%s)\n", item, canonicalKey, k)
+						items = append(items, item)
+					}
+					req.Header[canonicalKey] = items
+				} else {
+					self.logger.Printf("Adding header %s (%s): %s\n", canonicalKey, k, v[0])
+					req.Header[canonicalKey] = v
+				}
 			}
 		}
-	}
 
-	DEBUGPrintln("All custom headers set!")
-
-	// Set Content-Length header to avoid HTTP 501 from S3.
-	// Don't bother setting it in headerStrings; curl does this on its own.
-	req.ContentLength = encrypter.TotalSize
-	DEBUGPrintln("Content-Length set!")
-
-	/*//
-	dump, err := httputil.DumpRequestOut(req, false)
-	if err == nil {
-		DEBUGPrintf("Request:\n")
-		DEBUGPrintf("%q\n\n", dump)
-	} else {
-		DEBUGPrintf("Error dumping request!\n")
-		DEBUGPrintf("%s\n", err.Error())
-		os.Exit(1)
-	}*/
-
-	DEBUGPrintf("Uploading %d bytes...\n", req.ContentLength)
-	resp, err := uploadClient.Do(req)
+		self.logger.Printf("All custom headers set!\n")
+
+		// Set Content-Length header to avoid HTTP 501 from S3.
+		// Don't bother setting it in headerStrings; curl does this on its own.
+		req.ContentLength = encrypter.TotalSize
+		totalSize = encrypter.TotalSize
+		self.logger.Printf("Content-Length set!\n")
+
+		/*//
+		dump, err := httputil.DumpRequestOut(req, false)
+		if err == nil {
+			self.logger.Printf("Request:\n")
+			self.logger.Printf("%q\n\n", dump)
+		} else {
+			self.logger.Printf("Error dumping request!\n")
+			self.logger.Printf("%s\n", err.Error())
+			os.Exit(1)
+		}*/
+
+		self.logger.Printf("Uploading %d bytes...\n", req.ContentLength)
+		return req, nil
+	})
 	if err != nil {
-		return err
+		return 0, err
 	}
+	resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		DEBUGPrintf("Failed to upload file! S3 server returned status code: %d\n", resp.StatusCode)
-		DEBUGPrintf(`curl -XPUT -d @$FILENAME %s '%s'`, strings.Join(headerStrings, " "), putURL)
-		return fmt.Errorf("Failed to upload file! S3 server returned status code: %d\n", resp.StatusCode)
+		self.logger.Printf("Failed to upload file! S3 server returned status code: %d\n", resp.StatusCode)
+		self.logger.Printf(`curl -XPUT -d @$FILENAME %s '%s'`, strings.Join(headerStrings, " "), putURL)
+		return 0, fmt.Errorf("S3 server returned status code: %d", resp.StatusCode)
 	}
-	return nil
+	return totalSize, nil
 }
 
 type SendErrorType int
@@ -114,125 +117,108 @@ const (
 	FileOpenFailed
 	FileReadFailed
 	UniverseFailed
+	// SendCancelled means the context passed to Client.SendContext was cancelled or
+	// its deadline passed.
+	SendCancelled
+	// AuthFailed means the secretshare server didn't accept the client's credentials.
+	AuthFailed
+	// UploadRejected means the secretshare server refused the upload, for example
+	// because the file is too large or the TTL too long.
+	UploadRejected
+	// Incompatible means the client and server have no format or authentication
+	// scheme in common.
+	Incompatible
+	// UploadUnverified means the upload seemed to work, but the secret's objects
+	// weren't all in storage at the right sizes afterwards.
+	UploadUnverified
 )
 
 type SendError struct {
 	Message string
 	Code    SendErrorType
+	// Err is the underlying error, if any.  It's often a *ServerError.
+	Err error
 }
 
 func (self *SendError) Error() string {
 	return self.Message
 }
 
-func makeSendError(code SendErrorType, formatString string, args ...interface{}) *SendError {
-	return &SendError{
-		Message: fmt.Sprintf(formatString, args...),
-		Code:    code,
-	}
+func (self *SendError) Unwrap() error {
+	return self.Err
 }
 
-func SendSecret(endpoint, bucket, bucketRegion, secretKey, filePath string, ttl int, progressChan chan *ProgressRecord) (string, string, *SendError) {
-	var err error
-	if progressChan != nil {
-		defer func() {
-			close(progressChan)
-		}()
-	}
-
-	key, keystr, err := generateKey()
-	if err != nil {
-		return "", "", makeSendError(KeyGenFailed, "Failed to generate encryption key: %s", err.Error())
-	}
-	idstr := deriveId(key)
-
-	stats, err := os.Stat(filePath)
-	if err != nil {
-		return "", "", makeSendError(FileOpenFailed, "Failed to open file: %s", err.Error())
-	}
-	if stats.IsDir() {
-		return "", "", makeSendError(FileOpenFailed, "File is a directory")
-	}
-	fileSize := stats.Size()
-	basename := filepath.Base(filePath)
-	requestBytes, err := json.Marshal(&UploadRequest{
-		TTL:       ttl,
-		SecretKey: secretKey,
-		ObjectId:  idstr,
-	})
-	if err != nil {
-		return "", "", makeSendError(UniverseFailed, "Failed to create JSON for upload request?  What? %s", err.Error())
-	}
-
-	buf := bytes.NewBuffer(requestBytes)
+var sendErrorKinds = map[SendErrorType]error{
+	MetadataUploadFailed: ErrStorageFailed,
+	ConnectionFailed:     ErrConnectionFailed,
+	ServerFailed:         ErrServerFailed,
+	DataUploadFailed:     ErrStorageFailed,
+	FileOpenFailed:       ErrLocalFile,
+	FileReadFailed:       ErrLocalFile,
+	SendCancelled:        ErrCancelled,
+	AuthFailed:           ErrAuthFailed,
+	Incompatible:         ErrIncompatible,
+	UploadUnverified:     ErrStorageFailed,
+}
 
-	DEBUGPrintf("POST %s\n", endpoint+"/upload")
-	resp, err := http.Post(endpoint+"/upload", "application/json", buf)
-	if err != nil {
-		return "", "", makeSendError(ConnectionFailed, "Failed to connect to secretshare server: %s", err.Error())
-	}
+// Is matches the error kind (ErrAuthFailed, ErrCancelled and so on) for the
+// error's code.  UploadRejected errors match the kind of their Err instead.
+func (self *SendError) Is(target error) bool {
+	kind, ok := sendErrorKinds[self.Code]
+	return ok && target == kind
+}
 
-	var reqId string
-	{
-		reqIds, exists := resp.Header["Secretshare-Reqid"]
-		if exists && len(reqIds) > 0 {
-			reqId = reqIds[0]
-		}
-	}
+// withCause sets the error's Err.
+func (self *SendError) withCause(err error) *SendError {
+	self.Err = err
+	return self
+}
 
-	if resp.Body == nil {
-		return "", "", makeSendError(ServerFailed, "Empty reply received from secretshare server; reqId=%s", reqId)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusInternalServerError {
-		return "", "", makeSendError(ServerFailed, "The secretshare server encountered an internal error; reqId=%s", reqId)
-	}
-	if resp.StatusCode == http.StatusUnauthorized {
-		return "", "", makeSendError(ServerFailed, "Failed to authenticate to secretshare server; reqId=%s", reqId)
-	}
-	if resp.StatusCode != http.StatusOK {
-		return "", "", makeSendError(ServerFailed, "The secretshare server responded with HTTP code %d, so the file cannot be uploaded; reqId=%s", resp.StatusCode, reqId)
-	}
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", "", makeSendError(ServerFailed, "Error reading response from secretshare server: %s; reqId=%s", err.Error(), reqId)
+func makeSendError(code SendErrorType, formatString string, args ...interface{}) *SendError {
+	return &SendError{
+		Message: fmt.Sprintf(formatString, args...),
+		Code:    code,
 	}
-	var responseData UploadResponse
-	err = json.Unmarshal(bodyBytes, &responseData)
-	if err != nil {
-		return "", "", makeSendError(ServerFailed, `Malformed response received from secretshare server: %s\n
-
-Response body:
-
-%s
+}
 
-(request ID was %s)`, err.Error(), bodyBytes, reqId)
-	}
+// Credentials holds whatever the client uses to prove its identity to the secretshare server.
+//
+// If BearerToken is set, it is sent in an "Authorization: Bearer" header.  Otherwise,
+// the request is signed with SecretKey (see SignRequest); the key itself is never sent.
+type Credentials struct {
+	// SecretKey is the pre-shared key configured on the server.
+	SecretKey string
+	// BearerToken is an OIDC ID token obtained by "secretshare login".
+	BearerToken string
+}
 
-	f, err := os.Open(filePath)
-	if err != nil {
-		return "", "", makeSendError(FileOpenFailed, "Can't read file %s: %s", filePath, err.Error())
-	}
-	defer f.Close()
-	stream := bufio.NewReader(f)
-	uploadEncrypted(stream, fileSize, responseData.PutURL, responseData.Headers, key, progressChan)
+// GetServerInfo fetches the server's version and capabilities.
+func GetServerInfo(endpoint string) (*ServerVersionResponse, error) {
+	return NewClient(WithEndpoint(endpoint)).Version()
+}
 
-	filemeta := FileMetadata{
-		Filename: basename,
-		Filesize: fileSize,
+// SendSecret encrypts and uploads filePath, returning the key and object ID.  It
+// closes progressChan, if given, when it's done.  New code should use Client.Send.
+func SendSecret(endpoint, bucket, bucketRegion string, creds *Credentials, filePath string, ttl int, progressChan chan *ProgressRecord) (string, string, *SendError) {
+	client := NewClient(
+		WithEndpoint(endpoint),
+		WithStorage(bucket, bucketRegion),
+		WithCredentials(creds),
+		withProgressChan(progressChan))
+	if progressChan != nil {
+		defer close(progressChan)
 	}
-	metabytes, err := json.Marshal(filemeta)
-
+	result, err := client.Send(filePath, ttl)
 	if err != nil {
-		return "", "", makeSendError(UniverseFailed, "Failed to create JSON for file metadata?  What?  %s\n", err.Error())
+		return "", "", err.(*SendError)
 	}
-	metabuf := bytes.NewBuffer(metabytes)
-	uploadEncrypted(metabuf, int64(len(metabytes)), responseData.MetaPutURL, responseData.MetaHeaders, key, nil)
-
-	return keystr, idstr, nil
+	return result.Key, result.Id, nil
 }
 
 func decrypt(ciphertext, key []byte) ([]byte, error) {
+	if len(ciphertext) < 1+aes.BlockSize {
+		return nil, fmt.Errorf("Data is malformed!  length is %d, which is too short\n", len(ciphertext))
+	}
 	paddingLen := ciphertext[0]
 	DEBUGPrintf("decrypt: paddingLen = %d\n", paddingLen)
 	DEBUGPrintf("decrypt: len(ciphertext) = %d\n", len(ciphertext))
@@ -243,6 +229,9 @@ func decrypt(ciphertext, key []byte) ([]byte, error) {
 	if len(raw)%aes.BlockSize != 0 {
 		return nil, fmt.Errorf("Data is malformed!  length is %d, which is not a multiple of %d\n", len(raw), aes.BlockSize)
 	}
+	if int(paddingLen) > len(raw) {
+		return nil, fmt.Errorf("Data is malformed!  padding length is %d, but there are only %d bytes\n", paddingLen, len(raw))
+	}
 
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -271,17 +260,71 @@ const (
 	RecvCreateFailed
 	DataDownloadFailed
 	DecryptionFailed
+	// StorageUnknown means the server didn't say which bucket holds the secret and
+	// the client has no bucket configured.
+	StorageUnknown
+	// RecvCancelled means the context passed to Client.ReceiveContext was cancelled
+	// or its deadline passed.
+	RecvCancelled
+	// SecretExpired means the secret's TTL passed and it was deleted.
+	SecretExpired
+	// SecretRevoked means an administrator deleted the secret.
+	SecretRevoked
+	// SecretRetrieved means the secret was received and then deleted.
+	SecretRetrieved
+	// SecretNotFound means there's no sign the secret ever existed, which usually
+	// means the key has a typo in it.
+	SecretNotFound
+	// WrongKey means the key doesn't decrypt the secret.
+	WrongKey
+	// SecretIncomplete means the sender hasn't confirmed that the upload finished.
+	SecretIncomplete
 )
 
 type RecvError struct {
 	Message string
 	Code    RecvErrorType
+	// Err is the underlying error, if any.
+	Err error
 }
 
 func (self *RecvError) Error() string {
 	return self.Message
 }
 
+func (self *RecvError) Unwrap() error {
+	return self.Err
+}
+
+var recvErrorKinds = map[RecvErrorType]error{
+	MetadataDownloadFailed: ErrStorageFailed,
+	MalformedMetadata:      ErrDecryption,
+	RecvFileExists:         ErrFileExists,
+	RecvCreateFailed:       ErrLocalFile,
+	DataDownloadFailed:     ErrStorageFailed,
+	DecryptionFailed:       ErrDecryption,
+	StorageUnknown:         ErrStorageUnknown,
+	RecvCancelled:          ErrCancelled,
+	SecretExpired:          ErrExpired,
+	SecretRevoked:          ErrRevoked,
+	SecretRetrieved:        ErrRetrieved,
+	SecretNotFound:         ErrNotFound,
+	WrongKey:               ErrWrongKey,
+	SecretIncomplete:       ErrStorageFailed,
+}
+
+// Is matches the error kind (ErrFileExists, ErrCancelled and so on) for the
+// error's code.
+func (self *RecvError) Is(target error) bool {
+	return target == recvErrorKinds[self.Code]
+}
+
+// withCause sets the error's Err.
+func (self *RecvError) withCause(err error) *RecvError {
+	self.Err = err
+	return self
+}
+
 func makeRecvError(code RecvErrorType, formatString string, args ...interface{}) *RecvError {
 	return &RecvError{
 		Message: fmt.Sprintf(formatString, args...),
@@ -289,86 +332,59 @@ func makeRecvError(code RecvErrorType, formatString string, args ...interface{})
 	}
 }
 
-func RecvSecret(bucket, bucketRegion string, key []byte, destDir string, newName *string, overwrite bool, progressChan chan *ProgressRecord) (*FileMetadata, *RecvError) {
-	var err error
-	if progressChan != nil {
-		defer func() {
-			close(progressChan)
-		}()
-	}
+// LocateSecret asks the secretshare server which bucket holds the secret with the
+// given key.
+func LocateSecret(endpoint string, key []byte) (*SecretLocation, error) {
+	return NewClient(WithEndpoint(endpoint)).locateOnServer(context.Background(), deriveId(key))
+}
 
-	id := deriveId(key)
+// ReportRetrieval tells the secretshare server that the secret with the given key has
+// been received.
+func ReportRetrieval(endpoint string, key []byte) error {
+	return NewClient(WithEndpoint(endpoint)).reportRetrieval(context.Background(), deriveId(key))
+}
 
-	resp, err := http.Get(fmt.Sprintf("https://s3-%s.amazonaws.com/%s/meta/%s",
-		url.QueryEscape(bucketRegion),
-		url.QueryEscape(bucket),
-		url.QueryEscape(id),
-	))
-	if err != nil {
-		return nil, makeRecvError(MetadataDownloadFailed, "Failed to download metadata file from S3: %s", err.Error())
+// RecvSecret downloads and decrypts a secret from the given bucket.  It closes
+// progressChan, if given, when it's done.  New code should use Client.Receive, which
+// also asks the server where the secret is and reports the retrieval.
+func RecvSecret(bucket, bucketRegion string, key []byte, destDir string, newName *string, overwrite bool, progressChan chan *ProgressRecord) (*FileMetadata, *RecvError) {
+	client := NewClient(
+		WithStorage(bucket, bucketRegion),
+		withProgressChan(progressChan))
+	if progressChan != nil {
+		defer close(progressChan)
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, makeRecvError(MetadataDownloadFailed, "Failed to download metadata file! S3 server returned status '%d'", resp.StatusCode)
+	options := &ReceiveOptions{
+		Overwrite: overwrite,
 	}
-
-	defer resp.Body.Close()
-	metabytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, makeRecvError(MetadataDownloadFailed, "Failed to read metadata from S3: %s", err.Error())
+	if newName != nil {
+		options.Filename = *newName
 	}
-	realMeta, err := decrypt(metabytes, key)
+	filemeta, err := client.Receive(key, destDir, options)
 	if err != nil {
-		return nil, makeRecvError(DecryptionFailed, "Failed to decrypt metadata: %s", err.Error())
+		return filemeta, err.(*RecvError)
 	}
+	return filemeta, nil
+}
 
-	var filemeta FileMetadata
-	err = json.Unmarshal(realMeta, &filemeta)
-	if err != nil {
-		return nil, makeRecvError(MalformedMetadata, "Received malformed metadata from S3: %s", err.Error())
+// withProgressChan sends progress to a channel, for the functions that predate Client.
+func withProgressChan(progressChan chan *ProgressRecord) ClientOption {
+	return func(self *Client) {
+		if progressChan != nil {
+			self.progress = legacyProgressChan(progressChan)
+		}
 	}
+}
 
-	filename := filemeta.Filename
-	if newName != nil {
-		filename = *newName
-	}
-	filePath := filepath.Join(destDir, filename)
+// legacyProgressChan is a ProgressChan that leaves out the metadata upload.  Callers
+// that predate phases draw one progress bar, which would otherwise start over.
+type legacyProgressChan chan *ProgressRecord
 
-	// This is how you check if a file exists in Go.  Yep.
-	if _, err := os.Stat(filePath); err == nil {
-		if !overwrite {
-			return &filemeta, makeRecvError(RecvFileExists, "File already exists: %s", filePath)
-		} else {
-			os.Remove(filePath)
-		}
-	}
-	outf, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		return nil, makeRecvError(RecvCreateFailed, "Failed to create file %s: %s\n", filePath, err.Error())
-	}
-	defer outf.Close()
-
-	// Download data
-	resp, err = http.Get(fmt.Sprintf("https://s3-%s.amazonaws.com/%s/%s",
-		url.QueryEscape(bucketRegion),
-		url.QueryEscape(bucket),
-		url.QueryEscape(id),
-	))
-	if err != nil {
-		return nil, makeRecvError(DataDownloadFailed, "Failed to download file from S3: %s", err.Error())
-	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, makeRecvError(DataDownloadFailed, "Failed to download file!  S3 server returned status '%d'", resp.StatusCode)
-	}
+func (self legacyProgressChan) StartPhase(Phase) {}
 
-	defer resp.Body.Close()
-	decrypter, err := NewDecrypter(resp.Body, filemeta.Filesize, key, progressChan)
-	if err != nil {
-		return nil, makeRecvError(DecryptionFailed, "Failed to initiate decryption: %s", err.Error())
-	}
-	bytesWritten, err := io.Copy(outf, decrypter)
-	DEBUGPrintf("Wrote %d bytes\n", bytesWritten)
-	if err != nil {
-		return nil, makeRecvError(DecryptionFailed, "Failed to save decrypted file: %s", err.Error())
+func (self legacyProgressChan) Progress(record *ProgressRecord) {
+	if record.Phase == PhaseUploadingMetadata {
+		return
 	}
-	return &filemeta, nil
+	self <- record
 }
@@ -0,0 +1,167 @@
+package commonlib
+
+// secretshare - share secrets securely
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Formats are the ways a secret can be encrypted and stored.
+const (
+	// FormatAES256CBC is AES-256-CBC with a one-byte padding length and a random IV
+	// prepended (see Encrypter).  It is the only format so far.
+	FormatAES256CBC = "aes256-cbc"
+)
+
+// Authentication schemes a server can accept for uploads.  These are also the
+// authentication methods the server logs for each upload.
+const (
+	AuthSignature       = "signature"
+	AuthLegacySecretKey = "legacy_secret_key"
+	AuthOIDC            = "oidc"
+	AuthSSHKey          = "ssh_key"
+	AuthClientCert      = "client_cert"
+)
+
+const StorageS3 = "s3"
+
+var (
+	// SupportedFormats lists the formats this client can write and read, best first.
+	SupportedFormats = []string{FormatAES256CBC}
+
+	ErrNoCommonFormat = errors.New("The secretshare server does not support any storage format this client knows; update your client")
+)
+
+// Capabilities describes what a secretshare server supports.  Servers advertise them
+// in the /version response, and clients use them to decide how to talk to the server
+// instead of insisting on an exact API version.
+type Capabilities struct {
+	Formats     []string `json:"formats"`
+	AuthSchemes []string `json:"auth_schemes"`
+	// DefaultTTL and MaxTTL are in minutes.  A MaxTTL of zero means there is no limit.
+	DefaultTTL int `json:"default_ttl,omitempty"`
+	MaxTTL     int `json:"max_ttl,omitempty"`
+	// MaxSize is the largest file, in bytes, the server accepts; zero means no limit.
+	MaxSize int64  `json:"max_size,omitempty"`
+	Storage string `json:"storage"`
+	// Once and MaxDownloads say whether the server can delete a secret after it has
+	// been received once or a given number of times.
+	Once         bool `json:"once"`
+	MaxDownloads bool `json:"max_downloads"`
+	// Complete says whether the server can check that an upload arrived, with
+	// POST /secrets/{id}/complete.  Clients check the objects themselves otherwise.
+	Complete bool `json:"complete,omitempty"`
+}
+
+// Caps returns the server's capabilities.  Servers that predate capability
+// negotiation don't send any, so they are worked out from the API version.
+func (self *ServerVersionResponse) Caps() *Capabilities {
+	if self.Capabilities != nil {
+		return self.Capabilities
+	}
+	caps := &Capabilities{
+		Formats: []string{FormatAES256CBC},
+		Storage: StorageS3,
+	}
+	if self.APIVersion <= 3 {
+		caps.AuthSchemes = []string{AuthLegacySecretKey}
+	} else {
+		caps.AuthSchemes = []string{AuthSignature, AuthOIDC, AuthSSHKey, AuthClientCert}
+	}
+	return caps
+}
+
+func (self *Capabilities) hasAuthScheme(scheme string) bool {
+	for _, s := range self.AuthSchemes {
+		if s == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+// Features are what a client has chosen to use with a particular server.
+type Features struct {
+	Format string
+	// AuthScheme is empty if the client has no credentials beyond, perhaps, a TLS
+	// client certificate.
+	AuthScheme string
+}
+
+// Negotiate picks the best format and authentication scheme supported by both this
+// client and the server.
+func Negotiate(caps *Capabilities, creds *Credentials) (*Features, error) {
+	features := &Features{}
+	for _, format := range SupportedFormats {
+		for _, offered := range caps.Formats {
+			if format == offered {
+				features.Format = format
+				break
+			}
+		}
+		if features.Format != "" {
+			break
+		}
+	}
+	if features.Format == "" {
+		return nil, ErrNoCommonFormat
+	}
+
+	if creds == nil {
+		return features, nil
+	}
+	switch {
+	case creds.BearerToken != "":
+		scheme := AuthOIDC
+		if strings.HasPrefix(creds.BearerToken, SessionTokenPrefix) {
+			scheme = AuthSSHKey
+		}
+		if !caps.hasAuthScheme(scheme) {
+			return nil, fmt.Errorf("The secretshare server does not accept %s logins", scheme)
+		}
+		features.AuthScheme = scheme
+	case creds.SecretKey != "":
+		if caps.hasAuthScheme(AuthSignature) {
+			features.AuthScheme = AuthSignature
+		} else if caps.hasAuthScheme(AuthLegacySecretKey) {
+			features.AuthScheme = AuthLegacySecretKey
+		} else {
+			return nil, errors.New("The secretshare server does not accept the pre-shared secret key")
+		}
+	}
+	return features, nil
+}
+
+// CheckUpload returns an error if the server would refuse to store a file of the
+// given size for ttl minutes.  A ttl of zero means the server's default.
+func (self *Capabilities) CheckUpload(ttl int, size int64) error {
+	if self.MaxTTL > 0 && ttl > self.MaxTTL {
+		return &kindError{
+			kind:    ErrInvalidTTL,
+			message: fmt.Sprintf("The secretshare server keeps secrets for at most %d minutes; use a shorter TTL", self.MaxTTL),
+		}
+	}
+	if self.MaxSize > 0 && size > self.MaxSize {
+		return &kindError{
+			kind:    ErrTooLarge,
+			message: fmt.Sprintf("The secretshare server accepts files of at most %d bytes", self.MaxSize),
+		}
+	}
+	return nil
+}
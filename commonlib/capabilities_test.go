@@ -0,0 +1,71 @@
+package commonlib
+
+// secretshare - share secrets securely
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type CapabilitiesSuite struct{}
+
+var _ = Suite(&CapabilitiesSuite{})
+
+func (s *CapabilitiesSuite) TestNegotiate(c *C) {
+	caps := &Capabilities{
+		Formats:     []string{"some-future-format", FormatAES256CBC},
+		AuthSchemes: []string{AuthSignature, AuthLegacySecretKey, AuthSSHKey},
+		Storage:     StorageS3,
+	}
+	features, err := Negotiate(caps, &Credentials{SecretKey: "hunter2"})
+	c.Assert(err, IsNil)
+	c.Assert(features.Format, Equals, FormatAES256CBC)
+	c.Assert(features.AuthScheme, Equals, AuthSignature)
+
+	features, err = Negotiate(caps, &Credentials{BearerToken: SessionTokenPrefix + "abc"})
+	c.Assert(err, IsNil)
+	c.Assert(features.AuthScheme, Equals, AuthSSHKey)
+
+	_, err = Negotiate(caps, &Credentials{BearerToken: "eyJhbGciOi..."})
+	c.Assert(err, ErrorMatches, "The secretshare server does not accept oidc logins")
+
+	_, err = Negotiate(&Capabilities{Formats: []string{"some-future-format"}}, nil)
+	c.Assert(err, Equals, ErrNoCommonFormat)
+}
+
+func (s *CapabilitiesSuite) TestOldServers(c *C) {
+	// API version 3 servers only take the pre-shared key in the request body.
+	old := &ServerVersionResponse{APIVersion: 3}
+	features, err := Negotiate(old.Caps(), &Credentials{SecretKey: "hunter2"})
+	c.Assert(err, IsNil)
+	c.Assert(features.Format, Equals, FormatAES256CBC)
+	c.Assert(features.AuthScheme, Equals, AuthLegacySecretKey)
+
+	// API version 4 servers from before capability negotiation take signatures.
+	old = &ServerVersionResponse{APIVersion: 4}
+	features, err = Negotiate(old.Caps(), &Credentials{SecretKey: "hunter2"})
+	c.Assert(err, IsNil)
+	c.Assert(features.AuthScheme, Equals, AuthSignature)
+}
+
+func (s *CapabilitiesSuite) TestCheckUpload(c *C) {
+	caps := &Capabilities{MaxTTL: 60, MaxSize: 1024}
+	c.Assert(caps.CheckUpload(0, 1024), IsNil)
+	c.Assert(caps.CheckUpload(60, 0), IsNil)
+	c.Assert(caps.CheckUpload(61, 0), NotNil)
+	c.Assert(caps.CheckUpload(0, 1025), NotNil)
+	c.Assert((&Capabilities{}).CheckUpload(60*24*365, 1<<40), IsNil)
+}
@@ -0,0 +1,864 @@
+package commonlib
+
+// secretshare - share secrets securely
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Logger is where a Client writes its debugging output.  *log.Logger and logrus
+// loggers both satisfy it.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// debugLogger writes to standard output if DEBUG is set, like DEBUGPrintf.
+type debugLogger struct{}
+
+func (debugLogger) Printf(format string, args ...interface{}) {
+	DEBUGPrintf(format, args...)
+}
+
+// RetryPolicy says how often a Client tries a request before giving up.  Requests are
+// retried if they fail to connect or if the server or S3 responds with a 5xx status
+// or 429, but only if repeating them is harmless: uploads and downloads, but not
+// requests for upload URLs or reports that a secret was received.
+type RetryPolicy struct {
+	// Attempts is the total number of tries; anything less than 1 means 1.
+	Attempts int
+	// Delay is how long to wait before the first retry.  Each retry after that waits
+	// twice as long as the one before.
+	Delay time.Duration
+	// MaxDelay caps the wait between tries; zero means no cap.  If a server asks
+	// (with Retry-After) for a longer wait than this, the client gives up instead.
+	MaxDelay time.Duration
+	// Jitter is the fraction of each wait that's random, so that clients that failed
+	// together don't all retry together.  0 means none, and 1 means each wait is
+	// anywhere up to the full delay.
+	Jitter float64
+}
+
+var (
+	// DefaultRetryPolicy is what a Client uses unless told otherwise.
+	DefaultRetryPolicy = RetryPolicy{
+		Attempts: 4,
+		Delay:    500 * time.Millisecond,
+		MaxDelay: 15 * time.Second,
+		Jitter:   0.5,
+	}
+	NoRetries = RetryPolicy{Attempts: 1}
+)
+
+// backoff returns how long to wait after the given failed attempt (1 for the first).
+func (self RetryPolicy) backoff(attempt int) time.Duration {
+	delay := self.Delay
+	for i := 1; i < attempt && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	if self.MaxDelay > 0 && delay > self.MaxDelay {
+		delay = self.MaxDelay
+	}
+	if self.Jitter > 0 {
+		delay -= time.Duration(self.Jitter * rand.Float64() * float64(delay))
+	}
+	return delay
+}
+
+// parseRetryAfter reads a Retry-After header, which is either a number of seconds or
+// an HTTP date.
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Second * time.Duration(seconds), true
+	}
+	if when, err := http.ParseTime(header); err == nil {
+		if wait := when.Sub(now); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// Client sends and receives secrets.  Create one with NewClient.
+type Client struct {
+	endpoint     string
+	bucket       string
+	bucketRegion string
+	creds        *Credentials
+	httpClient   *http.Client
+	logger       Logger
+	progress     ProgressReporter
+	retry        RetryPolicy
+	// storageURL returns the URL of an object in a bucket.  Tests replace it.
+	storageURL func(location *SecretLocation, name string) string
+}
+
+type ClientOption func(*Client)
+
+// WithEndpoint sets the base URL of the secretshare server.  A client with no endpoint
+// can still receive secrets if it knows where they're stored (see WithStorage).
+func WithEndpoint(endpoint string) ClientOption {
+	return func(self *Client) {
+		for len(endpoint) > 0 && endpoint[len(endpoint)-1] == '/' {
+			endpoint = endpoint[:len(endpoint)-1]
+		}
+		self.endpoint = endpoint
+	}
+}
+
+// WithStorage sets the S3 bucket to receive secrets from when the server can't say
+// which bucket holds them (or there is no server).
+func WithStorage(bucket, bucketRegion string) ClientOption {
+	return func(self *Client) {
+		self.bucket = bucket
+		self.bucketRegion = bucketRegion
+	}
+}
+
+// WithCredentials sets what the client uses to authenticate to the server.  A client
+// certificate is configured on the *http.Client instead (see UseClientCertificate).
+func WithCredentials(creds *Credentials) ClientOption {
+	return func(self *Client) {
+		if creds != nil {
+			self.creds = creds
+		}
+	}
+}
+
+// WithHTTPClient sets the *http.Client for requests to the server and to S3.  The
+// default is HTTPClient.
+func WithHTTPClient(httpClient *http.Client) ClientOption {
+	return func(self *Client) {
+		self.httpClient = httpClient
+	}
+}
+
+// WithLogger sets where debugging output goes.  The default is DEBUGPrintf.
+func WithLogger(logger Logger) ClientOption {
+	return func(self *Client) {
+		self.logger = logger
+	}
+}
+
+// WithProgress sets a function to call as files are sent and received.  It's the same
+// as WithProgressReporter, for callers that don't care about phases.
+func WithProgress(progress ProgressFunc) ClientOption {
+	return func(self *Client) {
+		if progress != nil {
+			self.progress = progress
+		}
+	}
+}
+
+// WithProgressReporter sets what to tell as files are sent and received.
+func WithProgressReporter(progress ProgressReporter) ClientOption {
+	return func(self *Client) {
+		self.progress = progress
+	}
+}
+
+// WithRetryPolicy sets how failed requests are retried.  The default is
+// DefaultRetryPolicy.
+func WithRetryPolicy(retry RetryPolicy) ClientOption {
+	return func(self *Client) {
+		self.retry = retry
+	}
+}
+
+func NewClient(options ...ClientOption) *Client {
+	client := &Client{
+		creds:      &Credentials{},
+		httpClient: HTTPClient,
+		logger:     debugLogger{},
+		retry:      DefaultRetryPolicy,
+		storageURL: s3URL,
+	}
+	for _, option := range options {
+		option(client)
+	}
+	return client
+}
+
+// do sends the request made by newRequest, making a new one for each try so that
+// bodies and signatures are fresh.  Requests that aren't idempotent are only tried
+// once.
+func (self *Client) do(ctx context.Context, idempotent bool, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		self.logger.Printf("%s %s\n", req.Method, req.URL)
+		resp, err := self.httpClient.Do(req)
+		var retryable bool
+		if err != nil {
+			retryable = ctx.Err() == nil
+		} else {
+			retryable = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		}
+		if !idempotent || !retryable || attempt >= self.retry.Attempts {
+			return resp, err
+		}
+
+		delay := self.retry.backoff(attempt)
+		if err != nil {
+			self.logger.Printf("Attempt %d of %s %s failed: %s\n", attempt, req.Method, req.URL, err.Error())
+		} else {
+			self.logger.Printf("Attempt %d of %s %s failed with HTTP %d\n", attempt, req.Method, req.URL, resp.StatusCode)
+			if wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok && wait > delay {
+				if self.retry.MaxDelay > 0 && wait > self.retry.MaxDelay {
+					self.logger.Printf("Not retrying, since the server asked to wait %s\n", wait)
+					return resp, nil
+				}
+				delay = wait
+			}
+			resp.Body.Close()
+		}
+		self.logger.Printf("Retrying in %s\n", delay)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// serverRequest sends a request to the secretshare server.  If authenticated is set,
+// the request carries the client's credentials.  If idempotent is set, it may be
+// retried (see RetryPolicy).
+func (self *Client) serverRequest(ctx context.Context, method, path string, body []byte, authenticated, idempotent bool) (*http.Response, error) {
+	if self.endpoint == "" {
+		return nil, fmt.Errorf("No secretshare server endpoint is configured")
+	}
+	resp, err := self.do(ctx, idempotent, func() (*http.Request, error) {
+		req, err := http.NewRequest(method, self.endpoint+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if !authenticated {
+			return req, nil
+		}
+		if self.creds.BearerToken != "" {
+			req.Header.Set("Authorization", "Bearer "+self.creds.BearerToken)
+		} else if self.creds.SecretKey != "" {
+			if err = SignRequest(req, body, self.creds.SecretKey); err != nil {
+				return nil, err
+			}
+		}
+		return req, nil
+	})
+	if err != nil && ctx.Err() == nil {
+		return nil, &kindError{kind: ErrConnectionFailed, message: err.Error(), cause: err}
+	}
+	return resp, err
+}
+
+// readCloser reads through a buffer but closes the underlying file.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// contextReader fails once ctx is done, so that encryption and decryption stop
+// promptly when an operation is cancelled.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (self *contextReader) Read(p []byte) (int, error) {
+	if err := self.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return self.reader.Read(p)
+}
+
+// Version fetches the server's version and capabilities.
+func (self *Client) Version() (*ServerVersionResponse, error) {
+	return self.VersionContext(context.Background())
+}
+
+func (self *Client) VersionContext(ctx context.Context) (*ServerVersionResponse, error) {
+	resp, err := self.serverRequest(ctx, "GET", "/version", nil, false, true)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to secretshare server: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, readServerError(resp)
+	}
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading secretshare server response: %s", err.Error())
+	}
+	var info ServerVersionResponse
+	if err = json.Unmarshal(bodyBytes, &info); err != nil {
+		return nil, fmt.Errorf("Malformed response received from secretshare server: %s", err.Error())
+	}
+	return &info, nil
+}
+
+// SendResult is what a receiver needs to get a secret that was sent.
+type SendResult struct {
+	// Key is the encryption key, encoded for humans.
+	Key string
+	// Id is the object ID the secret is stored under.
+	Id string
+	// Verified is set if the upload was checked.  It isn't if the server can't check
+	// and the client doesn't know which bucket to look in.
+	Verified bool
+}
+
+// Send encrypts and uploads filePath, keeping it for ttl minutes (0 for the server's
+// default).  Errors are *SendError.
+//
+// The server's capabilities are checked first, so that the client uses a format and
+// authentication scheme the server supports and doesn't upload a file the server
+// would refuse.
+func (self *Client) Send(filePath string, ttl int) (*SendResult, error) {
+	return self.SendContext(context.Background(), filePath, ttl)
+}
+
+// SendContext is Send, but stops if ctx is cancelled or its deadline passes.  The
+// error's code is then SendCancelled.
+func (self *Client) SendContext(ctx context.Context, filePath string, ttl int) (*SendResult, error) {
+	result, err := self.send(ctx, filePath, ttl)
+	if err != nil && ctx.Err() != nil {
+		return nil, makeSendError(SendCancelled, "Upload cancelled: %s", ctx.Err().Error()).withCause(ctx.Err())
+	}
+	return result, err
+}
+
+func (self *Client) send(ctx context.Context, filePath string, ttl int) (*SendResult, error) {
+	key, keystr, err := generateKey()
+	if err != nil {
+		return nil, makeSendError(KeyGenFailed, "Failed to generate encryption key: %s", err.Error())
+	}
+	idstr := deriveId(key)
+
+	stats, err := os.Stat(filePath)
+	if err != nil {
+		return nil, makeSendError(FileOpenFailed, "Failed to open file: %s", err.Error()).withCause(err)
+	}
+	if stats.IsDir() {
+		return nil, makeSendError(FileOpenFailed, "File is a directory")
+	}
+	fileSize := stats.Size()
+	basename := filepath.Base(filePath)
+
+	progress := self.newProgress()
+	progress.startPhase(PhaseRequestingTicket, 0)
+	info, err := self.VersionContext(ctx)
+	if err != nil {
+		var serverErr *ServerError
+		if errors.As(err, &serverErr) {
+			return nil, makeSendError(ServerFailed, "%s", err.Error()).withCause(err)
+		}
+		return nil, makeSendError(ConnectionFailed, "%s", err.Error()).withCause(err)
+	}
+	caps := info.Caps()
+	features, err := Negotiate(caps, self.creds)
+	if err != nil {
+		return nil, makeSendError(Incompatible, "%s", err.Error()).withCause(err)
+	}
+	if err = caps.CheckUpload(ttl, fileSize); err != nil {
+		return nil, makeSendError(UploadRejected, "%s", err.Error()).withCause(err)
+	}
+	self.logger.Printf("Using format %s and authentication scheme %q\n", features.Format, features.AuthScheme)
+
+	uploadRequest := &UploadRequest{
+		TTL:      ttl,
+		ObjectId: idstr,
+		Filesize: fileSize,
+		Complete: caps.Complete,
+	}
+	if features.AuthScheme == AuthLegacySecretKey {
+		uploadRequest.SecretKey = self.creds.SecretKey
+	}
+	requestBytes, err := json.Marshal(uploadRequest)
+	if err != nil {
+		return nil, makeSendError(UniverseFailed, "Failed to create JSON for upload request?  What? %s", err.Error())
+	}
+
+	// Only sign the request if the server understands signatures; a legacy server
+	// gets the key in the body instead.  This isn't retried: each /upload counts
+	// against the sender's rate limit and writes a fresh record.
+	resp, err := self.serverRequest(ctx, "POST", "/upload", requestBytes, features.AuthScheme != AuthLegacySecretKey, false)
+	if err != nil {
+		return nil, makeSendError(ConnectionFailed, "Failed to connect to secretshare server: %s", err.Error()).withCause(err)
+	}
+	defer resp.Body.Close()
+	reqId := resp.Header.Get("Secretshare-ReqId")
+	if resp.StatusCode != http.StatusOK {
+		serverErr := readServerError(resp)
+		switch {
+		case resp.StatusCode >= 500:
+			return nil, makeSendError(ServerFailed, "The secretshare server encountered an internal error; reqId=%s", reqId).withCause(serverErr)
+		case resp.StatusCode == http.StatusUnauthorized && self.creds.BearerToken != "":
+			return nil, makeSendError(AuthFailed, "Failed to authenticate to secretshare server (your login may have expired); reqId=%s", reqId).withCause(serverErr)
+		case resp.StatusCode == http.StatusUnauthorized:
+			return nil, makeSendError(AuthFailed, "Failed to authenticate to secretshare server; reqId=%s", reqId).withCause(serverErr)
+		case serverErr.Message != "":
+			return nil, makeSendError(UploadRejected, "The secretshare server refused the upload: %s", serverErr.Error()).withCause(serverErr)
+		}
+		return nil, makeSendError(UploadRejected, "The secretshare server responded with HTTP code %d, so the file cannot be uploaded; reqId=%s", resp.StatusCode, reqId).withCause(serverErr)
+	}
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, makeSendError(ServerFailed, "Error reading response from secretshare server: %s; reqId=%s", err.Error(), reqId)
+	}
+	var responseData UploadResponse
+	err = json.Unmarshal(bodyBytes, &responseData)
+	if err != nil {
+		return nil, makeSendError(ServerFailed, `Malformed response received from secretshare server: %s\n
+
+Response body:
+
+%s
+
+(request ID was %s)`, err.Error(), bodyBytes, reqId)
+	}
+
+	// The file is read again for each try.
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, makeSendError(FileOpenFailed, "Can't read file %s: %s", filePath, err.Error()).withCause(err)
+	}
+	f.Close()
+	openFile := func() (io.ReadCloser, error) {
+		f, err := os.Open(filePath)
+		if err != nil {
+			return nil, err
+		}
+		return &readCloser{bufio.NewReader(&contextReader{ctx, f}), f}, nil
+	}
+	progress.startPhase(PhaseUploadingData, fileSize)
+	size, err := self.uploadEncrypted(ctx, openFile, fileSize, responseData.PutURL, responseData.Headers, key, progress)
+	if ctx.Err() != nil {
+		return nil, makeSendError(SendCancelled, "Upload cancelled: %s", ctx.Err().Error()).withCause(ctx.Err())
+	}
+	if err != nil {
+		return nil, makeSendError(DataUploadFailed, "Failed to upload file: %s", err.Error()).withCause(err)
+	}
+
+	filemeta := FileMetadata{
+		Filename: basename,
+		Filesize: fileSize,
+	}
+	metabytes, err := json.Marshal(filemeta)
+
+	if err != nil {
+		return nil, makeSendError(UniverseFailed, "Failed to create JSON for file metadata?  What?  %s\n", err.Error())
+	}
+	openMeta := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(metabytes)), nil
+	}
+	progress.startPhase(PhaseUploadingMetadata, int64(len(metabytes)))
+	metaSize, err := self.uploadEncrypted(ctx, openMeta, int64(len(metabytes)), responseData.MetaPutURL, responseData.MetaHeaders, key, progress)
+	if err != nil {
+		return nil, makeSendError(MetadataUploadFailed, "Failed to upload file metadata: %s", err.Error()).withCause(err)
+	}
+
+	// Don't hand out a key until both objects are known to be there.
+	progress.startPhase(PhaseVerifying, 0)
+	verified, err := self.verifyUpload(ctx, caps, idstr, size, metaSize)
+	if err != nil {
+		return nil, makeSendError(UploadUnverified, "Failed to verify upload: %s", err.Error()).withCause(err)
+	}
+	progress.startPhase(PhaseDone, 0)
+
+	return &SendResult{
+		Key:      keystr,
+		Id:       idstr,
+		Verified: verified,
+	}, nil
+}
+
+// verifyUpload checks that both of a secret's objects are in storage at the sizes
+// that were uploaded.  The server checks if it can; otherwise, the client looks for
+// itself, which needs the bucket to be readable.  It returns false, and no error, if
+// there's no way to check.
+func (self *Client) verifyUpload(ctx context.Context, caps *Capabilities, id string, size, metaSize int64) (bool, error) {
+	if caps.Complete {
+		body, err := json.Marshal(&CompleteRequest{
+			Size:     size,
+			MetaSize: metaSize,
+		})
+		if err != nil {
+			return false, err
+		}
+		resp, err := self.serverRequest(ctx, "POST", "/secrets/"+url.PathEscape(id)+"/complete", body, true, true)
+		if err != nil {
+			return false, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			return false, readServerError(resp)
+		}
+		return true, nil
+	}
+
+	location, err := self.locate(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	if location.Bucket == "" || location.BucketRegion == "" {
+		self.logger.Printf("Not verifying upload: the server didn't say where the secret is stored, and no bucket is configured\n")
+		return false, nil
+	}
+	objects := []struct {
+		name string
+		size int64
+	}{
+		{url.QueryEscape(id), size},
+		{"meta/" + url.QueryEscape(id), metaSize},
+	}
+	for _, object := range objects {
+		actual, err := self.storageSize(ctx, location, object.name)
+		if err != nil {
+			return false, err
+		}
+		if actual != object.size {
+			return false, &kindError{
+				kind:    ErrStorageFailed,
+				message: fmt.Sprintf("%s is %d bytes in S3, not %d", object.name, actual, object.size),
+			}
+		}
+	}
+	return true, nil
+}
+
+// locate finds the bucket holding a secret: the server says if it can, and
+// otherwise the client assumes it's the one from WithStorage.  If the server says
+// the secret is gone or never existed, the error is a *RecvError saying which.
+func (self *Client) locate(ctx context.Context, id string) (*SecretLocation, error) {
+	if self.endpoint != "" {
+		location, err := self.locateOnServer(ctx, id)
+		if err == nil {
+			return location, nil
+		}
+		var serverErr *ServerError
+		if errors.As(err, &serverErr) {
+			switch serverErr.Code {
+			case CodeExpired:
+				return nil, makeRecvError(SecretExpired, "%s; ask the sender to send it again", serverErr.Message).withCause(err)
+			case CodeRevoked:
+				return nil, makeRecvError(SecretRevoked, "%s; ask the sender to send it again", serverErr.Message).withCause(err)
+			case CodeRetrieved:
+				return nil, makeRecvError(SecretRetrieved, "%s; ask the sender to send it again", serverErr.Message).withCause(err)
+			case CodeNotFound:
+				return nil, makeRecvError(SecretNotFound, "No such secret; check the key for typos").withCause(err)
+			case CodeIncompleteUpload:
+				return nil, makeRecvError(SecretIncomplete, "%s; try again later, or ask the sender to send it again", serverErr.Message).withCause(err)
+			}
+		}
+		self.logger.Printf("Failed to locate secret: %s\n", err.Error())
+	}
+	return &SecretLocation{
+		Bucket:       self.bucket,
+		BucketRegion: self.bucketRegion,
+	}, nil
+}
+
+// locateOnServer asks the secretshare server which bucket holds a secret.  Servers
+// with several tenants keep each tenant's secrets in a different bucket.
+func (self *Client) locateOnServer(ctx context.Context, id string) (*SecretLocation, error) {
+	resp, err := self.serverRequest(ctx, "GET", "/secrets/"+url.PathEscape(id)+"/location", nil, false, true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, readServerError(resp)
+	}
+	var location SecretLocation
+	if err = json.NewDecoder(resp.Body).Decode(&location); err != nil {
+		return nil, fmt.Errorf("Malformed response received from secretshare server: %s", err.Error())
+	}
+	return &location, nil
+}
+
+// reportRetrieval tells the secretshare server that a secret has been received.
+// Secrets are downloaded straight from S3, so the server has no other way of knowing.
+func (self *Client) reportRetrieval(ctx context.Context, id string) error {
+	// Each report is recorded, so don't repeat it.
+	resp, err := self.serverRequest(ctx, "POST", "/secrets/"+url.PathEscape(id)+"/retrieved", nil, false, false)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return readServerError(resp)
+	}
+	return nil
+}
+
+func s3URL(location *SecretLocation, name string) string {
+	return fmt.Sprintf("https://s3-%s.amazonaws.com/%s/%s",
+		url.QueryEscape(location.BucketRegion),
+		url.QueryEscape(location.Bucket),
+		name,
+	)
+}
+
+// storageGet downloads an object from S3.  The caller must close the response body.
+func (self *Client) storageGet(ctx context.Context, location *SecretLocation, name string) (*http.Response, error) {
+	objectURL := self.storageURL(location, name)
+	resp, err := self.do(ctx, true, func() (*http.Request, error) {
+		return http.NewRequest("GET", objectURL, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		// S3 says 403 rather than 404 for missing objects unless the client may list
+		// the bucket.
+		kind := ErrStorageFailed
+		if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden {
+			kind = ErrNotFound
+		}
+		return nil, &kindError{kind: kind, message: fmt.Sprintf("S3 server returned status '%d'", resp.StatusCode)}
+	}
+	return resp, nil
+}
+
+// storageSize returns the size of an object in S3.
+func (self *Client) storageSize(ctx context.Context, location *SecretLocation, name string) (int64, error) {
+	objectURL := self.storageURL(location, name)
+	resp, err := self.do(ctx, true, func() (*http.Request, error) {
+		return http.NewRequest("HEAD", objectURL, nil)
+	})
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden {
+		return 0, &kindError{kind: ErrStorageFailed, message: fmt.Sprintf("%s is missing from S3", name)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, &kindError{kind: ErrStorageFailed, message: fmt.Sprintf("S3 server returned status '%d'", resp.StatusCode)}
+	}
+	return resp.ContentLength, nil
+}
+
+// SecretDetails describes a secret without downloading it.
+type SecretDetails struct {
+	ObjectId string
+	Location *SecretLocation
+	Metadata *FileMetadata
+}
+
+// Inspect finds a secret and decrypts its metadata, but doesn't download the secret
+// itself.  Errors are *RecvError.
+func (self *Client) Inspect(key []byte) (*SecretDetails, error) {
+	return self.InspectContext(context.Background(), key)
+}
+
+// InspectContext is Inspect, but stops if ctx is cancelled or its deadline passes.
+// The error's code is then RecvCancelled.
+func (self *Client) InspectContext(ctx context.Context, key []byte) (*SecretDetails, error) {
+	details, err := self.inspect(ctx, key)
+	if err != nil && ctx.Err() != nil {
+		return nil, makeRecvError(RecvCancelled, "Download cancelled: %s", ctx.Err().Error()).withCause(ctx.Err())
+	}
+	return details, err
+}
+
+func (self *Client) inspect(ctx context.Context, key []byte) (*SecretDetails, error) {
+	id := deriveId(key)
+	location, err := self.locate(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if location.Bucket == "" || location.BucketRegion == "" {
+		return nil, makeRecvError(StorageUnknown, "The server didn't say where the secret is stored, and no bucket is configured")
+	}
+
+	resp, err := self.storageGet(ctx, location, "meta/"+url.QueryEscape(id))
+	if errors.Is(err, ErrNotFound) {
+		// Without the server, there's no telling a typo from a secret that's gone.
+		return nil, makeRecvError(SecretNotFound, "No such secret; check the key for typos.  If the key is right, the secret has expired or been deleted").withCause(err)
+	}
+	if err != nil {
+		return nil, makeRecvError(MetadataDownloadFailed, "Failed to download metadata file from S3: %s", err.Error()).withCause(err)
+	}
+	defer resp.Body.Close()
+	metabytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, makeRecvError(MetadataDownloadFailed, "Failed to read metadata from S3: %s", err.Error()).withCause(err)
+	}
+	realMeta, err := decrypt(metabytes, key)
+	if err != nil {
+		return nil, makeRecvError(DecryptionFailed, "Failed to decrypt metadata: %s", err.Error()).withCause(err)
+	}
+
+	var filemeta FileMetadata
+	err = json.Unmarshal(realMeta, &filemeta)
+	if err != nil {
+		// The metadata is always JSON, so garbage means the key is wrong.
+		return nil, makeRecvError(WrongKey, "The key does not decrypt this secret; check that it was copied correctly").withCause(err)
+	}
+	return &SecretDetails{
+		ObjectId: id,
+		Location: location,
+		Metadata: &filemeta,
+	}, nil
+}
+
+// ReceiveOptions changes where Receive saves a secret.
+type ReceiveOptions struct {
+	// Filename replaces the sender's name for the file.
+	Filename string
+	// Overwrite replaces an existing file, once the whole secret has been received,
+	// rather than failing with RecvFileExists.
+	Overwrite bool
+}
+
+// Receive downloads and decrypts a secret into destDir, and tells the server it has
+// been retrieved.  Errors are *RecvError.  If the file already exists, the error's
+// code is RecvFileExists and the secret's metadata is returned too.
+func (self *Client) Receive(key []byte, destDir string, options *ReceiveOptions) (*FileMetadata, error) {
+	return self.ReceiveContext(context.Background(), key, destDir, options)
+}
+
+// ReceiveContext is Receive, but stops if ctx is cancelled or its deadline passes.
+// The error's code is then RecvCancelled.  A partly written file is removed.
+func (self *Client) ReceiveContext(ctx context.Context, key []byte, destDir string, options *ReceiveOptions) (*FileMetadata, error) {
+	filemeta, err := self.receive(ctx, key, destDir, options)
+	if err != nil && ctx.Err() != nil {
+		return nil, makeRecvError(RecvCancelled, "Download cancelled: %s", ctx.Err().Error()).withCause(ctx.Err())
+	}
+	return filemeta, err
+}
+
+func (self *Client) receive(ctx context.Context, key []byte, destDir string, options *ReceiveOptions) (*FileMetadata, error) {
+	if options == nil {
+		options = &ReceiveOptions{}
+	}
+	progress := self.newProgress()
+	progress.startPhase(PhaseLocating, 0)
+	details, err := self.inspect(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	filemeta := details.Metadata
+
+	filename := filemeta.Filename
+	if options.Filename != "" {
+		filename = options.Filename
+	}
+	filePath := filepath.Join(destDir, filename)
+
+	// This is how you check if a file exists in Go.  Yep.
+	if _, err := os.Stat(filePath); err == nil && !options.Overwrite {
+		return filemeta, makeRecvError(RecvFileExists, "File already exists: %s", filePath)
+	}
+	// The secret is decrypted into a temporary file that only replaces filePath once
+	// it's all there, so a failed or cancelled download neither leaves a partial file
+	// behind nor loses the file it was going to overwrite.
+	outf, err := ioutil.TempFile(destDir, ".secretshare-")
+	if err != nil {
+		return nil, makeRecvError(RecvCreateFailed, "Failed to create file in %s: %s\n", destDir, err.Error()).withCause(err)
+	}
+	tempPath := outf.Name()
+	complete := false
+	defer func() {
+		if !complete {
+			outf.Close()
+			os.Remove(tempPath)
+		}
+	}()
+
+	resp, err := self.storageGet(ctx, details.Location, url.QueryEscape(details.ObjectId))
+	if errors.Is(err, ErrNotFound) {
+		return nil, makeRecvError(SecretNotFound, "The secret has been deleted from S3").withCause(err)
+	}
+	if err != nil {
+		return nil, makeRecvError(DataDownloadFailed, "Failed to download file from S3: %s", err.Error()).withCause(err)
+	}
+	defer resp.Body.Close()
+
+	progress.startPhase(PhaseDownloadingData, filemeta.Filesize)
+	decrypter, err := NewDecrypter(&contextReader{ctx, resp.Body}, filemeta.Filesize, key, nil)
+	if err != nil {
+		return nil, makeRecvError(DecryptionFailed, "Failed to initiate decryption: %s", err.Error()).withCause(err)
+	}
+	bytesWritten, err := io.Copy(outf, &progressReader{reader: decrypter, progress: progress})
+	self.logger.Printf("Wrote %d bytes\n", bytesWritten)
+	if err != nil {
+		return nil, makeRecvError(DecryptionFailed, "Failed to save decrypted file: %s", err.Error()).withCause(err)
+	}
+	if err = outf.Sync(); err == nil {
+		err = outf.Close()
+	}
+	if err == nil {
+		err = os.Rename(tempPath, filePath)
+	}
+	if err != nil {
+		return nil, makeRecvError(RecvCreateFailed, "Failed to save file %s: %s", filePath, err.Error()).withCause(err)
+	}
+	complete = true
+
+	if self.endpoint != "" {
+		if err = self.reportRetrieval(ctx, details.ObjectId); err != nil {
+			self.logger.Printf("Failed to report retrieval: %s\n", err.Error())
+		}
+	}
+	progress.startPhase(PhaseDone, 0)
+	return filemeta, nil
+}
+
+// Revoke deletes a secret before it expires.  Only administrators may revoke
+// secrets, so the client's credentials must be the server's admin_key or an
+// administrator's login.
+func (self *Client) Revoke(id string) error {
+	return self.RevokeContext(context.Background(), id)
+}
+
+func (self *Client) RevokeContext(ctx context.Context, id string) error {
+	resp, err := self.serverRequest(ctx, "DELETE", "/admin/secrets/"+url.PathEscape(id), nil, true, true)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to secretshare server: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	return fmt.Errorf("Failed to revoke secret: %w", readServerError(resp))
+}
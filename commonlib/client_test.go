@@ -0,0 +1,442 @@
+package commonlib
+
+// secretshare - share secrets securely
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// fakeServer plays both the secretshare server and S3.
+type fakeServer struct {
+	*httptest.Server
+	mutex   sync.Mutex
+	objects map[string][]byte
+	// versionFailures is how many requests for /version fail before one succeeds, and
+	// retryAfter goes in the Retry-After header of the failures.
+	versionFailures int
+	retryAfter      string
+	requests        map[string]int
+	retrieved       []string
+	// stall makes downloads of secrets (but not metadata) stop halfway until the
+	// client gives up.
+	stall bool
+	// uploadStatus, if set, is the response to uploads, with uploadError as the body.
+	uploadStatus int
+	uploadError  *ErrorResponse
+	// locationStatus and locationError are the same for requests for locations.
+	locationStatus int
+	locationError  *ErrorResponse
+	// complete makes the server offer to check uploads.
+	complete bool
+	// putStatus, if set, is the response to uploads to S3.  dropMeta makes S3 accept
+	// uploads of metadata but not keep them.
+	putStatus int
+	dropMeta  bool
+	completed []*CompleteRequest
+	// putFailures and getFailures are how many uploads to and downloads from S3 fail
+	// before one succeeds.  retrievedStatus, if set, is the response to reports of
+	// retrieval.
+	putFailures     int
+	getFailures     int
+	retrievedStatus int
+	// uploads are the requests made to /upload.
+	uploads []*UploadRequest
+}
+
+func newFakeServer(c *C) *fakeServer {
+	fake := &fakeServer{
+		objects:  make(map[string][]byte),
+		requests: make(map[string]int),
+	}
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fake.mutex.Lock()
+		fake.requests[r.Method+" "+r.URL.Path]++
+		switch {
+		case r.URL.Path == "/version":
+			if fake.versionFailures > 0 {
+				fake.versionFailures--
+				if fake.retryAfter != "" {
+					w.Header().Set("Retry-After", fake.retryAfter)
+				}
+				w.WriteHeader(http.StatusServiceUnavailable)
+				break
+			}
+			json.NewEncoder(w).Encode(&ServerVersionResponse{
+				APIVersion: APIVersion,
+				Capabilities: &Capabilities{
+					Formats:     []string{FormatAES256CBC},
+					AuthSchemes: []string{AuthSignature},
+					Storage:     StorageS3,
+					Complete:    fake.complete,
+				},
+			})
+		case r.URL.Path == "/upload" && fake.uploadStatus != 0:
+			w.WriteHeader(fake.uploadStatus)
+			json.NewEncoder(w).Encode(fake.uploadError)
+		case r.URL.Path == "/upload":
+			body, _ := ioutil.ReadAll(r.Body)
+			sig, ok, err := ParseSignatureHeader(r.Header.Get("Authorization"))
+			c.Assert(err, IsNil)
+			c.Assert(ok, Equals, true)
+			c.Check(sig.Verify("hunter2", r.Method, r.URL.Path, body), IsNil)
+			var requestData UploadRequest
+			c.Assert(json.Unmarshal(body, &requestData), IsNil)
+			fake.uploads = append(fake.uploads, &requestData)
+			json.NewEncoder(w).Encode(&UploadResponse{
+				PutURL:     fake.URL + "/s3/" + requestData.ObjectId,
+				MetaPutURL: fake.URL + "/s3/meta/" + requestData.ObjectId,
+			})
+		case strings.HasPrefix(r.URL.Path, "/s3/") && r.Method == "PUT":
+			data, _ := ioutil.ReadAll(r.Body)
+			if fake.putFailures > 0 {
+				fake.putFailures--
+				w.WriteHeader(http.StatusServiceUnavailable)
+				break
+			}
+			if fake.putStatus != 0 {
+				w.WriteHeader(fake.putStatus)
+				break
+			}
+			if !fake.dropMeta || !strings.HasPrefix(r.URL.Path, "/s3/meta/") {
+				fake.objects[strings.TrimPrefix(r.URL.Path, "/s3/")] = data
+			}
+		case strings.HasPrefix(r.URL.Path, "/s3/") && fake.getFailures > 0:
+			fake.getFailures--
+			w.WriteHeader(http.StatusBadGateway)
+		case strings.HasPrefix(r.URL.Path, "/s3/"):
+			data, ok := fake.objects[strings.TrimPrefix(r.URL.Path, "/s3/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				break
+			}
+			if !fake.stall || strings.HasPrefix(r.URL.Path, "/s3/meta/") {
+				w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+				w.Write(data)
+				break
+			}
+			fake.mutex.Unlock()
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.Write(data[:len(data)/2])
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		case strings.HasSuffix(r.URL.Path, "/location") && fake.locationStatus != 0:
+			w.WriteHeader(fake.locationStatus)
+			json.NewEncoder(w).Encode(fake.locationError)
+		case strings.HasSuffix(r.URL.Path, "/location"):
+			json.NewEncoder(w).Encode(&SecretLocation{Bucket: "bucket", BucketRegion: "region"})
+		case strings.HasSuffix(r.URL.Path, "/complete"):
+			id := strings.Split(r.URL.Path, "/")[2]
+			var requestData CompleteRequest
+			c.Assert(json.NewDecoder(r.Body).Decode(&requestData), IsNil)
+			fake.completed = append(fake.completed, &requestData)
+			if int64(len(fake.objects[id])) != requestData.Size || int64(len(fake.objects["meta/"+id])) != requestData.MetaSize {
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(&ErrorResponse{Code: CodeIncompleteUpload, Message: "meta/" + id + " is missing from storage"})
+				break
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case strings.HasSuffix(r.URL.Path, "/retrieved") && fake.retrievedStatus != 0:
+			w.WriteHeader(fake.retrievedStatus)
+		case strings.HasSuffix(r.URL.Path, "/retrieved"):
+			fake.retrieved = append(fake.retrieved, strings.Split(r.URL.Path, "/")[2])
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+		fake.mutex.Unlock()
+	}))
+	return fake
+}
+
+// client returns a Client that talks to the fake server for everything.  It retries
+// without waiting, unless told otherwise.
+func (self *fakeServer) client(options ...ClientOption) *Client {
+	options = append([]ClientOption{
+		WithEndpoint(self.URL + "/"),
+		WithCredentials(&Credentials{SecretKey: "hunter2"}),
+		WithHTTPClient(self.Client()),
+		WithRetryPolicy(RetryPolicy{Attempts: 3}),
+	}, options...)
+	client := NewClient(options...)
+	client.storageURL = func(location *SecretLocation, name string) string {
+		return self.URL + "/s3/" + name
+	}
+	return client
+}
+
+type ClientSuite struct{}
+
+var _ = Suite(&ClientSuite{})
+
+func (s *ClientSuite) TestSendReceive(c *C) {
+	fake := newFakeServer(c)
+	defer fake.Close()
+	srcDir, destDir := c.MkDir(), c.MkDir()
+	content := []byte(strings.Repeat("This is a test\n", 1000))
+	c.Assert(ioutil.WriteFile(filepath.Join(srcDir, "test.txt"), content, 0600), IsNil)
+
+	var progress []*ProgressRecord
+	client := fake.client(WithProgress(func(record *ProgressRecord) {
+		progress = append(progress, record)
+	}))
+	result, err := client.Send(filepath.Join(srcDir, "test.txt"), 60)
+	c.Assert(err, IsNil)
+	c.Assert(progress, Not(HasLen), 0)
+	c.Assert(progress[len(progress)-1].Value, Equals, progress[len(progress)-1].Total)
+
+	key, err := DecodeForHuman(result.Key)
+	c.Assert(err, IsNil)
+	details, err := client.Inspect(key)
+	c.Assert(err, IsNil)
+	c.Assert(details.ObjectId, Equals, result.Id)
+	c.Assert(*details.Location, Equals, SecretLocation{Bucket: "bucket", BucketRegion: "region"})
+	c.Assert(*details.Metadata, Equals, FileMetadata{Filename: "test.txt", Filesize: int64(len(content))})
+
+	filemeta, err := client.Receive(key, destDir, nil)
+	c.Assert(err, IsNil)
+	c.Assert(filemeta.Filename, Equals, "test.txt")
+	received, err := ioutil.ReadFile(filepath.Join(destDir, "test.txt"))
+	c.Assert(err, IsNil)
+	c.Assert(received, DeepEquals, content)
+	c.Assert(fake.retrieved, DeepEquals, []string{result.Id})
+
+	// Receiving again doesn't overwrite the file unless asked to.
+	filemeta, err = client.Receive(key, destDir, nil)
+	c.Assert(err, FitsTypeOf, &RecvError{})
+	c.Assert(err.(*RecvError).Code, Equals, RecvFileExists)
+	c.Assert(filemeta.Filename, Equals, "test.txt")
+	_, err = client.Receive(key, destDir, &ReceiveOptions{Filename: "test.txt", Overwrite: true})
+	c.Assert(err, IsNil)
+}
+
+func (s *ClientSuite) TestStorageUnknown(c *C) {
+	client := NewClient()
+	_, err := client.Receive(make([]byte, 32), c.MkDir(), nil)
+	c.Assert(err, FitsTypeOf, &RecvError{})
+	c.Assert(err.(*RecvError).Code, Equals, StorageUnknown)
+}
+
+func (s *ClientSuite) TestRetry(c *C) {
+	fake := newFakeServer(c)
+	defer fake.Close()
+
+	fake.versionFailures = 2
+	_, err := fake.client(WithRetryPolicy(NoRetries)).Version()
+	c.Assert(err, NotNil)
+
+	fake.versionFailures = 2
+	info, err := fake.client().Version()
+	c.Assert(err, IsNil)
+	c.Assert(info.APIVersion, Equals, APIVersion)
+
+	// Retry-After is honoured, unless it asks for too long a wait.
+	fake.versionFailures = 1
+	fake.retryAfter = "1"
+	start := time.Now()
+	_, err = fake.client().Version()
+	c.Assert(err, IsNil)
+	c.Assert(time.Since(start) >= time.Second, Equals, true)
+	fake.versionFailures = 1
+	_, err = fake.client(WithRetryPolicy(RetryPolicy{Attempts: 3, MaxDelay: time.Millisecond})).Version()
+	var serverErr *ServerError
+	c.Assert(errors.As(err, &serverErr), Equals, true)
+	c.Assert(serverErr.RetryAfter, Equals, time.Second)
+	fake.versionFailures = 0
+
+	// Uploads to and downloads from S3 are retried.
+	path := filepath.Join(c.MkDir(), "test.txt")
+	content := []byte(strings.Repeat("This is a test\n", 100))
+	c.Assert(ioutil.WriteFile(path, content, 0600), IsNil)
+	fake.putFailures = 2
+	result, err := fake.client().Send(path, 60)
+	c.Assert(err, IsNil)
+	c.Assert(fake.requests["PUT /s3/"+result.Id], Equals, 3)
+
+	key, err := DecodeForHuman(result.Key)
+	c.Assert(err, IsNil)
+	fake.getFailures = 2
+	_, err = fake.client().Receive(key, c.MkDir(), nil)
+	c.Assert(err, IsNil)
+
+	// Reports of retrieval aren't, since the server counts them.
+	fake.retrievedStatus = http.StatusServiceUnavailable
+	_, err = fake.client().Receive(key, c.MkDir(), nil)
+	c.Assert(err, IsNil)
+	c.Assert(fake.requests["POST /secrets/"+result.Id+"/retrieved"], Equals, 2)
+
+	// Neither are requests for upload URLs.
+	fake.uploadStatus = http.StatusServiceUnavailable
+	fake.uploadError = &ErrorResponse{Message: "Try again later"}
+	uploads := fake.requests["POST /upload"]
+	_, err = fake.client().Send(path, 60)
+	c.Assert(err, NotNil)
+	c.Assert(fake.requests["POST /upload"], Equals, uploads+1)
+}
+
+func (s *ClientSuite) TestBackoff(c *C) {
+	policy := RetryPolicy{Delay: time.Second, MaxDelay: 5 * time.Second}
+	c.Assert(policy.backoff(1), Equals, time.Second)
+	c.Assert(policy.backoff(2), Equals, 2*time.Second)
+	c.Assert(policy.backoff(3), Equals, 4*time.Second)
+	c.Assert(policy.backoff(4), Equals, 5*time.Second)
+	c.Assert(policy.backoff(100), Equals, 5*time.Second)
+
+	policy.Jitter = 1
+	for i := 0; i < 100; i++ {
+		delay := policy.backoff(2)
+		c.Assert(delay >= 0 && delay <= 2*time.Second, Equals, true)
+	}
+
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	wait, ok := parseRetryAfter("120", now)
+	c.Assert(ok, Equals, true)
+	c.Assert(wait, Equals, 2*time.Minute)
+	wait, ok = parseRetryAfter("Fri, 01 Jan 2016 00:00:30 GMT", now)
+	c.Assert(ok, Equals, true)
+	c.Assert(wait, Equals, 30*time.Second)
+	_, ok = parseRetryAfter("soon", now)
+	c.Assert(ok, Equals, false)
+	_, ok = parseRetryAfter("", now)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *ClientSuite) TestCancel(c *C) {
+	fake := newFakeServer(c)
+	defer fake.Close()
+	srcDir, destDir := c.MkDir(), c.MkDir()
+	content := make([]byte, 1<<20)
+	c.Assert(ioutil.WriteFile(filepath.Join(srcDir, "test.bin"), content, 0600), IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := fake.client().SendContext(ctx, filepath.Join(srcDir, "test.bin"), 60)
+	c.Assert(err, FitsTypeOf, &SendError{})
+	c.Assert(err.(*SendError).Code, Equals, SendCancelled)
+
+	result, err := fake.client().Send(filepath.Join(srcDir, "test.bin"), 60)
+	c.Assert(err, IsNil)
+	key, err := DecodeForHuman(result.Key)
+	c.Assert(err, IsNil)
+
+	// Cancel once part of the secret has arrived.
+	fake.stall = true
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	client := fake.client(WithProgress(func(*ProgressRecord) {
+		cancel()
+	}))
+	_, err = client.ReceiveContext(ctx, key, destDir, nil)
+	c.Assert(err, FitsTypeOf, &RecvError{})
+	c.Assert(err.(*RecvError).Code, Equals, RecvCancelled)
+
+	// The partial file is gone, and the retrieval wasn't reported.
+	_, err = os.Stat(filepath.Join(destDir, "test.bin"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+	c.Assert(fake.retrieved, HasLen, 0)
+
+	// A file that was going to be overwritten is left alone.
+	c.Assert(ioutil.WriteFile(filepath.Join(destDir, "test.bin"), []byte("original"), 0600), IsNil)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	client = fake.client(WithProgress(func(*ProgressRecord) {
+		cancel()
+	}))
+	_, err = client.ReceiveContext(ctx, key, destDir, &ReceiveOptions{Overwrite: true})
+	c.Assert(err, FitsTypeOf, &RecvError{})
+	original, err := ioutil.ReadFile(filepath.Join(destDir, "test.bin"))
+	c.Assert(err, IsNil)
+	c.Assert(string(original), Equals, "original")
+	files, err := ioutil.ReadDir(destDir)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 1)
+}
+
+func (s *ClientSuite) TestLegacyWrappers(c *C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "missing.txt")
+	progressChan := make(chan *ProgressRecord, 10)
+	_, _, err := SendSecret("http://localhost:0", "bucket", "region", &Credentials{}, path, 60, progressChan)
+	c.Assert(err, NotNil)
+	c.Assert(err.Code, Equals, FileOpenFailed)
+	// The channel is closed even on failure.
+	_, open := <-progressChan
+	c.Assert(open, Equals, false)
+}
+
+func (s *ClientSuite) TestVerifyUpload(c *C) {
+	fake := newFakeServer(c)
+	defer fake.Close()
+	path := filepath.Join(c.MkDir(), "test.txt")
+	content := []byte(strings.Repeat("This is a test\n", 100))
+	c.Assert(ioutil.WriteFile(path, content, 0600), IsNil)
+
+	// Failed uploads aren't ignored.
+	fake.putStatus = http.StatusForbidden
+	_, err := fake.client().Send(path, 60)
+	c.Assert(err, FitsTypeOf, &SendError{})
+	c.Assert(err.(*SendError).Code, Equals, DataUploadFailed)
+	fake.putStatus = 0
+
+	// If neither the server nor the client knows where the secret went, the result
+	// says it wasn't checked.
+	fake.locationStatus = http.StatusInternalServerError
+	result, err := fake.client().Send(path, 60)
+	c.Assert(err, IsNil)
+	c.Assert(result.Verified, Equals, false)
+	fake.locationStatus = 0
+
+	// The client looks in the bucket itself if the server can't.
+	fake.dropMeta = true
+	_, err = fake.client().Send(path, 60)
+	c.Assert(err, FitsTypeOf, &SendError{})
+	c.Assert(err.(*SendError).Code, Equals, UploadUnverified)
+	c.Assert(err, ErrorMatches, "Failed to verify upload: meta/.* is missing from S3")
+
+	fake.complete = true
+	_, err = fake.client().Send(path, 60)
+	c.Assert(err, FitsTypeOf, &SendError{})
+	c.Assert(err.(*SendError).Code, Equals, UploadUnverified)
+	var serverErr *ServerError
+	c.Assert(errors.As(err, &serverErr), Equals, true)
+	c.Assert(serverErr.Code, Equals, CodeIncompleteUpload)
+
+	fake.dropMeta = false
+	fake.completed = nil
+	fake.uploads = nil
+	result, err = fake.client().Send(path, 60)
+	c.Assert(err, IsNil)
+	c.Assert(result.Verified, Equals, true)
+	// The client promised to confirm the upload, and did.
+	c.Assert(fake.uploads[0].Complete, Equals, true)
+	c.Assert(fake.completed, HasLen, 1)
+	c.Assert(fake.completed[0].Size, Equals, int64(len(fake.objects[result.Id])))
+	c.Assert(fake.completed[0].MetaSize, Equals, int64(len(fake.objects["meta/"+result.Id])))
+}
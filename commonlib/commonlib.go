@@ -21,10 +21,11 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 )
 
 var (
-	APIVersion                  = 3
+	APIVersion                  = 4
 	DEBUG                       = false
 	BadBlockSizeError           = errors.New("Block size is >256?  WTF?")
 	ShortReadError              = errors.New("Read was truncated, but then read more data!  This should never happen!")
@@ -44,6 +45,9 @@ var (
 var Version string
 
 type ErrorResponse struct {
+	// Code is one of the Code constants.  Servers older than this client don't
+	// send it.
+	Code    string `json:"code,omitempty"`
 	Message string `json:"message"`
 }
 
@@ -55,9 +59,30 @@ type UploadResponse struct {
 }
 
 type UploadRequest struct {
-	TTL       int    `json:"ttl"`
-	SecretKey string `json:"secret_key"`
+	TTL int `json:"ttl"`
+	// SecretKey is only sent by API version 3 clients.  Newer clients sign the request instead.
+	SecretKey string `json:"secret_key,omitempty"`
 	ObjectId  string `json:"object_id"`
+	// Filesize is the size of the unencrypted file.  It is informational only.
+	Filesize int64 `json:"filesize,omitempty"`
+	// Complete promises that the client will confirm the upload with POST
+	// /secrets/{id}/complete.  Servers with a database won't let anyone receive the
+	// secret until it does.
+	Complete bool `json:"complete,omitempty"`
+}
+
+// CompleteRequest gives the sizes of the encrypted objects a client uploaded, so that
+// the server can check that both arrived intact.
+type CompleteRequest struct {
+	Size     int64 `json:"size"`
+	MetaSize int64 `json:"meta_size"`
+}
+
+// SecretLocation says where a secret is stored.  Servers with several tenants keep
+// each tenant's secrets in a different bucket.
+type SecretLocation struct {
+	Bucket       string `json:"bucket"`
+	BucketRegion string `json:"bucket_region"`
 }
 
 type FileMetadata struct {
@@ -66,9 +91,12 @@ type FileMetadata struct {
 }
 
 type ServerVersionResponse struct {
-	ServerVersion        string `json:"server_version"`
-	APIVersion           int    `json:"api_version"`
-	ServerSourceLocation string `json:"server_source"`
+	ServerVersion string `json:"server_version"`
+	// APIVersion stays at 4 because older clients refuse to talk to a server with a
+	// different one.  New features are advertised in Capabilities instead.
+	APIVersion           int           `json:"api_version"`
+	ServerSourceLocation string        `json:"server_source"`
+	Capabilities         *Capabilities `json:"capabilities,omitempty"`
 }
 
 func DEBUGPrintf(format string, args ...interface{}) {
@@ -92,3 +120,19 @@ func EncodeForHuman(bindata []byte) string {
 func DecodeForHuman(human string) ([]byte, error) {
 	return Encoding.DecodeString(human)
 }
+
+// ReceiveLink returns a link to the web UI's receive page for a key.  The key goes in
+// the fragment, which browsers never send to the server.
+func ReceiveLink(endpoint, keystr string) string {
+	return strings.TrimRight(endpoint, "/") + "/r#" + keystr
+}
+
+// KeyFromLink returns the key from a link made by ReceiveLink.  Anything else is
+// assumed to be a bare key and returned as it is.
+func KeyFromLink(link string) string {
+	link = strings.TrimSpace(link)
+	if i := strings.LastIndex(link, "#"); i >= 0 {
+		return link[i+1:]
+	}
+	return link
+}
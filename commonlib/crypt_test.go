@@ -23,6 +23,7 @@ import (
 	"crypto/rand"
 	"fmt"
 	. "gopkg.in/check.v1"
+	"io"
 	"io/ioutil"
 	"testing"
 )
@@ -102,3 +103,31 @@ func (s *CryptSuite) TestEncryptDecrypt(c *C) {
 	fmt.Println("Testing with data size 100 * aes.BlockSize, buffer size aes.BlockSize * 4")
 	checkBufRoundTrip(c, 100*aes.BlockSize, aes.BlockSize*4)
 }
+
+func (s *CryptSuite) TestReadAfterEOF(c *C) {
+	key := make([]byte, aes.BlockSize)
+	_, err := rand.Read(key)
+	c.Assert(err, IsNil)
+	content := bytes.Repeat([]byte("x"), 3*aes.BlockSize)
+	encrypter, err := NewEncrypter(bytes.NewReader(content), int64(len(content)), key, nil)
+	c.Assert(err, IsNil)
+
+	// The header and every block fit exactly, so the final block fills the buffer.
+	buf := make([]byte, encrypter.TotalSize)
+	n, err := io.ReadFull(encrypter, buf)
+	c.Assert(err, IsNil)
+	c.Assert(int64(n), Equals, encrypter.TotalSize)
+
+	// Reading again says EOF, rather than failing, however many times it's asked.
+	for i := 0; i < 2; i++ {
+		n, err = encrypter.Read(make([]byte, aes.BlockSize))
+		c.Assert(n, Equals, 0)
+		c.Assert(err, Equals, io.EOF)
+	}
+
+	decrypter, err := NewDecrypter(bytes.NewReader(buf), int64(len(content)), key, nil)
+	c.Assert(err, IsNil)
+	decrypted, err := ioutil.ReadAll(decrypter)
+	c.Assert(err, IsNil)
+	c.Assert(decrypted, DeepEquals, content)
+}
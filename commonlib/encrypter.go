@@ -134,7 +134,6 @@ func (self *Encrypter) readBlock() error {
 }
 
 func (self *Encrypter) Read(p []byte) (int, error) {
-	var eof error = nil
 	var bytesWritten int = 0
 	defer func() {
 		if self.progressChan != nil {
@@ -162,12 +161,8 @@ func (self *Encrypter) Read(p []byte) (int, error) {
 		}
 		self.headerWritten = true
 		err := self.readBlock()
-		if err != nil {
-			if err != io.EOF {
-				return bytesWritten, err
-			} else {
-				eof = err
-			}
+		if err != nil && err != io.EOF {
+			return bytesWritten, err
 		}
 	}
 
@@ -180,21 +175,22 @@ func (self *Encrypter) Read(p []byte) (int, error) {
 		}
 		if self.blockPos >= len(self.nextBlock) {
 			err := self.readBlock()
-			if err != nil {
-				if err != io.EOF {
-					return bytesWritten, err
-				} else {
-					eof = err
-				}
+			if err != nil && err != io.EOF {
+				return bytesWritten, err
 			}
 		}
 	}
 
 	DEBUGPrintf("Encrypter: Wrote %d bytes total\n", bytesWritten)
-	if eof != nil {
+	// There's no next block once the stream has hit EOF and the last block has all
+	// been written; p may have filled up before then.  Keep saying EOF after that,
+	// since net/http reads again to check for extra data.
+	if self.nextBlock == nil {
 		DEBUGPrintf("Encrypter: Hit EOF!\n")
-	} else if bytesWritten == 0 {
+		return bytesWritten, io.EOF
+	}
+	if bytesWritten == 0 {
 		return bytesWritten, EncrypterWeirdEOFError
 	}
-	return bytesWritten, eof
+	return bytesWritten, nil
 }
@@ -0,0 +1,168 @@
+package commonlib
+
+// secretshare - share secrets securely
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Codes in ErrorResponse.  These are stable, so clients may rely on them.
+const (
+	CodeBadRequest  = "bad_request"
+	CodeInvalidTTL  = "invalid_ttl"
+	CodeAuthFailed  = "auth_failed"
+	CodeForbidden   = "forbidden"
+	CodeNotFound    = "not_found"
+	CodeTooLarge    = "too_large"
+	CodeRateLimited = "rate_limited"
+	CodeNoDatabase  = "no_database"
+	CodeInternal    = "internal"
+	CodeExpired     = "expired"
+	CodeRevoked     = "revoked"
+	CodeRetrieved   = "retrieved"
+	// CodeIncompleteUpload means an object is missing or the wrong size.
+	CodeIncompleteUpload = "incomplete_upload"
+)
+
+// The kinds of failure a caller might want to handle differently.  The errors
+// returned by Client (SendError, RecvError and ServerError) match them with errors.Is.
+var (
+	ErrBadRequest       = errors.New("The secretshare server rejected the request")
+	ErrInvalidTTL       = errors.New("The secretshare server does not allow that TTL")
+	ErrAuthFailed       = errors.New("Failed to authenticate to secretshare server")
+	ErrForbidden        = errors.New("The secretshare server refused permission")
+	ErrNotFound         = errors.New("No such secret")
+	ErrExpired          = errors.New("The secret has expired")
+	ErrRevoked          = errors.New("The secret was revoked")
+	ErrRetrieved        = errors.New("The secret was already retrieved")
+	ErrWrongKey         = errors.New("The key does not decrypt the secret")
+	ErrTooLarge         = errors.New("The file is larger than the secretshare server allows")
+	ErrRateLimited      = errors.New("Too many requests to the secretshare server")
+	ErrIncompatible     = errors.New("The secretshare server and client are incompatible")
+	ErrConnectionFailed = errors.New("Failed to connect to secretshare server")
+	ErrServerFailed     = errors.New("The secretshare server failed")
+	ErrStorageFailed    = errors.New("Failed to transfer the secret to or from S3")
+	ErrStorageUnknown   = errors.New("The secret's storage location is unknown")
+	ErrFileExists       = errors.New("File already exists")
+	ErrLocalFile        = errors.New("Failed to read or write a local file")
+	ErrDecryption       = errors.New("Failed to decrypt the secret")
+	ErrCancelled        = errors.New("Cancelled")
+)
+
+// kindError is an error of one of the kinds above with a more specific message, and
+// perhaps the error that caused it.
+type kindError struct {
+	kind    error
+	message string
+	cause   error
+}
+
+func (self *kindError) Error() string {
+	return self.message
+}
+
+func (self *kindError) Is(target error) bool {
+	return target == self.kind
+}
+
+func (self *kindError) Unwrap() error {
+	return self.cause
+}
+
+var codeKinds = map[string]error{
+	CodeBadRequest:  ErrBadRequest,
+	CodeInvalidTTL:  ErrInvalidTTL,
+	CodeAuthFailed:  ErrAuthFailed,
+	CodeForbidden:   ErrForbidden,
+	CodeNotFound:    ErrNotFound,
+	CodeTooLarge:    ErrTooLarge,
+	CodeRateLimited: ErrRateLimited,
+	CodeInternal:    ErrServerFailed,
+	CodeExpired:     ErrExpired,
+	CodeRevoked:     ErrRevoked,
+	CodeRetrieved:   ErrRetrieved,
+
+	CodeIncompleteUpload: ErrStorageFailed,
+}
+
+var statusKinds = map[int]error{
+	http.StatusBadRequest:            ErrBadRequest,
+	http.StatusUnauthorized:          ErrAuthFailed,
+	http.StatusForbidden:             ErrForbidden,
+	http.StatusNotFound:              ErrNotFound,
+	http.StatusRequestEntityTooLarge: ErrTooLarge,
+	http.StatusTooManyRequests:       ErrRateLimited,
+}
+
+// ServerError is an error response from the secretshare server.
+type ServerError struct {
+	StatusCode int
+	// Code and Message are from the ErrorResponse, if the server sent one.
+	Code    string
+	Message string
+	// ReqId identifies the request in the server's logs.
+	ReqId string
+	// RetryAfter is how long the server asked the client to wait, if it did.
+	RetryAfter time.Duration
+}
+
+func (self *ServerError) Error() string {
+	message := self.Message
+	if message == "" {
+		message = fmt.Sprintf("The secretshare server responded with HTTP code %d", self.StatusCode)
+	}
+	if self.ReqId != "" {
+		message = fmt.Sprintf("%s; reqId=%s", message, self.ReqId)
+	}
+	return message
+}
+
+// Is matches the error kind for the server's code, or for the HTTP status if the
+// server is too old to send codes.
+func (self *ServerError) Is(target error) bool {
+	if kind, ok := codeKinds[self.Code]; ok {
+		return target == kind
+	}
+	if kind, ok := statusKinds[self.StatusCode]; ok {
+		return target == kind
+	}
+	return self.StatusCode >= 500 && target == ErrServerFailed
+}
+
+// readServerError reads an error response.  It doesn't close the body.
+func readServerError(resp *http.Response) *ServerError {
+	serverErr := &ServerError{
+		StatusCode: resp.StatusCode,
+		ReqId:      resp.Header.Get("Secretshare-ReqId"),
+	}
+	if wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+		serverErr.RetryAfter = wait
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var errResp ErrorResponse
+	if json.Unmarshal(body, &errResp) == nil {
+		serverErr.Code = errResp.Code
+		serverErr.Message = errResp.Message
+	}
+	return serverErr
+}
@@ -0,0 +1,126 @@
+package commonlib
+
+// secretshare - share secrets securely
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type ErrorsSuite struct{}
+
+var _ = Suite(&ErrorsSuite{})
+
+func (s *ErrorsSuite) TestServerErrorKinds(c *C) {
+	err := &ServerError{StatusCode: http.StatusBadRequest, Code: CodeInvalidTTL}
+	c.Assert(errors.Is(err, ErrInvalidTTL), Equals, true)
+	c.Assert(errors.Is(err, ErrBadRequest), Equals, false)
+
+	// Older servers don't send codes, so the status has to do.
+	err = &ServerError{StatusCode: http.StatusNotFound}
+	c.Assert(errors.Is(err, ErrNotFound), Equals, true)
+	err = &ServerError{StatusCode: http.StatusBadGateway}
+	c.Assert(errors.Is(err, ErrServerFailed), Equals, true)
+}
+
+func (s *ErrorsSuite) TestSendErrorKinds(c *C) {
+	fake := newFakeServer(c)
+	defer fake.Close()
+	path := filepath.Join(c.MkDir(), "test.txt")
+	c.Assert(ioutil.WriteFile(path, []byte("test"), 0600), IsNil)
+
+	fake.uploadStatus = http.StatusUnauthorized
+	fake.uploadError = &ErrorResponse{Code: CodeAuthFailed, Message: "Authentication failed"}
+	_, err := fake.client().Send(path, 60)
+	c.Assert(errors.Is(err, ErrAuthFailed), Equals, true)
+	c.Assert(err.(*SendError).Code, Equals, AuthFailed)
+
+	fake.uploadStatus = http.StatusRequestEntityTooLarge
+	fake.uploadError = &ErrorResponse{Code: CodeTooLarge, Message: "File too large"}
+	_, err = fake.client().Send(path, 60)
+	c.Assert(errors.Is(err, ErrTooLarge), Equals, true)
+	c.Assert(errors.Is(err, ErrAuthFailed), Equals, false)
+	var serverErr *ServerError
+	c.Assert(errors.As(err, &serverErr), Equals, true)
+	c.Assert(serverErr.Message, Equals, "File too large")
+
+	_, err = fake.client().Send(filepath.Join(c.MkDir(), "missing.txt"), 60)
+	c.Assert(errors.Is(err, ErrLocalFile), Equals, true)
+
+	_, err = NewClient(WithEndpoint("http://localhost:0"), WithCredentials(&Credentials{SecretKey: "hunter2"}), WithRetryPolicy(NoRetries)).Send(path, 60)
+	c.Assert(errors.Is(err, ErrConnectionFailed), Equals, true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = fake.client().SendContext(ctx, path, 60)
+	c.Assert(errors.Is(err, ErrCancelled), Equals, true)
+	c.Assert(errors.Is(err, context.Canceled), Equals, true)
+}
+
+func (s *ErrorsSuite) TestRecvErrorKinds(c *C) {
+	_, err := NewClient().Receive(make([]byte, 32), c.MkDir(), nil)
+	c.Assert(errors.Is(err, ErrStorageUnknown), Equals, true)
+	c.Assert(errors.Is(err, ErrFileExists), Equals, false)
+
+	fake := newFakeServer(c)
+	defer fake.Close()
+	path := filepath.Join(c.MkDir(), "test.txt")
+	c.Assert(ioutil.WriteFile(path, []byte("test"), 0600), IsNil)
+	result, err := fake.client().Send(path, 60)
+	c.Assert(err, IsNil)
+	key, err := DecodeForHuman(result.Key)
+	c.Assert(err, IsNil)
+
+	// A key nobody sent a secret with.
+	_, err = fake.client().Receive(make([]byte, 32), c.MkDir(), nil)
+	c.Assert(errors.Is(err, ErrNotFound), Equals, true)
+	c.Assert(err.(*RecvError).Code, Equals, SecretNotFound)
+
+	// The metadata decrypts to garbage.
+	meta := fake.objects["meta/"+result.Id]
+	meta[len(meta)-1] ^= 0xff
+	_, err = fake.client().Receive(key, c.MkDir(), nil)
+	c.Assert(errors.Is(err, ErrWrongKey), Equals, true)
+
+	fake.locationStatus = http.StatusGone
+	fake.locationError = &ErrorResponse{Code: CodeExpired, Message: "The secret expired at 2016-01-02T15:04:05Z"}
+	_, err = fake.client().Receive(key, c.MkDir(), nil)
+	c.Assert(errors.Is(err, ErrExpired), Equals, true)
+	c.Assert(err.(*RecvError).Code, Equals, SecretExpired)
+	c.Assert(err, ErrorMatches, "The secret expired at 2016-01-02T15:04:05Z; .*")
+
+	fake.locationError = &ErrorResponse{Code: CodeRevoked, Message: "The secret was revoked by an administrator"}
+	_, err = fake.client().Receive(key, c.MkDir(), nil)
+	c.Assert(errors.Is(err, ErrRevoked), Equals, true)
+
+	fake.locationStatus = http.StatusConflict
+	fake.locationError = &ErrorResponse{Code: CodeIncompleteUpload, Message: "The sender hasn't finished uploading the secret"}
+	_, err = fake.client().Receive(key, c.MkDir(), nil)
+	c.Assert(err.(*RecvError).Code, Equals, SecretIncomplete)
+	c.Assert(errors.Is(err, ErrStorageFailed), Equals, true)
+
+	// An old server's 404 doesn't say anything, so the client looks for itself.
+	fake.locationStatus = http.StatusNotFound
+	fake.locationError = nil
+	_, err = fake.client(WithStorage("bucket", "region")).Receive(key, c.MkDir(), nil)
+	c.Assert(errors.Is(err, ErrWrongKey), Equals, true)
+}
@@ -0,0 +1,39 @@
+package commonlib
+
+// secretshare - share secrets securely
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type LinkSuite struct{}
+
+var _ = Suite(&LinkSuite{})
+
+func (s *LinkSuite) TestLinks(c *C) {
+	key, keystr, err := generateKey()
+	c.Assert(err, IsNil)
+
+	link := ReceiveLink("https://secretshare.example.com/", keystr)
+	c.Assert(link, Equals, "https://secretshare.example.com/r#"+keystr)
+	c.Assert(KeyFromLink(link), Equals, keystr)
+	c.Assert(KeyFromLink(" "+keystr+"\n"), Equals, keystr)
+
+	decoded, err := DecodeForHuman(KeyFromLink(link))
+	c.Assert(err, IsNil)
+	c.Assert(decoded, DeepEquals, key)
+}
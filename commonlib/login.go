@@ -0,0 +1,117 @@
+package commonlib
+
+// secretshare - share secrets securely
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SessionTokenPrefix marks bearer tokens issued by the secretshare server itself (as
+// opposed to tokens from an OIDC provider).
+const SessionTokenPrefix = "sss_"
+
+type LoginChallengeRequest struct {
+	PublicKey string `json:"public_key"`
+}
+
+type LoginChallengeResponse struct {
+	ChallengeId string `json:"challenge_id"`
+	Challenge   []byte `json:"challenge"`
+}
+
+type LoginRequest struct {
+	ChallengeId     string `json:"challenge_id"`
+	SignatureFormat string `json:"signature_format"`
+	Signature       []byte `json:"signature"`
+}
+
+type LoginResponse struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// SSHLoginSignedData returns the data that must be signed to answer a login challenge.
+//
+// The challenge is prefixed with a fixed string so that a signature made for
+// secretshare can't be mistaken for one made for SSH authentication or anything else.
+func SSHLoginSignedData(challenge []byte) []byte {
+	return append([]byte("secretshare-login-v1\x00"), challenge...)
+}
+
+func postJSON(url string, request, response interface{}) error {
+	requestBytes, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	DEBUGPrintf("POST %s\n", url)
+	resp, err := HTTPClient.Post(url, "application/json", bytes.NewBuffer(requestBytes))
+	if err != nil {
+		return fmt.Errorf("Failed to connect to secretshare server: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("Error reading response from secretshare server: %s", err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errResp ErrorResponse
+		if json.Unmarshal(bodyBytes, &errResp) == nil && errResp.Message != "" {
+			return fmt.Errorf("The secretshare server responded with HTTP code %d: %s", resp.StatusCode, errResp.Message)
+		}
+		return fmt.Errorf("The secretshare server responded with HTTP code %d", resp.StatusCode)
+	}
+	err = json.Unmarshal(bodyBytes, response)
+	if err != nil {
+		return fmt.Errorf("Malformed response received from secretshare server: %s", err.Error())
+	}
+	return nil
+}
+
+// SSHLogin proves possession of signer's private key to the secretshare server and
+// returns a short-lived session token to use as Credentials.BearerToken.
+func SSHLogin(endpoint string, signer ssh.Signer) (*LoginResponse, error) {
+	var challenge LoginChallengeResponse
+	err := postJSON(endpoint+"/login/challenge", &LoginChallengeRequest{
+		PublicKey: string(ssh.MarshalAuthorizedKey(signer.PublicKey())),
+	}, &challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := signer.Sign(nil, SSHLoginSignedData(challenge.Challenge))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to sign login challenge: %s", err.Error())
+	}
+
+	var login LoginResponse
+	err = postJSON(endpoint+"/login", &LoginRequest{
+		ChallengeId:     challenge.ChallengeId,
+		SignatureFormat: sig.Format,
+		Signature:       sig.Blob,
+	}, &login)
+	if err != nil {
+		return nil, err
+	}
+	return &login, nil
+}
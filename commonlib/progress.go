@@ -0,0 +1,195 @@
+package commonlib
+
+// secretshare - share secrets securely
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Phase is a step in sending or receiving a secret.
+type Phase int
+
+const (
+	// PhaseRequestingTicket is asking the server where to upload a secret.
+	PhaseRequestingTicket Phase = iota
+	PhaseUploadingData
+	PhaseUploadingMetadata
+	// PhaseVerifying is checking that both objects made it to storage.
+	PhaseVerifying
+	// PhaseLocating is finding a secret and downloading its metadata.
+	PhaseLocating
+	PhaseDownloadingData
+	// PhaseDone comes last, and only if the send or receive succeeded.
+	PhaseDone
+)
+
+func (self Phase) String() string {
+	switch self {
+	case PhaseRequestingTicket:
+		return "Requesting upload URLs"
+	case PhaseUploadingData:
+		return "Uploading file"
+	case PhaseUploadingMetadata:
+		return "Uploading metadata"
+	case PhaseVerifying:
+		return "Verifying upload"
+	case PhaseLocating:
+		return "Locating secret"
+	case PhaseDownloadingData:
+		return "Downloading file"
+	case PhaseDone:
+		return "Done"
+	}
+	return "Unknown phase"
+}
+
+// ProgressRecord says how far through a phase a transfer is.  Value and Total count
+// bytes of the file, before encryption or after decryption.
+type ProgressRecord struct {
+	Value int64
+	Total int64
+	Phase Phase
+	// Rate is the average number of bytes per second so far in this phase, and ETA
+	// is how much longer the phase will take at that rate.  Both are zero until
+	// there's something to go on.
+	Rate float64
+	ETA  time.Duration
+}
+
+// ProgressReporter is told how a send or receive is going.  Its methods may be called
+// from any goroutine, but not concurrently.
+type ProgressReporter interface {
+	// StartPhase is called as each phase begins.
+	StartPhase(phase Phase)
+	// Progress is called as data moves, but no more often than every 100ms, apart
+	// from the last record of a phase, which always has Value equal to Total.
+	Progress(record *ProgressRecord)
+}
+
+// ProgressFunc is a ProgressReporter that only wants progress records.
+type ProgressFunc func(*ProgressRecord)
+
+func (self ProgressFunc) StartPhase(Phase) {}
+
+func (self ProgressFunc) Progress(record *ProgressRecord) {
+	self(record)
+}
+
+// ProgressChan is a ProgressReporter that sends progress records on a channel.  The
+// transfer waits for each record to be received, so keep the channel drained.
+type ProgressChan chan *ProgressRecord
+
+func (self ProgressChan) StartPhase(Phase) {}
+
+func (self ProgressChan) Progress(record *ProgressRecord) {
+	self <- record
+}
+
+// progressInterval is the least time between progress records.
+const progressInterval = 100 * time.Millisecond
+
+// progressTracker turns byte counts into progress records for a reporter, leaving out
+// records that come too soon after the last.  A nil progressTracker does nothing.
+type progressTracker struct {
+	mutex    sync.Mutex
+	reporter ProgressReporter
+	interval time.Duration
+	now      func() time.Time
+
+	phase    Phase
+	total    int64
+	start    time.Time
+	last     time.Time
+	value    int64
+	reported int64
+}
+
+// newProgress returns a progressTracker for one send or receive, or nil if nobody is
+// listening.
+func (self *Client) newProgress() *progressTracker {
+	if self.progress == nil {
+		return nil
+	}
+	return &progressTracker{
+		reporter: self.progress,
+		interval: progressInterval,
+		now:      time.Now,
+	}
+}
+
+// startPhase tells the reporter about a new phase, which moves total bytes.
+func (self *progressTracker) startPhase(phase Phase, total int64) {
+	if self == nil {
+		return
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.phase = phase
+	self.total = total
+	self.start = self.now()
+	self.last = time.Time{}
+	self.value = 0
+	self.reported = -1
+	self.reporter.StartPhase(phase)
+}
+
+// update records that value bytes of the phase have moved.
+func (self *progressTracker) update(value int64) {
+	if self == nil {
+		return
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	now := self.now()
+	if value < self.value {
+		// A retry started over.
+		self.start = now
+	}
+	self.value = value
+	if value == self.reported || (value < self.total && now.Sub(self.last) < self.interval) {
+		return
+	}
+	self.last = now
+	self.reported = value
+
+	record := &ProgressRecord{
+		Value: value,
+		Total: self.total,
+		Phase: self.phase,
+	}
+	if elapsed := now.Sub(self.start); elapsed > 0 && value > 0 {
+		record.Rate = float64(value) / elapsed.Seconds()
+		record.ETA = time.Duration(float64(self.total-value) / record.Rate * float64(time.Second))
+	}
+	self.reporter.Progress(record)
+}
+
+// progressReader counts the bytes read through it for a progressTracker.
+type progressReader struct {
+	reader   io.Reader
+	progress *progressTracker
+	count    int64
+}
+
+func (self *progressReader) Read(p []byte) (int, error) {
+	n, err := self.reader.Read(p)
+	self.count += int64(n)
+	self.progress.update(self.count)
+	return n, err
+}
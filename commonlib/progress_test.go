@@ -0,0 +1,133 @@
+package commonlib
+
+// secretshare - share secrets securely
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type ProgressSuite struct{}
+
+var _ = Suite(&ProgressSuite{})
+
+// phaseRecorder remembers what it's told.
+type phaseRecorder struct {
+	phases  []Phase
+	records []*ProgressRecord
+}
+
+func (self *phaseRecorder) StartPhase(phase Phase) {
+	self.phases = append(self.phases, phase)
+}
+
+func (self *phaseRecorder) Progress(record *ProgressRecord) {
+	self.records = append(self.records, record)
+}
+
+func (s *ProgressSuite) TestTracker(c *C) {
+	recorder := &phaseRecorder{}
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	tracker := &progressTracker{
+		reporter: recorder,
+		interval: progressInterval,
+		now:      func() time.Time { return now },
+	}
+	tracker.startPhase(PhaseUploadingData, 1000)
+	now = now.Add(time.Second)
+	tracker.update(100)
+	c.Assert(recorder.records, HasLen, 1)
+	c.Assert(*recorder.records[0], Equals, ProgressRecord{
+		Value: 100,
+		Total: 1000,
+		Phase: PhaseUploadingData,
+		Rate:  100,
+		ETA:   9 * time.Second,
+	})
+
+	// Updates are rate-limited, except for the last.
+	now = now.Add(progressInterval / 2)
+	tracker.update(200)
+	c.Assert(recorder.records, HasLen, 1)
+	now = now.Add(progressInterval)
+	tracker.update(300)
+	c.Assert(recorder.records, HasLen, 2)
+	tracker.update(1000)
+	tracker.update(1000)
+	c.Assert(recorder.records, HasLen, 3)
+	c.Assert(recorder.records[2].ETA, Equals, time.Duration(0))
+
+	// A retry starts the clock again.
+	now = now.Add(time.Second)
+	tracker.update(0)
+	now = now.Add(time.Second)
+	tracker.update(500)
+	c.Assert(recorder.records[len(recorder.records)-1].Rate, Equals, float64(500))
+
+	var nilTracker *progressTracker
+	nilTracker.startPhase(PhaseDone, 0)
+	nilTracker.update(1)
+}
+
+func (s *ProgressSuite) TestPhases(c *C) {
+	fake := newFakeServer(c)
+	defer fake.Close()
+	path := filepath.Join(c.MkDir(), "test.txt")
+	content := []byte(strings.Repeat("This is a test\n", 100))
+	c.Assert(ioutil.WriteFile(path, content, 0600), IsNil)
+
+	recorder := &phaseRecorder{}
+	client := fake.client(WithProgressReporter(recorder))
+	result, err := client.Send(path, 60)
+	c.Assert(err, IsNil)
+	c.Assert(recorder.phases, DeepEquals, []Phase{PhaseRequestingTicket, PhaseUploadingData, PhaseUploadingMetadata, PhaseVerifying, PhaseDone})
+	c.Assert(recorder.records[0].Phase, Equals, PhaseUploadingData)
+	c.Assert(recorder.records[0].Total, Equals, int64(len(content)))
+
+	// The channel adapter still works, and only reports the file upload.
+	progressChan := make(chan *ProgressRecord, 100)
+	_, err = fake.client(withProgressChan(progressChan)).Send(path, 60)
+	c.Assert(err, IsNil)
+	close(progressChan)
+	var last *ProgressRecord
+	for record := range progressChan {
+		c.Assert(record.Phase, Equals, PhaseUploadingData)
+		last = record
+	}
+	c.Assert(last.Value, Equals, int64(len(content)))
+
+	key, err := DecodeForHuman(result.Key)
+	c.Assert(err, IsNil)
+	progressChan = make(chan *ProgressRecord, 100)
+	_, err = fake.client(withProgressChan(progressChan)).Receive(key, c.MkDir(), nil)
+	c.Assert(err, IsNil)
+	close(progressChan)
+	for record := range progressChan {
+		last = record
+	}
+	c.Assert(last.Phase, Equals, PhaseDownloadingData)
+	c.Assert(last.Value, Equals, int64(len(content)))
+
+	recorder = &phaseRecorder{}
+	_, err = fake.client(WithProgressReporter(recorder)).Receive(key, c.MkDir(), nil)
+	c.Assert(err, IsNil)
+	c.Assert(recorder.phases, DeepEquals, []Phase{PhaseLocating, PhaseDownloadingData, PhaseDone})
+}
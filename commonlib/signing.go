@@ -0,0 +1,126 @@
+package commonlib
+
+// secretshare - share secrets securely
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureScheme is the Authorization header scheme used for signed requests.
+const SignatureScheme = "Secretshare-HMAC-SHA256"
+
+var (
+	MalformedSignatureError = errors.New("Malformed request signature")
+	BadSignatureError       = errors.New("Request signature does not match")
+)
+
+// RequestSignature holds the parameters of a signed request, as carried in its
+// Authorization header.
+type RequestSignature struct {
+	Timestamp int64
+	Nonce     string
+	Signature []byte
+}
+
+// CanonicalRequest returns the string that gets signed for a request.
+//
+// It covers the method, the path, the timestamp, the nonce, and a hash of the body, so
+// a captured signature can't be reused for a different request.
+func CanonicalRequest(method, path string, timestamp int64, nonce string, body []byte) string {
+	bodySum := sha256.Sum256(body)
+	return strings.Join([]string{
+		SignatureScheme,
+		strings.ToUpper(method),
+		path,
+		strconv.FormatInt(timestamp, 10),
+		nonce,
+		hex.EncodeToString(bodySum[:]),
+	}, "\n")
+}
+
+func computeSignature(key, method, path string, timestamp int64, nonce string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(CanonicalRequest(method, path, timestamp, nonce, body)))
+	return mac.Sum(nil)
+}
+
+// SignRequest adds an Authorization header to req signed with the given pre-shared key.
+// body must be exactly what will be sent as the request body.
+func SignRequest(req *http.Request, body []byte, key string) error {
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+	timestamp := time.Now().Unix()
+	sig := computeSignature(key, req.Method, req.URL.Path, timestamp, nonce, body)
+	req.Header.Set("Authorization", fmt.Sprintf("%s ts=%d,nonce=%s,sig=%s",
+		SignatureScheme, timestamp, nonce, base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+// ParseSignatureHeader extracts the signature parameters from an Authorization header.
+// The second return value is false if the header doesn't use SignatureScheme at all.
+func ParseSignatureHeader(header string) (*RequestSignature, bool, error) {
+	if !strings.HasPrefix(header, SignatureScheme+" ") {
+		return nil, false, nil
+	}
+	sig := &RequestSignature{}
+	for _, param := range strings.Split(header[len(SignatureScheme)+1:], ",") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) != 2 {
+			return nil, true, MalformedSignatureError
+		}
+		var err error
+		switch kv[0] {
+		case "ts":
+			sig.Timestamp, err = strconv.ParseInt(kv[1], 10, 64)
+		case "nonce":
+			sig.Nonce = kv[1]
+		case "sig":
+			sig.Signature, err = base64.StdEncoding.DecodeString(kv[1])
+		}
+		if err != nil {
+			return nil, true, MalformedSignatureError
+		}
+	}
+	if sig.Timestamp == 0 || sig.Nonce == "" || len(sig.Signature) == 0 {
+		return nil, true, MalformedSignatureError
+	}
+	return sig, true, nil
+}
+
+// Verify checks the signature against a request in constant time.  It does not check
+// whether the timestamp is fresh or the nonce has been seen before; that's up to the
+// caller.
+func (self *RequestSignature) Verify(key, method, path string, body []byte) error {
+	expected := computeSignature(key, method, path, self.Timestamp, self.Nonce, body)
+	if !hmac.Equal(expected, self.Signature) {
+		return BadSignatureError
+	}
+	return nil
+}
@@ -1,4 +1,4 @@
-#!/usr/bin/env python2
+#!/usr/bin/env python3
 
 import os
 import sys
@@ -11,8 +11,8 @@ config = {
     "bucket": os.getenv("SECRETSHARE_BUCKET"),
     "bucket_region": os.getenv("SECRETSHARE_BUCKET_REGION"),
     "secret_key": os.getenv("SECRETSHARE_SECRET_KEY"),
-    "aws_access_key_id": os.getenv("SECRETSHARE_AWS_KEY_ID"),
-    "aws_secret_access_key": os.getenv("SECRETSHARE_AWS_SECRET_KEY"),
+    "aws_access_key_id": os.getenv("SECRETSHARE_AWS_ACCESS_KEY_ID", os.getenv("SECRETSHARE_AWS_KEY_ID")),
+    "aws_secret_access_key": os.getenv("SECRETSHARE_AWS_SECRET_ACCESS_KEY", os.getenv("SECRETSHARE_AWS_SECRET_KEY")),
 }
 
 CONFIG_DIR = "/tmp/secretshare-config"
@@ -22,7 +22,7 @@ os.chmod(CONFIG_DIR, stat.S_IRWXU)
 
 CONFIGFILE_PATH = os.path.join(CONFIG_DIR, 'secretshare-server.json')
 
-with open(CONFIGFILE_PATH, 'wb') as f:
+with open(CONFIGFILE_PATH, 'w') as f:
     json.dump(config, f)
 os.chmod(CONFIGFILE_PATH, stat.S_IRWXU)
 
@@ -17,16 +17,17 @@ package main
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	homedir "github.com/mitchellh/go-homedir"
 	"io/ioutil"
-	"net/http"
 	"os"
 	//"net/http/httputil"
 	"errors"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/andlabs/ui"
 	"github.com/atotto/clipboard"
@@ -42,6 +43,10 @@ type clientConfig struct {
 	EndpointBaseURL string `json:"endpointBaseUrl"`
 	BucketRegion    string `json:"bucket_region"`
 	Bucket          string `json:"bucket"`
+	OIDCIssuer      string `json:"oidc_issuer,omitempty"`
+	OIDCClientID    string `json:"oidc_client_id,omitempty"`
+	ClientCert      string `json:"client_cert,omitempty"`
+	ClientKey       string `json:"client_key,omitempty"`
 }
 
 var (
@@ -153,33 +158,17 @@ func fetchVersionInfo() (*versionInfo, error) {
 		ServerSourceLocation: "ERROR",
 	}
 
-	resp, err := http.Get(config.EndpointBaseURL + "/version")
+	responseData, err := commonlib.NewClient(commonlib.WithEndpoint(config.EndpointBaseURL)).Version()
 	if err != nil {
-		return info, e("Failed to connect to secretshare server: %s", err.Error())
-	}
-	if resp.Body == nil {
-		return info, e("No data received from secretshare server")
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusInternalServerError {
-		return info, e("The secretshare server encountered an internal error")
-	}
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return info, e("Error reading secretshare server response: %s", err.Error())
-	}
-	var responseData commonlib.ServerVersionResponse
-	err = json.Unmarshal(bodyBytes, &responseData)
-	if err != nil {
-		return info, e("Malformed response received from secretshare server: %s", err.Error())
+		return info, e("%s", err.Error())
 	}
 
 	info.ServerVersion = responseData.ServerVersion
 	info.ServerApiVersion = responseData.APIVersion
 	info.ServerSourceLocation = responseData.ServerSourceLocation
 
-	if commonlib.APIVersion != responseData.APIVersion {
-		return info, e("WARNING! Server and client APIs do not match!  Update your client.")
+	if _, err = commonlib.Negotiate(responseData.Caps(), nil); err != nil {
+		return info, e("WARNING! %s", err.Error())
 	}
 	return info, nil
 }
@@ -244,23 +233,60 @@ func copyBox(title, label, text string, andthen afterFunc) {
 	window.Show()
 }
 
-func progressBox(title, label string) (*ui.ProgressBar, *ui.Window) {
+// progressBox shows a progress bar with a Cancel button that calls cancel.  Closing
+// the window cancels too; the caller destroys the window once the operation stops.
+func progressBox(title, label string, cancel func()) (*progressView, *ui.Window) {
 	window := ui.NewWindow(title, 400, 100, false)
 
 	desc := ui.NewLabel(label)
 	progress := ui.NewProgressBar()
+	cancelButton := ui.NewButton("Cancel")
+	cancelButton.OnClicked(func(*ui.Button) {
+		cancelButton.Disable()
+		cancel()
+	})
 
 	mainbox := ui.NewVerticalBox()
 	mainbox.Append(desc, true)
 	mainbox.Append(progress, true)
+	mainbox.Append(cancelButton, false)
 
 	window.SetChild(mainbox)
 	window.OnClosing(func(*ui.Window) bool {
-		return true
+		cancelButton.Disable()
+		cancel()
+		return false
 	})
 	window.Show()
 
-	return progress, window
+	return &progressView{desc, progress}, window
+}
+
+// progressView shows how a send or receive is going in a progressBox.
+type progressView struct {
+	desc *ui.Label
+	pbar *ui.ProgressBar
+}
+
+func (self *progressView) StartPhase(phase commonlib.Phase) {
+	ui.QueueMain(func() {
+		self.desc.SetText(phase.String() + "...")
+	})
+}
+
+func (self *progressView) Progress(prec *commonlib.ProgressRecord) {
+	text := prec.Phase.String() + "..."
+	if prec.Rate > 0 && prec.Value < prec.Total {
+		text = fmt.Sprintf("%s (%.1f KB/s, about %s left)", prec.Phase, prec.Rate/1024, prec.ETA.Round(time.Second))
+	}
+	ui.QueueMain(func() {
+		self.desc.SetText(text)
+		if prec.Total > 0 {
+			fraction := float64(prec.Value) / float64(prec.Total)
+			percent := int(fraction * 100)
+			self.pbar.SetValue(percent)
+		}
+	})
 }
 
 type entryFunc func(string, error)
@@ -328,6 +354,16 @@ func load() (string, error) {
 
 type afterFunc func(error)
 
+// newClient returns a client for the server and bucket from the configuration that
+// shows its progress in view.
+func newClient(creds *commonlib.Credentials, view *progressView) *commonlib.Client {
+	return commonlib.NewClient(
+		commonlib.WithEndpoint(config.EndpointBaseURL),
+		commonlib.WithStorage(config.Bucket, config.BucketRegion),
+		commonlib.WithCredentials(creds),
+		commonlib.WithProgressReporter(view))
+}
+
 func sendUi(parent *ui.Window, andthen afterFunc) {
 	filePath := ui.OpenFile(parent)
 	if filePath == "" {
@@ -342,50 +378,43 @@ func sendUi(parent *ui.Window, andthen afterFunc) {
 		return
 	}
 
+	if config.ClientCert != "" {
+		err = commonlib.UseClientCertificate(config.ClientCert, config.ClientKey)
+		if err != nil {
+			defer andthen(e("Failed to load client certificate: %s", err.Error()))
+			return
+		}
+	}
+
 	err = loadSecretKey(filepath.Join(homeDir, ".secretshare.key"))
-	if err != nil || secretKey == "" {
+	if (err != nil || secretKey == "") && config.ClientCert == "" {
 		defer andthen(e("You can't send a file without setting the secret key.  You can do that in the configuration screen."))
 		return
 	}
 
-	progressChan := make(chan *commonlib.ProgressRecord, 100)
-	keystrChan := make(chan string)
-	senderrChan := make(chan *commonlib.SendError)
-
+	ctx, cancel := context.WithCancel(context.Background())
+	view, pbox := progressBox("Progress", "Uploading file...", cancel)
+	client := newClient(&commonlib.Credentials{SecretKey: secretKey}, view)
 	go func() {
-		innerkeystr, _, innersenderr := commonlib.SendSecret(
-			config.EndpointBaseURL,
-			config.Bucket,
-			config.BucketRegion,
-			secretKey,
-			filePath,
-			4*60,
-			progressChan)
-		keystrChan <- innerkeystr
-		senderrChan <- innersenderr
-	}()
-	pbar, pbox := progressBox("Progress", "Uploading file...")
-	go func() {
-		for prec := range progressChan {
-			ui.QueueMain(func() {
-				fraction := float64(prec.Value) / float64(prec.Total)
-				percent := int(fraction * 100)
-				pbar.SetValue(percent)
-			})
-		}
+		defer cancel()
+		result, err := client.SendContext(ctx, filePath, 4*60)
 
 		ui.QueueMain(func() {
 			pbox.Destroy()
-		})
-		keystr, senderr := <-keystrChan, <-senderrChan
-
-		ui.QueueMain(func() {
-			if senderr != nil {
-				andthen(senderr)
+			if senderr, ok := err.(*commonlib.SendError); ok && senderr.Code == commonlib.SendCancelled {
+				andthen(nil)
+				return
+			}
+			if err != nil {
+				andthen(err)
 				return
 			}
 
-			copyBox("Success!", "Key to receive this secret", keystr, nil)
+			title := "Success!"
+			if !result.Verified {
+				title = "Uploaded, but not checked"
+			}
+			copyBox(title, "Key to receive this secret", result.Key, nil)
 			defer andthen(nil)
 		})
 	}()
@@ -399,7 +428,7 @@ func recvUi(parent *ui.Window, keystr string, andthen afterFunc) {
 		return
 	}
 
-	key, err := commonlib.DecodeForHuman(keystr)
+	key, err := commonlib.DecodeForHuman(commonlib.KeyFromLink(keystr))
 	if err != nil {
 		defer andthen(err)
 		return
@@ -409,30 +438,24 @@ func recvUi(parent *ui.Window, keystr string, andthen afterFunc) {
 	destDir := filepath.Dir(savePath)
 	filename := filepath.Base(savePath)
 
-	progressChan := make(chan *commonlib.ProgressRecord, 100)
-	recverrChan := make(chan *commonlib.RecvError)
-	go func() {
-		_, recverr := commonlib.RecvSecret(config.Bucket, config.BucketRegion, key, destDir, &filename, true, progressChan)
-		recverrChan <- recverr
-	}()
-	pbar, pbox := progressBox("Progress", "Downloading file...")
+	ctx, cancel := context.WithCancel(context.Background())
+	view, pbox := progressBox("Progress", "Downloading file...", cancel)
+	client := newClient(nil, view)
 	go func() {
-		for prec := range progressChan {
-			ui.QueueMain(func() {
-				fraction := float64(prec.Value) / float64(prec.Total)
-				percent := int(fraction * 100)
-				pbar.SetValue(percent)
-			})
-		}
-
-		ui.QueueMain(func() {
-			pbox.Destroy()
+		defer cancel()
+		_, err := client.ReceiveContext(ctx, key, destDir, &commonlib.ReceiveOptions{
+			Filename:  filename,
+			Overwrite: true,
 		})
-		recverr := <-recverrChan
 
 		ui.QueueMain(func() {
-			if recverr != nil {
-				defer andthen(recverr)
+			pbox.Destroy()
+			if recverr, ok := err.(*commonlib.RecvError); ok && recverr.Code == commonlib.RecvCancelled {
+				andthen(nil)
+				return
+			}
+			if err != nil {
+				defer andthen(err)
 				return
 			}
 
@@ -0,0 +1,450 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+	"github.com/urfave/cli"
+
+	"github.com/waucka/secretshare/commonlib"
+)
+
+type adminListResponse struct {
+	Secrets []*secretInfo `json:"secrets"`
+}
+
+type adminPurgeRequest struct {
+	OlderThanSeconds int64 `json:"older_than_seconds"`
+}
+
+type adminDeleteResponse struct {
+	Deleted []string `json:"deleted"`
+}
+
+// adminAPI serves the /admin endpoints, which let operators see and delete the
+// secrets in the bucket and back up the database.
+type adminAPI struct {
+	auth    *authenticator
+	tenants *tenantSet
+	audit   *auditLogger
+	store   secretStore
+}
+
+func (self *adminAPI) register(r *gin.Engine) {
+	group := r.Group("/admin", self.requireAdmin)
+	group.GET("/secrets", self.handleList)
+	group.DELETE("/secrets/:id", self.handleDelete)
+	group.POST("/purge", self.handlePurge)
+	group.GET("/db/backup", self.handleBackup)
+	group.GET("/db/export", self.handleExport)
+}
+
+// requireAdmin is gin middleware that rejects requests from anyone but administrators.
+func (self *adminAPI) requireAdmin(c *gin.Context) {
+	body, err := c.GetRawData()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeBadRequest,
+			Message: err.Error(),
+		})
+		logger(c).Error(err.Error())
+		return
+	}
+	// Put the body back for the handler.
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	caller, err := self.auth.authenticateAdmin(c, body)
+	if err != nil {
+		status, code := http.StatusUnauthorized, commonlib.CodeAuthFailed
+		if err == ErrNotAdmin {
+			status, code = http.StatusForbidden, commonlib.CodeForbidden
+		}
+		c.AbortWithStatusJSON(status, &commonlib.ErrorResponse{
+			Code:    code,
+			Message: err.Error(),
+		})
+		logger(c).Errorf("%d: admin authentication failed: %s", status, err.Error())
+		authFailures.WithLabelValues(authFailureReason(err)).Inc()
+		return
+	}
+	c.Set("caller", caller)
+	logger(c).WithFields(log.Fields{
+		"caller":   caller.Name,
+		"authType": caller.Method,
+		"path":     c.Request.URL.Path,
+	}).Info("Admin request")
+}
+
+func adminCaller(c *gin.Context) *identity {
+	caller, _ := c.MustGet("caller").(*identity)
+	return caller
+}
+
+// list returns the secrets in every tenant's bucket.
+func (self *adminAPI) list() ([]*secretInfo, error) {
+	secrets := make([]*secretInfo, 0)
+	for _, t := range self.tenants.tenants {
+		tenantSecrets, err := t.bucket.list()
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %s", t.name, err.Error())
+		}
+		for _, info := range tenantSecrets {
+			info.Tenant = t.name
+		}
+		secrets = append(secrets, tenantSecrets...)
+	}
+	return secrets, nil
+}
+
+func (self *adminAPI) handleList(c *gin.Context) {
+	secrets, err := self.list()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeInternal,
+			Message: err.Error(),
+		})
+		logger(c).Error(err.Error())
+		return
+	}
+	for _, info := range secrets {
+		if err = self.tenants.get(info.Tenant).bucket.describe(info); err != nil && err != ErrNoSuchSecret {
+			logger(c).WithFields(log.Fields{
+				"objectId": info.ObjectId,
+			}).Errorf("Failed to read object metadata: %s", err.Error())
+		}
+		if record, err := self.store.get(info.ObjectId); err == nil {
+			info.Owner = record.Owner
+			info.Retrievals = len(record.Retrievals)
+			info.Verified = record.Flags&secretVerified != 0
+		}
+	}
+	c.JSON(http.StatusOK, &adminListResponse{
+		Secrets: secrets,
+	})
+}
+
+// revoke deletes a secret from a tenant's bucket and records who did it.
+func (self *adminAPI) revoke(c *gin.Context, t *tenant, id string) error {
+	if err := t.bucket.delete(id); err != nil {
+		return err
+	}
+	caller := adminCaller(c)
+	if err := self.store.setFlags(id, secretRevoked); err != nil && err != ErrNoSuchRecord {
+		logger(c).WithFields(log.Fields{
+			"objectId": id,
+		}).Errorf("Failed to record revocation: %s", err.Error())
+	}
+	self.audit.record(&auditEntry{
+		Event:    AuditSecretRevoked,
+		ReqId:    c.GetString("reqId"),
+		Caller:   caller.Name,
+		AuthType: caller.Method,
+		ClientIP: c.ClientIP(),
+		Tenant:   t.name,
+		ObjectId: id,
+	})
+	logger(c).WithFields(log.Fields{
+		"objectId": id,
+		"caller":   caller.Name,
+		"tenant":   t.name,
+	}).Info("Deleted secret")
+	return nil
+}
+
+func (self *adminAPI) handleDelete(c *gin.Context) {
+	id := c.Param("id")
+	// Look in the buckets rather than the database so that deleting a secret that's
+	// already gone is a 404.
+	t, err := self.tenants.locate(id, nullStore{})
+	if err == ErrNoSuchSecret {
+		c.JSON(http.StatusNotFound, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeNotFound,
+			Message: err.Error(),
+		})
+		return
+	}
+	if err == nil {
+		err = self.revoke(c, t, id)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeInternal,
+			Message: err.Error(),
+		})
+		logger(c).Error(err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, &adminDeleteResponse{
+		Deleted: []string{id},
+	})
+}
+
+func (self *adminAPI) handlePurge(c *gin.Context) {
+	var requestData adminPurgeRequest
+	if err := c.BindJSON(&requestData); err != nil {
+		logger(c).Error(err.Error())
+		return
+	}
+	if requestData.OlderThanSeconds <= 0 {
+		c.JSON(http.StatusBadRequest, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeBadRequest,
+			Message: "older_than_seconds must be positive",
+		})
+		return
+	}
+	cutoff := time.Now().Add(-time.Second * time.Duration(requestData.OlderThanSeconds))
+
+	secrets, err := self.list()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeInternal,
+			Message: err.Error(),
+		})
+		logger(c).Error(err.Error())
+		return
+	}
+	deleted := make([]string, 0)
+	for _, info := range secrets {
+		if !info.Created.Before(cutoff) {
+			continue
+		}
+		if err = self.revoke(c, self.tenants.get(info.Tenant), info.ObjectId); err != nil {
+			c.JSON(http.StatusInternalServerError, &commonlib.ErrorResponse{
+				Code:    commonlib.CodeInternal,
+				Message: fmt.Sprintf("Deleted %d secrets, then failed: %s", len(deleted), err.Error()),
+			})
+			logger(c).Error(err.Error())
+			return
+		}
+		deleted = append(deleted, info.ObjectId)
+	}
+	c.JSON(http.StatusOK, &adminDeleteResponse{
+		Deleted: deleted,
+	})
+}
+
+// handleBackup sends a copy of the database file.
+func (self *adminAPI) handleBackup(c *gin.Context) {
+	if _, ok := self.store.(nullStore); ok {
+		c.JSON(http.StatusNotFound, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeNoDatabase,
+			Message: ErrNoDatabase.Error(),
+		})
+		return
+	}
+	c.Header("Content-Type", "application/octet-stream")
+	c.Status(http.StatusOK)
+	written, err := self.store.backup(c.Writer)
+	if err != nil {
+		// It's too late to change the status; the client will see a short file.
+		logger(c).Errorf("Database backup failed after %d bytes: %s", written, err.Error())
+		return
+	}
+	logger(c).Infof("Sent %d byte database backup", written)
+}
+
+// handleExport sends every record in the database as JSON, one per line.
+func (self *adminAPI) handleExport(c *gin.Context) {
+	if _, ok := self.store.(nullStore); ok {
+		c.JSON(http.StatusNotFound, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeNoDatabase,
+			Message: ErrNoDatabase.Error(),
+		})
+		return
+	}
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+	encoder := json.NewEncoder(c.Writer)
+	err := self.store.forEach(func(record *secretRecord) error {
+		return encoder.Encode(record)
+	})
+	if err != nil {
+		logger(c).Errorf("Database export failed: %s", err.Error())
+	}
+}
+
+// adminDo sends a request to the admin API, signed with admin_key from the server's
+// configuration.  The caller must close the response body.
+func adminDo(c *cli.Context, method, path string, requestData interface{}) (*http.Response, error) {
+	config, _, err := loadConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	if config.AdminKey == "" {
+		return nil, fmt.Errorf("admin_key is not set in the server configuration")
+	}
+	endpoint := c.GlobalString("endpoint")
+	if endpoint == "" {
+		scheme := "http"
+		if config.tlsEnabled() {
+			scheme = "https"
+		}
+		endpoint = fmt.Sprintf("%s://localhost:%d", scheme, config.ListenPort)
+	}
+
+	var body []byte
+	if requestData != nil {
+		body, err = json.Marshal(requestData)
+		if err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err = commonlib.SignRequest(req, body, config.AdminKey); err != nil {
+		return nil, err
+	}
+	resp, err := commonlib.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		respBytes, _ := ioutil.ReadAll(resp.Body)
+		var errResp commonlib.ErrorResponse
+		if json.Unmarshal(respBytes, &errResp) == nil && errResp.Message != "" {
+			return nil, fmt.Errorf("%s (HTTP %d)", errResp.Message, resp.StatusCode)
+		}
+		return nil, fmt.Errorf("Server returned HTTP %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// adminRequest sends a request to the admin API and decodes the JSON response.
+func adminRequest(c *cli.Context, method, path string, requestData, responseData interface{}) error {
+	resp, err := adminDo(c, method, path, requestData)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(respBytes, responseData)
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+func adminList(c *cli.Context) error {
+	var resp adminListResponse
+	if err := adminRequest(c, "GET", "/admin/secrets", nil, &resp); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "OBJECT ID\tTENANT\tSIZE\tCREATED\tEXPIRES\tOWNER\tRETRIEVED")
+	for _, info := range resp.Secrets {
+		owner := info.Owner
+		if owner == "" {
+			owner = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\n", info.ObjectId, info.Tenant, strconv.FormatInt(info.Size, 10), formatTime(&info.Created), formatTime(info.Expires), owner, info.Retrievals)
+	}
+	return w.Flush()
+}
+
+func adminDelete(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return cli.NewExitError("USAGE: secretshare-server admin delete OBJECT_ID...", 1)
+	}
+	for _, id := range c.Args() {
+		var resp adminDeleteResponse
+		if err := adminRequest(c, "DELETE", "/admin/secrets/"+url.PathEscape(id), nil, &resp); err != nil {
+			return cli.NewExitError(fmt.Sprintf("Failed to delete %s: %s", id, err.Error()), 1)
+		}
+		fmt.Printf("Deleted %s\n", id)
+	}
+	return nil
+}
+
+func adminPurge(c *cli.Context) error {
+	olderThan := c.Duration("older-than")
+	if olderThan <= 0 {
+		return cli.NewExitError("USAGE: secretshare-server admin purge --older-than DURATION", 1)
+	}
+	var resp adminDeleteResponse
+	err := adminRequest(c, "POST", "/admin/purge", &adminPurgeRequest{
+		OlderThanSeconds: int64(olderThan / time.Second),
+	}, &resp)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	for _, id := range resp.Deleted {
+		fmt.Printf("Deleted %s\n", id)
+	}
+	fmt.Printf("Deleted %d secrets older than %s\n", len(resp.Deleted), olderThan)
+	return nil
+}
+
+// adminCopy writes the response to an admin API request to the file named by the
+// --output flag, or to stdout.
+func adminCopy(c *cli.Context, path string) error {
+	resp, err := adminDo(c, "GET", path, nil)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	defer resp.Body.Close()
+
+	out := os.Stdout
+	if outPath := c.String("output"); outPath != "" && outPath != "-" {
+		out, err = os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		defer out.Close()
+	}
+	written, err := io.Copy(out, resp.Body)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed after %d bytes: %s", written, err.Error()), 1)
+	}
+	if out != os.Stdout {
+		fmt.Fprintf(os.Stderr, "Wrote %d bytes to %s\n", written, out.Name())
+	}
+	return nil
+}
+
+func adminBackup(c *cli.Context) error {
+	if c.String("output") == "" {
+		return cli.NewExitError("USAGE: secretshare-server admin backup --output FILE", 1)
+	}
+	return adminCopy(c, "/admin/db/backup")
+}
+
+func adminExport(c *cli.Context) error {
+	return adminCopy(c, "/admin/db/export")
+}
@@ -0,0 +1,337 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+
+	"github.com/waucka/secretshare/api"
+	"github.com/waucka/secretshare/commonlib"
+)
+
+// apiServer holds what the API handlers need.  The routes it registers are described
+// by api/openapi.yaml; api_test.go checks that the two agree.
+type apiServer struct {
+	auth     *authenticator
+	tenants  *tenantSet
+	policies *policyHolder
+	store    secretStore
+	audit    *auditLogger
+	ready    *readiness
+}
+
+func (self *apiServer) register(r *gin.Engine) {
+	r.GET("/healthz", handleHealthz)
+	r.GET("/readyz", self.ready.handleReadyz)
+	r.GET("/version", versionHandler(self.auth, self.policies))
+	r.GET("/openapi.yaml", handleSpec)
+	// Unauthenticated endpoints that use up something shared are limited for each
+	// client address: outstanding login challenges, retrieval reports, and lookups.
+	public := publicRateLimit()
+	if self.auth.sshLogin != nil {
+		r.POST("/login/challenge", public, self.auth.sshLogin.handleChallenge)
+		r.POST("/login", self.auth.sshLogin.handleLogin)
+	}
+	admin := &adminAPI{
+		auth:    self.auth,
+		tenants: self.tenants,
+		audit:   self.audit,
+		store:   self.store,
+	}
+	admin.register(r)
+	r.GET("/secrets/:id/location", public, locationHandler(self.tenants, self.store))
+	r.POST("/secrets/:id/retrieved", public, retrievalHandler(self.store, self.audit))
+	r.POST("/secrets/:id/complete", self.handleComplete)
+	r.POST("/upload", self.handleUpload)
+}
+
+func handleSpec(c *gin.Context) {
+	c.Data(http.StatusOK, "application/yaml", api.Spec)
+}
+
+func (self *apiServer) handleUpload(c *gin.Context) {
+	var requestData commonlib.UploadRequest
+	body, err := c.GetRawData()
+	if err == nil {
+		err = json.Unmarshal(body, &requestData)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeBadRequest,
+			Message: err.Error(),
+		})
+		logger(c).Error(err.Error())
+		return
+	}
+	caller, err := self.auth.authenticate(c, body, &requestData)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeAuthFailed,
+			Message: err.Error(),
+		})
+		logger(c).Errorf("401: authentication failed: %s", err.Error())
+		authFailures.WithLabelValues(authFailureReason(err)).Inc()
+		return
+	}
+	t := self.tenants.get(self.auth.tenantFor(caller))
+	if t == nil {
+		c.JSON(http.StatusInternalServerError, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeInternal,
+			Message: "Unknown tenant",
+		})
+		logger(c).Errorf("Caller %s belongs to tenant %s, which is not set up", caller.Name, self.auth.tenantFor(caller))
+		return
+	}
+	policy := self.policies.current(t.name)
+	if ok, wait := policy.allow(rateLimitKey(caller, c.ClientIP())); !ok {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeRateLimited,
+			Message: ErrRateLimited.Error(),
+		})
+		logger(c).WithFields(log.Fields{
+			"caller": caller.Name,
+		}).Warn("429: upload rate limit exceeded")
+		return
+	}
+	ttl, err := policy.ttl(requestData.TTL)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeInvalidTTL,
+			Message: err.Error(),
+		})
+		logger(c).Error(err.Error())
+		return
+	}
+	if err := policy.checkSize(requestData.Filesize); err != nil {
+		c.JSON(http.StatusRequestEntityTooLarge, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeTooLarge,
+			Message: err.Error(),
+		})
+		logger(c).Error(err.Error())
+		return
+	}
+
+	if requestData.ObjectId == "" {
+		c.JSON(http.StatusBadRequest, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeBadRequest,
+			Message: "No object ID provided in request",
+		})
+		logger(c).Error("No object ID provided in request")
+		return
+	}
+	_, err = commonlib.DecodeForHuman(requestData.ObjectId)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeBadRequest,
+			Message: "Malformed object ID provided in request",
+		})
+		logger(c).Errorf("Malformed object ID provided in request: %s\n", err.Error())
+		return
+	}
+	id := requestData.ObjectId
+	logger(c).WithFields(log.Fields{
+		"objectId": id,
+		"caller":   caller.Name,
+		"authType": caller.Method,
+		"tenant":   t.name,
+	}).Info("Creating signed URL")
+
+	if requestData.Filesize > 0 {
+		uploadDeclaredBytes.Add(float64(requestData.Filesize))
+	}
+
+	putURL, headers, err := generateSignedURL(t.bucket.svc, t.bucket.name, id, "", ttl)
+	if err != nil {
+		presignFailures.WithLabelValues("data").Inc()
+		c.JSON(http.StatusInternalServerError, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeInternal,
+			Message: err.Error(),
+		})
+		logger(c).Error(err.Error())
+		return
+	}
+
+	metaPutURL, metaHeaders, err := generateSignedURL(t.bucket.svc, t.bucket.name, id, "meta/", ttl)
+	if err != nil {
+		presignFailures.WithLabelValues("meta").Inc()
+		c.JSON(http.StatusInternalServerError, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeInternal,
+			Message: err.Error(),
+		})
+		logger(c).Error(err.Error())
+		return
+	}
+
+	var flags uint32
+	if requestData.Complete {
+		flags = secretPending
+	}
+	err = self.store.create(&secretRecord{
+		ObjectId: id,
+		Owner:    caller.Name,
+		AuthType: caller.Method,
+		Tenant:   t.name,
+		Created:  time.Now(),
+		TTL:      int64(ttl / time.Second),
+		Flags:    flags,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeInternal,
+			Message: "Failed to record secret",
+		})
+		logger(c).Errorf("Failed to record secret %s: %s", id, err.Error())
+		return
+	}
+
+	self.audit.record(&auditEntry{
+		Event:    AuditSecretCreated,
+		ReqId:    c.GetString("reqId"),
+		Caller:   caller.Name,
+		AuthType: caller.Method,
+		ClientIP: c.ClientIP(),
+		Tenant:   t.name,
+		ObjectId: id,
+		TTL:      int64(ttl / time.Second),
+	})
+
+	c.JSON(http.StatusOK, &commonlib.UploadResponse{
+		PutURL:      putURL,
+		MetaPutURL:  metaPutURL,
+		Headers:     headers,
+		MetaHeaders: metaHeaders,
+	})
+}
+
+// handleComplete checks that both of a secret's objects reached the caller's bucket
+// at the sizes the client uploaded, and records that the secret is verified.
+// Clients call it after uploading, so that they don't hand out a key for a secret
+// that isn't there.  If the database knows who uploaded the secret, nobody else may
+// ask.
+func (self *apiServer) handleComplete(c *gin.Context) {
+	var requestData commonlib.CompleteRequest
+	body, err := c.GetRawData()
+	if err == nil {
+		err = json.Unmarshal(body, &requestData)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeBadRequest,
+			Message: err.Error(),
+		})
+		logger(c).Error(err.Error())
+		return
+	}
+	caller, err := self.auth.authenticate(c, body, &commonlib.UploadRequest{})
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeAuthFailed,
+			Message: err.Error(),
+		})
+		logger(c).Errorf("401: authentication failed: %s", err.Error())
+		authFailures.WithLabelValues(authFailureReason(err)).Inc()
+		return
+	}
+	t := self.tenants.get(self.auth.tenantFor(caller))
+	if t == nil {
+		c.JSON(http.StatusInternalServerError, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeInternal,
+			Message: "Unknown tenant",
+		})
+		logger(c).Errorf("Caller %s belongs to tenant %s, which is not set up", caller.Name, self.auth.tenantFor(caller))
+		return
+	}
+
+	id := c.Param("id")
+	// Without a database there's no telling who uploaded the secret, but then nothing
+	// is recorded either; checking sizes gives nothing away that S3 doesn't.
+	record, err := self.store.get(id)
+	if err != nil && err != ErrNoSuchRecord {
+		c.JSON(http.StatusInternalServerError, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeInternal,
+			Message: "Failed to look up secret",
+		})
+		logger(c).Errorf("Failed to look up %s: %s", id, err.Error())
+		return
+	}
+	if record != nil && (record.Owner != caller.Name || self.tenants.get(record.Tenant) != t) {
+		c.JSON(http.StatusForbidden, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeForbidden,
+			Message: "The secret was uploaded by someone else",
+		})
+		logger(c).WithFields(log.Fields{
+			"objectId": id,
+			"caller":   caller.Name,
+			"owner":    record.Owner,
+		}).Warn("403: caller tried to complete someone else's upload")
+		return
+	}
+	objects := []struct {
+		key  string
+		size int64
+	}{
+		{id, requestData.Size},
+		{"meta/" + id, requestData.MetaSize},
+	}
+	for _, object := range objects {
+		size, err := t.bucket.size(object.key)
+		if err == ErrNoSuchSecret {
+			c.JSON(http.StatusConflict, &commonlib.ErrorResponse{
+				Code:    commonlib.CodeIncompleteUpload,
+				Message: fmt.Sprintf("%s is missing from storage", object.key),
+			})
+			logger(c).Warnf("409: %s is missing", object.key)
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, &commonlib.ErrorResponse{
+				Code:    commonlib.CodeInternal,
+				Message: "Failed to check storage",
+			})
+			logger(c).Errorf("Failed to check %s: %s", object.key, err.Error())
+			return
+		}
+		if size != object.size {
+			c.JSON(http.StatusConflict, &commonlib.ErrorResponse{
+				Code:    commonlib.CodeIncompleteUpload,
+				Message: fmt.Sprintf("%s is %d bytes in storage, not %d", object.key, size, object.size),
+			})
+			logger(c).Warnf("409: %s is %d bytes, not %d", object.key, size, object.size)
+			return
+		}
+	}
+
+	if err = self.store.setFlags(id, secretVerified); err != nil && err != ErrNoSuchRecord {
+		logger(c).WithFields(log.Fields{
+			"objectId": id,
+		}).Errorf("Failed to record verification: %s", err.Error())
+	}
+	logger(c).WithFields(log.Fields{
+		"objectId": id,
+		"caller":   caller.Name,
+	}).Info("Upload verified")
+	c.Status(http.StatusNoContent)
+}
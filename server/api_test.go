@@ -0,0 +1,251 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "gopkg.in/check.v1"
+
+	"github.com/waucka/secretshare/api"
+	"github.com/waucka/secretshare/commonlib"
+)
+
+type APISuite struct{}
+
+var _ = Suite(&APISuite{})
+
+// testRouter registers every API route, including the optional SSH login endpoints.
+func testRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	config := &serverConfig{SecretKey: "hunter2"}
+	auth := &authenticator{
+		sshLogin: newSSHLogin(&sshKeyStore{}, time.Minute),
+	}
+	auth.update(config)
+	endpoints := &apiServer{
+		auth:     auth,
+		tenants:  &tenantSet{byName: make(map[string]*tenant)},
+		policies: &policyHolder{policies: newUploadPolicies(config, nil)},
+		store:    nullStore{},
+		ready:    newReadiness(),
+	}
+	r := gin.New()
+	endpoints.register(r)
+	return r
+}
+
+func (s *APISuite) TestRoutesMatchSpec(c *C) {
+	doc, err := api.Load()
+	c.Assert(err, IsNil)
+	specified := make([]string, 0)
+	for _, route := range doc.Routes() {
+		specified = append(specified, route.Method+" "+route.Path)
+	}
+	registered := make([]string, 0)
+	for _, route := range testRouter().Routes() {
+		registered = append(registered, route.Method+" "+route.Path)
+	}
+	sort.Strings(specified)
+	sort.Strings(registered)
+	c.Assert(registered, DeepEquals, specified)
+}
+
+func (s *APISuite) TestTypesMatchSpec(c *C) {
+	doc, err := api.Load()
+	c.Assert(err, IsNil)
+	types := map[string]interface{}{
+		"Error":                  commonlib.ErrorResponse{},
+		"VersionResponse":        commonlib.ServerVersionResponse{},
+		"Capabilities":           commonlib.Capabilities{},
+		"UploadRequest":          commonlib.UploadRequest{},
+		"UploadResponse":         commonlib.UploadResponse{},
+		"CompleteRequest":        commonlib.CompleteRequest{},
+		"Headers":                http.Header{},
+		"SecretLocation":         commonlib.SecretLocation{},
+		"Readiness":              readinessResponse{},
+		"CheckResult":            checkResult{},
+		"LoginChallengeRequest":  commonlib.LoginChallengeRequest{},
+		"LoginChallengeResponse": commonlib.LoginChallengeResponse{},
+		"LoginRequest":           commonlib.LoginRequest{},
+		"LoginResponse":          commonlib.LoginResponse{},
+		"SecretList":             adminListResponse{},
+		"SecretInfo":             secretInfo{},
+		"PurgeRequest":           adminPurgeRequest{},
+		"DeleteResponse":         adminDeleteResponse{},
+		"SecretRecord":           secretRecord{},
+		"RetrievalEvent":         retrievalEvent{},
+	}
+	for name, v := range types {
+		c.Check(doc.Check(name, v), HasLen, 0, Commentf("%v", doc.Check(name, v)))
+	}
+	// Health is the only response built from a gin.H rather than a type.
+	for name := range doc.Components.Schemas {
+		if _, ok := types[name]; !ok && name != "Health" {
+			c.Errorf("schema %s is not checked against a Go type", name)
+		}
+	}
+}
+
+func (s *APISuite) TestResponsesMatchSpec(c *C) {
+	doc, err := api.Load()
+	c.Assert(err, IsNil)
+	r := testRouter()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	c.Assert(w.Code, Equals, http.StatusOK)
+	var health map[string]interface{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &health), IsNil)
+	for _, name := range doc.Schema("Health").Required {
+		c.Check(health[name], NotNil, Commentf("%s", name))
+	}
+	c.Check(len(health), Equals, len(doc.Schema("Health").Properties))
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/openapi.yaml", nil))
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.Bytes(), DeepEquals, api.Spec)
+}
+
+func (s *APISuite) TestErrorCodesMatchSpec(c *C) {
+	doc, err := api.Load()
+	c.Assert(err, IsNil)
+	codes := []string{
+		commonlib.CodeBadRequest,
+		commonlib.CodeInvalidTTL,
+		commonlib.CodeAuthFailed,
+		commonlib.CodeForbidden,
+		commonlib.CodeNotFound,
+		commonlib.CodeTooLarge,
+		commonlib.CodeRateLimited,
+		commonlib.CodeNoDatabase,
+		commonlib.CodeInternal,
+		commonlib.CodeExpired,
+		commonlib.CodeRevoked,
+		commonlib.CodeRetrieved,
+		commonlib.CodeIncompleteUpload,
+	}
+	c.Assert(doc.Schema("Error").Properties["code"].Enum, DeepEquals, codes)
+
+	w := httptest.NewRecorder()
+	body := strings.NewReader(`{"object_id": "abc", "filesize": 1}`)
+	testRouter().ServeHTTP(w, httptest.NewRequest("POST", "/upload", body))
+	c.Assert(w.Code, Equals, http.StatusUnauthorized)
+	var errResp commonlib.ErrorResponse
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &errResp), IsNil)
+	c.Assert(errResp.Code, Equals, commonlib.CodeAuthFailed)
+}
+
+func (s *APISuite) TestComplete(c *C) {
+	bucket, stop := testBucket(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/secrets/abc", "/secrets/a+b":
+			w.Header().Set("Content-Length", "48")
+		case "/secrets/meta/abc", "/secrets/meta/a+b":
+			w.Header().Set("Content-Length", "32")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	defer stop()
+	config := &serverConfig{SecretKey: "hunter2"}
+	auth := &authenticator{nonces: newNonceCache(SignatureWindow)}
+	auth.update(config)
+	t := &tenant{name: DefaultTenant, bucket: bucket}
+	endpoints := &apiServer{
+		auth:     auth,
+		tenants:  &tenantSet{tenants: []*tenant{t}, byName: map[string]*tenant{DefaultTenant: t}},
+		policies: &policyHolder{policies: newUploadPolicies(config, nil)},
+		store:    nullStore{},
+		ready:    newReadiness(),
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	endpoints.register(r)
+
+	complete := func(id string, requestData *commonlib.CompleteRequest) (int, string) {
+		body, err := json.Marshal(requestData)
+		c.Assert(err, IsNil)
+		req := httptest.NewRequest("POST", "/secrets/"+id+"/complete", bytes.NewReader(body))
+		c.Assert(commonlib.SignRequest(req, body, "hunter2"), IsNil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var errResp commonlib.ErrorResponse
+		json.Unmarshal(w.Body.Bytes(), &errResp)
+		return w.Code, errResp.Code
+	}
+	status, _ := complete("abc", &commonlib.CompleteRequest{Size: 48, MetaSize: 32})
+	c.Assert(status, Equals, http.StatusNoContent)
+	status, code := complete("abc", &commonlib.CompleteRequest{Size: 64, MetaSize: 32})
+	c.Assert(status, Equals, http.StatusConflict)
+	c.Assert(code, Equals, commonlib.CodeIncompleteUpload)
+	status, code = complete("xyz", &commonlib.CompleteRequest{Size: 48, MetaSize: 32})
+	c.Assert(status, Equals, http.StatusConflict)
+	c.Assert(code, Equals, commonlib.CodeIncompleteUpload)
+
+	// IDs may contain "+", which clients escape in the URL.  The signature covers
+	// the decoded path; one over the escaped path doesn't match.
+	status, _ = complete(url.PathEscape("a+b"), &commonlib.CompleteRequest{Size: 48, MetaSize: 32})
+	c.Assert(status, Equals, http.StatusNoContent)
+	status, _ = complete("a%2Bb", &commonlib.CompleteRequest{Size: 48, MetaSize: 32})
+	c.Assert(status, Equals, http.StatusNoContent)
+	body := []byte(`{"size":48,"meta_size":32}`)
+	escaped := httptest.NewRequest("POST", "/secrets/a%2Bb/complete", nil)
+	escaped.URL.Path = escaped.URL.RawPath
+	c.Assert(commonlib.SignRequest(escaped, body, "hunter2"), IsNil)
+	req := httptest.NewRequest("POST", "/secrets/a%2Bb/complete", bytes.NewReader(body))
+	req.Header.Set("Authorization", escaped.Header.Get("Authorization"))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	c.Assert(w.Code, Equals, http.StatusUnauthorized)
+
+	// Only callers who could have uploaded may ask.
+	req = httptest.NewRequest("POST", "/secrets/abc/complete", strings.NewReader(`{"size": 48, "meta_size": 32}`))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	c.Assert(w.Code, Equals, http.StatusUnauthorized)
+
+	// With a database, only the uploader may ask.
+	store, err := openBoltStore(filepath.Join(c.MkDir(), "secretshare.db"))
+	c.Assert(err, IsNil)
+	defer store.close()
+	endpoints.store = store
+	c.Assert(store.create(&secretRecord{ObjectId: "abc", Owner: "alice@example.com", Flags: secretPending}), IsNil)
+	status, code = complete("abc", &commonlib.CompleteRequest{Size: 48, MetaSize: 32})
+	c.Assert(status, Equals, http.StatusForbidden)
+	c.Assert(code, Equals, commonlib.CodeForbidden)
+	record, err := store.get("abc")
+	c.Assert(err, IsNil)
+	c.Assert(record.Flags&secretVerified, Equals, uint32(0))
+
+	c.Assert(store.create(&secretRecord{ObjectId: "abc", Owner: "secret_key", Flags: secretPending}), IsNil)
+	status, _ = complete("abc", &commonlib.CompleteRequest{Size: 48, MetaSize: 32})
+	c.Assert(status, Equals, http.StatusNoContent)
+	record, err = store.get("abc")
+	c.Assert(err, IsNil)
+	c.Assert(record.Flags&secretVerified, Equals, secretVerified)
+}
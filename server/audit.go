@@ -0,0 +1,255 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// Audit event types.
+const (
+	AuditSecretCreated = "secret_created"
+	AuditSecretExpired = "secret_expired"
+	AuditSecretRevoked = "secret_revoked"
+	// AuditSecretRetrieved is a client's report that it received a secret.  Reports
+	// aren't authenticated, so ClientIP is all there is to say who made one.
+	AuditSecretRetrieved = "secret_retrieved"
+)
+
+var ErrAuditChainBroken = errors.New("Audit log hash chain is broken")
+
+type auditConfig struct {
+	// File is the path of a file to append audit entries to.
+	File string `json:"file"`
+	// Syslog sends audit entries to the local syslog daemon as well.
+	Syslog bool `json:"syslog"`
+	// SyslogTag is the tag used for syslog messages.  It defaults to "secretshare-audit".
+	SyslogTag string `json:"syslog_tag"`
+}
+
+// auditEntry is one line of the audit log.
+//
+// Hash is the SHA-256 of PrevHash followed by the JSON encoding of the entry with Hash
+// left empty.  Since each entry includes the hash of the one before it, removing or
+// editing an entry breaks the chain for every entry after it.
+type auditEntry struct {
+	Seq      int64     `json:"seq"`
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	ReqId    string    `json:"req_id,omitempty"`
+	Caller   string    `json:"caller,omitempty"`
+	AuthType string    `json:"auth_type,omitempty"`
+	ClientIP string    `json:"client_ip,omitempty"`
+	Tenant   string    `json:"tenant,omitempty"`
+	ObjectId string    `json:"object_id"`
+	TTL      int64     `json:"ttl_seconds,omitempty"`
+	PrevHash string    `json:"prev_hash"`
+	Hash     string    `json:"hash,omitempty"`
+}
+
+func (self *auditEntry) computeHash() (string, error) {
+	unhashed := *self
+	unhashed.Hash = ""
+	entryBytes, err := json.Marshal(&unhashed)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.New()
+	sum.Write([]byte(self.PrevHash))
+	sum.Write(entryBytes)
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// auditLogger writes audit entries.  It is kept separate from the logrus output on
+// purpose: the debug log is for operators, and its format can change at any time.
+type auditLogger struct {
+	mutex    sync.Mutex
+	file     *os.File
+	syslog   io.Writer
+	seq      int64
+	lastHash string
+}
+
+// newAuditLogger opens the audit log and picks up the hash chain where it left off.
+func newAuditLogger(config *auditConfig) (*auditLogger, error) {
+	logger := &auditLogger{}
+	if config.File != "" {
+		last, err := lastAuditEntry(config.File)
+		if err != nil {
+			return nil, err
+		}
+		if last != nil {
+			logger.seq = last.Seq
+			logger.lastHash = last.Hash
+		}
+		logger.file, err = os.OpenFile(config.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.Syslog {
+		tag := config.SyslogTag
+		if tag == "" {
+			tag = "secretshare-audit"
+		}
+		w, err := newSyslogWriter(tag)
+		if err != nil {
+			return nil, err
+		}
+		logger.syslog = w
+	}
+	return logger, nil
+}
+
+// lastAuditEntry returns the final entry in an existing audit log, or nil if there
+// isn't one.
+func lastAuditEntry(path string) (*auditEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var last *auditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry auditEntry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("Audit log %s is corrupt: %s", path, err.Error())
+		}
+		last = &entry
+	}
+	return last, scanner.Err()
+}
+
+// record appends an entry to the audit log.  A nil auditLogger discards everything.
+func (self *auditLogger) record(entry *auditEntry) {
+	if self == nil {
+		return
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.seq++
+	entry.Seq = self.seq
+	entry.Time = time.Now().UTC()
+	entry.PrevHash = self.lastHash
+	hash, err := entry.computeHash()
+	if err != nil {
+		log.Errorf("Failed to hash audit entry: %s", err.Error())
+		return
+	}
+	entry.Hash = hash
+	self.lastHash = hash
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorf("Failed to encode audit entry: %s", err.Error())
+		return
+	}
+	line = append(line, '\n')
+	if self.file != nil {
+		if _, err = self.file.Write(line); err != nil {
+			log.Errorf("Failed to write audit entry: %s", err.Error())
+		}
+	}
+	if self.syslog != nil {
+		if _, err = self.syslog.Write(line); err != nil {
+			log.Errorf("Failed to send audit entry to syslog: %s", err.Error())
+		}
+	}
+}
+
+// verifyAuditLog checks the hash chain of an audit log.  It returns the number of
+// entries and the hash of the last one.  The chain has to start at the beginning, so
+// that removing entries from the start of the log is detected too.
+func verifyAuditLog(r io.Reader) (int64, string, error) {
+	var count int64
+	var prev auditEntry
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return count, prev.Hash, fmt.Errorf("line %d: %s", lineNum, err.Error())
+		}
+		if count == 0 {
+			if entry.Seq != 1 || entry.PrevHash != "" {
+				return count, prev.Hash, fmt.Errorf("line %d: %s: the log doesn't start with the first entry (seq %d)", lineNum, ErrAuditChainBroken.Error(), entry.Seq)
+			}
+		} else {
+			if entry.Seq != prev.Seq+1 {
+				return count, prev.Hash, fmt.Errorf("line %d: %s: expected seq %d, found %d", lineNum, ErrAuditChainBroken.Error(), prev.Seq+1, entry.Seq)
+			}
+			if entry.PrevHash != prev.Hash {
+				return count, prev.Hash, fmt.Errorf("line %d: %s: prev_hash does not match the previous entry", lineNum, ErrAuditChainBroken.Error())
+			}
+		}
+		hash, err := entry.computeHash()
+		if err != nil {
+			return count, prev.Hash, fmt.Errorf("line %d: %s", lineNum, err.Error())
+		}
+		if hash != entry.Hash {
+			return count, prev.Hash, fmt.Errorf("line %d: %s: entry has been modified", lineNum, ErrAuditChainBroken.Error())
+		}
+		count++
+		prev = entry
+	}
+	return count, prev.Hash, scanner.Err()
+}
+
+func auditVerify(c *cli.Context) error {
+	path := c.Args().Get(0)
+	if path == "" || len(c.Args()) > 1 {
+		return cli.NewExitError("USAGE: secretshare-server audit verify FILENAME", 1)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Failed to open audit log: %s", err.Error()), 1)
+	}
+	defer f.Close()
+
+	count, lastHash, err := verifyAuditLog(f)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("FAILED after %d good entries: %s", count, err.Error()), 1)
+	}
+	fmt.Printf("OK: %d entries\n", count)
+	fmt.Printf("Last hash: %s\n", lastHash)
+	return nil
+}
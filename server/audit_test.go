@@ -0,0 +1,147 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type AuditSuite struct {
+	dir string
+}
+
+var _ = Suite(&AuditSuite{})
+
+func (s *AuditSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+}
+
+func (s *AuditSuite) writeEntries(c *C, path string, ids ...string) {
+	audit, err := newAuditLogger(&auditConfig{File: path})
+	c.Assert(err, IsNil)
+	for _, id := range ids {
+		audit.record(&auditEntry{
+			Event:    AuditSecretCreated,
+			Caller:   "user@example.com",
+			ObjectId: id,
+			TTL:      3600,
+		})
+	}
+	c.Assert(audit.file.Close(), IsNil)
+}
+
+func (s *AuditSuite) TestChain(c *C) {
+	path := filepath.Join(s.dir, "audit.log")
+	s.writeEntries(c, path, "a", "b")
+	// Reopening the log continues the existing chain.
+	s.writeEntries(c, path, "c")
+
+	f, err := os.Open(path)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	count, lastHash, err := verifyAuditLog(f)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, int64(3))
+
+	last, err := lastAuditEntry(path)
+	c.Assert(err, IsNil)
+	c.Assert(last.Hash, Equals, lastHash)
+	c.Assert(last.Seq, Equals, int64(3))
+	c.Assert(last.ObjectId, Equals, "c")
+}
+
+func (s *AuditSuite) TestTampering(c *C) {
+	path := filepath.Join(s.dir, "audit.log")
+	s.writeEntries(c, path, "a", "b", "c")
+	logBytes, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	lines := strings.SplitAfter(string(logBytes), "\n")
+
+	// Editing an entry is detected.
+	edited := strings.Replace(string(logBytes), "user@example.com", "someone@example.com", 1)
+	_, _, err = verifyAuditLog(strings.NewReader(edited))
+	c.Assert(err, ErrorMatches, "line 1: .*modified")
+
+	// So is removing one.
+	removed := lines[0] + lines[2]
+	count, _, err := verifyAuditLog(strings.NewReader(removed))
+	c.Assert(err, ErrorMatches, "line 2: .*expected seq 2, found 3")
+	c.Assert(count, Equals, int64(1))
+
+	// Even from the start.
+	count, _, err = verifyAuditLog(strings.NewReader(lines[1] + lines[2]))
+	c.Assert(err, ErrorMatches, "line 1: .*doesn't start with the first entry \\(seq 2\\)")
+	c.Assert(count, Equals, int64(0))
+
+	// And so is reordering.
+	swapped := lines[1] + lines[0] + lines[2]
+	_, _, err = verifyAuditLog(bytes.NewBufferString(swapped))
+	c.Assert(err, NotNil)
+}
+
+func (s *AuditSuite) TestRetrieval(c *C) {
+	path := filepath.Join(s.dir, "audit.log")
+	audit, err := newAuditLogger(&auditConfig{File: path})
+	c.Assert(err, IsNil)
+	defer audit.file.Close()
+	store, err := openBoltStore(filepath.Join(s.dir, "secretshare.db"))
+	c.Assert(err, IsNil)
+	defer store.close()
+	c.Assert(store.create(&secretRecord{ObjectId: "abc", Created: time.Now(), TTL: 3600}), IsNil)
+
+	r, err := newRouter(&serverConfig{})
+	c.Assert(err, IsNil)
+	r.POST("/secrets/:id/retrieved", retrievalHandler(store, audit))
+	req := httptest.NewRequest("POST", "/secrets/abc/retrieved", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	c.Assert(w.Code, Equals, http.StatusNoContent)
+
+	last, err := lastAuditEntry(path)
+	c.Assert(err, IsNil)
+	c.Assert(last.Event, Equals, AuditSecretRetrieved)
+	c.Assert(last.ObjectId, Equals, "abc")
+	c.Assert(last.ClientIP, Equals, "192.0.2.1")
+	c.Assert(last.ReqId, Equals, w.Header().Get("Secretshare-ReqId"))
+	c.Assert(last.ReqId, Not(Equals), "")
+
+	// Reports for secrets the server doesn't know about aren't audited, and nor are
+	// repeated ones.
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/secrets/nonesuch/retrieved", nil))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	c.Assert(w.Code, Equals, http.StatusNoContent)
+	// Nor does claiming to be someone else make a report new.
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	last, err = lastAuditEntry(path)
+	c.Assert(err, IsNil)
+	c.Assert(last.Seq, Equals, int64(1))
+	record, err := store.get("abc")
+	c.Assert(err, IsNil)
+	c.Assert(record.Retrievals, HasLen, 1)
+}
@@ -0,0 +1,484 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/gin-gonic/gin"
+
+	"github.com/waucka/secretshare/commonlib"
+)
+
+var (
+	ErrNoCredentials   = errors.New("No credentials provided")
+	ErrBadSecretKey    = errors.New("Incorrect secret key")
+	ErrMissingGroup    = errors.New("Token does not grant membership in a required group")
+	ErrBearerNotConfig = errors.New("Bearer tokens are not accepted by this server")
+	ErrCertNotAllowed  = errors.New("Client certificate is not in the allowlist")
+	ErrStaleSignature  = errors.New("Request signature has expired; check your clock")
+	ErrReplayedNonce   = errors.New("Request nonce has already been used")
+	ErrLegacyAuth      = errors.New("This server no longer accepts secret keys in the request body; update your client")
+	ErrNotAdmin        = errors.New("Caller is not an administrator")
+
+	// SignatureWindow is how far a signed request's timestamp may be from the server's clock.
+	SignatureWindow = 5 * time.Minute
+)
+
+// identity describes the caller of an authenticated request.
+type identity struct {
+	// Name is a human-readable name for the caller, suitable for logging.
+	Name string
+	// Method is the authentication method used (e.g. "secret_key" or "oidc").
+	Method string
+	// Tenant is set if the credentials themselves say which tenant the caller
+	// belongs to, as a tenant's secret_key does.
+	Tenant string
+}
+
+type oidcConfig struct {
+	Issuer         string   `json:"issuer"`
+	Audience       string   `json:"audience"`
+	GroupsClaim    string   `json:"groups_claim"`
+	RequiredGroups []string `json:"required_groups"`
+}
+
+// oidcVerifier checks bearer tokens against an OpenID Connect issuer.
+type oidcVerifier struct {
+	verifier       *oidc.IDTokenVerifier
+	groupsClaim    string
+	requiredGroups []string
+}
+
+// newOIDCVerifier fetches the issuer's discovery document and prepares to verify tokens
+// signed with the keys from its JWKS.  The keys themselves are fetched (and refreshed)
+// lazily by go-oidc.
+func newOIDCVerifier(ctx context.Context, config *oidcConfig) (*oidcVerifier, error) {
+	if config.Issuer == "" {
+		return nil, errors.New("oidc.issuer must be set")
+	}
+	if config.Audience == "" {
+		return nil, errors.New("oidc.audience must be set")
+	}
+	provider, err := oidc.NewProvider(ctx, config.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query OIDC issuer %s: %s", config.Issuer, err.Error())
+	}
+	groupsClaim := config.GroupsClaim
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+	return &oidcVerifier{
+		verifier:       provider.Verifier(&oidc.Config{ClientID: config.Audience}),
+		groupsClaim:    groupsClaim,
+		requiredGroups: config.RequiredGroups,
+	}, nil
+}
+
+// verify checks the signature, issuer, audience, and expiry of a raw JWT and makes sure
+// that it lists every required group.
+func (self *oidcVerifier) verify(ctx context.Context, rawToken string) (*identity, error) {
+	token, err := self.verifier.Verify(ctx, rawToken)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err = token.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string]bool)
+	if groupList, ok := claims[self.groupsClaim].([]interface{}); ok {
+		for _, g := range groupList {
+			if gs, ok := g.(string); ok {
+				groups[gs] = true
+			}
+		}
+	}
+	for _, required := range self.requiredGroups {
+		if !groups[required] {
+			return nil, ErrMissingGroup
+		}
+	}
+
+	name := token.Subject
+	if email, ok := claims["email"].(string); ok && email != "" {
+		name = email
+	}
+	return &identity{
+		Name:   name,
+		Method: commonlib.AuthOIDC,
+	}, nil
+}
+
+// clientCertRule maps client certificates to an identity.
+//
+// A certificate matches if its subject common name equals SubjectCN or if any of its
+// DNS, email, or URI subject alternative names equals SAN.  Empty fields never match.
+type clientCertRule struct {
+	SubjectCN string `json:"subject_cn"`
+	SAN       string `json:"san"`
+	Identity  string `json:"identity"`
+}
+
+func (self *clientCertRule) matches(cert *x509.Certificate) bool {
+	if self.SubjectCN != "" && cert.Subject.CommonName == self.SubjectCN {
+		return true
+	}
+	if self.SAN == "" {
+		return false
+	}
+	sans := make([]string, 0, len(cert.DNSNames)+len(cert.EmailAddresses)+len(cert.URIs))
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	for _, san := range sans {
+		if san == self.SAN {
+			return true
+		}
+	}
+	return false
+}
+
+// nonceCache remembers the nonces of recently-verified signed requests so that they
+// can't be replayed.  Nonces only need to be remembered for as long as their timestamps
+// would be accepted.  Every nonce is kept for the same time, so the oldest expire
+// first; queue holds them in the order they were seen.
+type nonceCache struct {
+	mutex  sync.Mutex
+	window time.Duration
+	seen   map[string]time.Time
+	queue  []seenNonce
+}
+
+type seenNonce struct {
+	nonce  string
+	expiry time.Time
+}
+
+func newNonceCache(window time.Duration) *nonceCache {
+	return &nonceCache{
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// check records the nonce and returns false if it has been seen before.
+func (self *nonceCache) check(nonce string, now time.Time) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for len(self.queue) > 0 && now.After(self.queue[0].expiry) {
+		delete(self.seen, self.queue[0].nonce)
+		self.queue = self.queue[1:]
+	}
+	if _, exists := self.seen[nonce]; exists {
+		return false
+	}
+	// The timestamp can be up to one window in the future, so keep the nonce for two.
+	expiry := now.Add(2 * self.window)
+	self.seen[nonce] = expiry
+	self.queue = append(self.queue, seenNonce{nonce, expiry})
+	return true
+}
+
+// authenticator decides whether a request to the secretshare server may proceed.
+//
+// The mutex guards the settings that can be changed by update.
+type authenticator struct {
+	mutex           sync.RWMutex
+	secretKey       string
+	allowLegacyAuth bool
+	nonces          *nonceCache
+	oidc            *oidcVerifier
+	sshLogin        *sshLogin
+	clientCerts     []clientCertRule
+	adminKey        string
+	admins          []string
+	tenants         []*tenantConfig
+}
+
+// update replaces the settings that can be changed without restarting the server.
+func (self *authenticator) update(config *serverConfig) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.secretKey = config.SecretKey
+	self.allowLegacyAuth = config.AllowLegacyAuth
+	self.clientCerts = config.ClientCerts
+	self.adminKey = config.AdminKey
+	self.admins = config.Admins
+	self.tenants = config.Tenants
+}
+
+// settings returns the current values of the user authentication settings that update
+// can change.
+func (self *authenticator) settings() (string, bool, []clientCertRule) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return self.secretKey, self.allowLegacyAuth, self.clientCerts
+}
+
+// schemes lists the authentication schemes currently accepted for uploads.
+func (self *authenticator) schemes() []string {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	schemes := make([]string, 0)
+	if len(self.secretKeysLocked()) > 0 {
+		schemes = append(schemes, commonlib.AuthSignature)
+		if self.allowLegacyAuth {
+			schemes = append(schemes, commonlib.AuthLegacySecretKey)
+		}
+	}
+	if self.oidc != nil {
+		schemes = append(schemes, commonlib.AuthOIDC)
+	}
+	if self.sshLogin != nil {
+		schemes = append(schemes, commonlib.AuthSSHKey)
+	}
+	if len(self.clientCerts) > 0 {
+		schemes = append(schemes, commonlib.AuthClientCert)
+	}
+	return schemes
+}
+
+// secretKeys returns the pre-shared keys currently accepted, mapped to the tenants
+// they belong to.
+func (self *authenticator) secretKeys() map[string]string {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return self.secretKeysLocked()
+}
+
+func (self *authenticator) secretKeysLocked() map[string]string {
+	keys := make(map[string]string)
+	if self.secretKey != "" {
+		keys[self.secretKey] = DefaultTenant
+	}
+	for _, tenant := range self.tenants {
+		if tenant.SecretKey != "" {
+			keys[tenant.SecretKey] = tenant.Name
+		}
+	}
+	return keys
+}
+
+// tenantFor returns the name of the tenant an authenticated caller belongs to.
+func (self *authenticator) tenantFor(caller *identity) string {
+	if caller.Tenant != "" {
+		return caller.Tenant
+	}
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	for _, tenant := range self.tenants {
+		if tenant.matches(caller.Name) {
+			return tenant.Name
+		}
+	}
+	return DefaultTenant
+}
+
+// adminSettings returns the current admin key and list of administrators.
+func (self *authenticator) adminSettings() (string, []string) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return self.adminKey, self.admins
+}
+
+// verifySignature checks a request signed with a pre-shared key.  The key used
+// decides the caller's tenant.
+func (self *authenticator) verifySignature(c *gin.Context, sig *commonlib.RequestSignature, body []byte) (*identity, error) {
+	keys := self.secretKeys()
+	candidates := make([]string, 0, len(keys))
+	for key := range keys {
+		candidates = append(candidates, key)
+	}
+	key, err := self.checkSignature(c, sig, body, candidates...)
+	if err != nil {
+		return nil, err
+	}
+	return &identity{
+		Name:   "secret_key",
+		Method: commonlib.AuthSignature,
+		Tenant: keys[key],
+	}, nil
+}
+
+// checkSignature checks that a request was recently signed with one of keys and hasn't
+// been seen before, and returns the key that signed it.
+func (self *authenticator) checkSignature(c *gin.Context, sig *commonlib.RequestSignature, body []byte, keys ...string) (string, error) {
+	now := time.Now()
+	skew := now.Sub(time.Unix(sig.Timestamp, 0))
+	if skew > SignatureWindow || skew < -SignatureWindow {
+		return "", ErrStaleSignature
+	}
+	// Check the signature before the nonce so that garbage can't fill the cache.
+	err := ErrBadSecretKey
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if err = sig.Verify(key, c.Request.Method, c.Request.URL.Path, body); err == nil {
+			if !self.nonces.check(sig.Nonce, now) {
+				return "", ErrReplayedNonce
+			}
+			return key, nil
+		}
+	}
+	return "", err
+}
+
+// verifiedClientCert returns the leaf certificate presented by the client, if the TLS
+// stack was able to verify it against the configured client CA.
+func verifiedClientCert(c *gin.Context) *x509.Certificate {
+	if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	chain := c.Request.TLS.VerifiedChains[0]
+	if len(chain) == 0 {
+		return nil
+	}
+	return chain[0]
+}
+
+// certIdentity maps a verified client certificate to an identity using the allowlist.
+func (self *authenticator) certIdentity(cert *x509.Certificate) (*identity, error) {
+	_, _, clientCerts := self.settings()
+	for i := range clientCerts {
+		rule := &clientCerts[i]
+		if rule.matches(cert) {
+			name := rule.Identity
+			if name == "" {
+				name = cert.Subject.CommonName
+			}
+			return &identity{
+				Name:   name,
+				Method: commonlib.AuthClientCert,
+			}, nil
+		}
+	}
+	return nil, ErrCertNotAllowed
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header, if there is one.
+func bearerToken(c *gin.Context) (string, bool) {
+	authHeader := c.GetHeader("Authorization")
+	if len(authHeader) < 7 || !strings.EqualFold(authHeader[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(authHeader[7:]), true
+}
+
+// authenticate works out who is making an upload request.
+//
+// body is the raw request body, which is covered by request signatures.
+//
+// Bearer tokens are either session tokens from an SSH key login or OIDC tokens.  A
+// bearer token or request signature takes precedence over a client certificate, which
+// in turn takes precedence over the pre-shared key in the request body.  The pre-shared
+// key is only accepted if one is configured; an empty secret_key disables it entirely.
+// Sending the pre-shared key in the body is how API version 3 clients authenticate, and
+// is only accepted if allow_legacy_auth is set.
+func (self *authenticator) authenticate(c *gin.Context, body []byte, requestData *commonlib.UploadRequest) (*identity, error) {
+	sig, signed, err := commonlib.ParseSignatureHeader(c.GetHeader("Authorization"))
+	if err != nil {
+		return nil, err
+	}
+	if signed {
+		return self.verifySignature(c, sig, body)
+	}
+
+	if rawToken, ok := bearerToken(c); ok {
+		if isSessionToken(rawToken) {
+			if self.sshLogin == nil {
+				return nil, ErrSSHLoginDisabled
+			}
+			return self.sshLogin.verifySession(rawToken)
+		}
+		if self.oidc == nil {
+			return nil, ErrBearerNotConfig
+		}
+		return self.oidc.verify(c.Request.Context(), rawToken)
+	}
+
+	if cert := verifiedClientCert(c); cert != nil {
+		return self.certIdentity(cert)
+	}
+
+	_, allowLegacyAuth, _ := self.settings()
+	keys := self.secretKeys()
+	if len(keys) > 0 && requestData.SecretKey != "" {
+		if !allowLegacyAuth {
+			return nil, ErrLegacyAuth
+		}
+		for key, tenant := range keys {
+			if subtle.ConstantTimeCompare([]byte(requestData.SecretKey), []byte(key)) == 1 {
+				return &identity{
+					Name:   "secret_key",
+					Method: commonlib.AuthLegacySecretKey,
+					Tenant: tenant,
+				}, nil
+			}
+		}
+		return nil, ErrBadSecretKey
+	}
+
+	return nil, ErrNoCredentials
+}
+
+// authenticateAdmin works out whether a request may use the admin API.
+//
+// Requests signed with admin_key are always allowed; this is what "secretshare-server
+// admin" does.  Otherwise, the caller must authenticate as a user would (except with
+// the pre-shared key, which every user has) and be listed in admins.
+func (self *authenticator) authenticateAdmin(c *gin.Context, body []byte) (*identity, error) {
+	adminKey, admins := self.adminSettings()
+	sig, signed, err := commonlib.ParseSignatureHeader(c.GetHeader("Authorization"))
+	if err != nil {
+		return nil, err
+	}
+	if signed {
+		if _, err = self.checkSignature(c, sig, body, adminKey); err != nil {
+			return nil, err
+		}
+		return &identity{
+			Name:   "admin_key",
+			Method: "admin_signature",
+		}, nil
+	}
+
+	caller, err := self.authenticate(c, body, &commonlib.UploadRequest{})
+	if err != nil {
+		return nil, err
+	}
+	for _, admin := range admins {
+		if caller.Name == admin {
+			return caller, nil
+		}
+	}
+	return nil, ErrNotAdmin
+}
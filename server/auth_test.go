@@ -0,0 +1,291 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "gopkg.in/check.v1"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/waucka/secretshare/commonlib"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+// mockIssuer is a minimal OpenID Connect issuer that serves discovery and JWKS documents.
+type mockIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	signer jose.Signer
+}
+
+func newMockIssuer(c *C) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "test"),
+	)
+	c.Assert(err, IsNil)
+
+	issuer := &mockIssuer{key: key, signer: signer}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                 issuer.server.URL,
+			"authorization_endpoint": issuer.server.URL + "/auth",
+			"token_endpoint":         issuer.server.URL + "/token",
+			"jwks_uri":               issuer.server.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{
+			Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"}},
+		})
+	})
+	issuer.server = httptest.NewServer(mux)
+	return issuer
+}
+
+func (self *mockIssuer) token(c *C, audience string, expiry time.Time, groups []string) string {
+	claims := jwt.Claims{
+		Issuer:   self.server.URL,
+		Subject:  "user123",
+		Audience: jwt.Audience{audience},
+		IssuedAt: jwt.NewNumericDate(time.Now()),
+		Expiry:   jwt.NewNumericDate(expiry),
+	}
+	extra := map[string]interface{}{
+		"email":  "user@example.com",
+		"groups": groups,
+	}
+	raw, err := jwt.Signed(self.signer).Claims(claims).Claims(extra).CompactSerialize()
+	c.Assert(err, IsNil)
+	return raw
+}
+
+type OIDCSuite struct {
+	issuer   *mockIssuer
+	verifier *oidcVerifier
+}
+
+var _ = Suite(&OIDCSuite{})
+
+func (s *OIDCSuite) SetUpSuite(c *C) {
+	s.issuer = newMockIssuer(c)
+	verifier, err := newOIDCVerifier(context.Background(), &oidcConfig{
+		Issuer:         s.issuer.server.URL,
+		Audience:       "secretshare",
+		RequiredGroups: []string{"secretshare-users"},
+	})
+	c.Assert(err, IsNil)
+	s.verifier = verifier
+}
+
+func (s *OIDCSuite) TearDownSuite(c *C) {
+	s.issuer.server.Close()
+}
+
+func (s *OIDCSuite) TestValidToken(c *C) {
+	raw := s.issuer.token(c, "secretshare", time.Now().Add(time.Hour), []string{"secretshare-users", "other"})
+	caller, err := s.verifier.verify(context.Background(), raw)
+	c.Assert(err, IsNil)
+	c.Assert(caller.Name, Equals, "user@example.com")
+	c.Assert(caller.Method, Equals, "oidc")
+}
+
+func (s *OIDCSuite) TestWrongAudience(c *C) {
+	raw := s.issuer.token(c, "someone-else", time.Now().Add(time.Hour), []string{"secretshare-users"})
+	_, err := s.verifier.verify(context.Background(), raw)
+	c.Assert(err, NotNil)
+}
+
+func (s *OIDCSuite) TestExpiredToken(c *C) {
+	raw := s.issuer.token(c, "secretshare", time.Now().Add(-time.Hour), []string{"secretshare-users"})
+	_, err := s.verifier.verify(context.Background(), raw)
+	c.Assert(err, NotNil)
+}
+
+func (s *OIDCSuite) TestMissingGroup(c *C) {
+	raw := s.issuer.token(c, "secretshare", time.Now().Add(time.Hour), []string{"other"})
+	_, err := s.verifier.verify(context.Background(), raw)
+	c.Assert(err, Equals, ErrMissingGroup)
+}
+
+type ClientCertSuite struct{}
+
+var _ = Suite(&ClientCertSuite{})
+
+func (s *ClientCertSuite) TestAllowlist(c *C) {
+	auth := &authenticator{
+		clientCerts: []clientCertRule{
+			{SubjectCN: "ci-runner-1", Identity: "ci"},
+			{SAN: "deploy.example.com"},
+		},
+	}
+
+	caller, err := auth.certIdentity(&x509.Certificate{Subject: pkix.Name{CommonName: "ci-runner-1"}})
+	c.Assert(err, IsNil)
+	c.Assert(caller.Name, Equals, "ci")
+	c.Assert(caller.Method, Equals, "client_cert")
+
+	caller, err = auth.certIdentity(&x509.Certificate{
+		Subject:  pkix.Name{CommonName: "deploy"},
+		DNSNames: []string{"other.example.com", "deploy.example.com"},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(caller.Name, Equals, "deploy")
+
+	_, err = auth.certIdentity(&x509.Certificate{Subject: pkix.Name{CommonName: "stranger"}})
+	c.Assert(err, Equals, ErrCertNotAllowed)
+}
+
+type SignatureSuite struct{}
+
+var _ = Suite(&SignatureSuite{})
+
+func signedContext(c *C, key string, body []byte) *gin.Context {
+	req, err := http.NewRequest("POST", "http://localhost/upload", bytes.NewReader(body))
+	c.Assert(err, IsNil)
+	c.Assert(commonlib.SignRequest(req, body, key), IsNil)
+	return &gin.Context{Request: req}
+}
+
+func (s *SignatureSuite) TestSignedRequest(c *C) {
+	auth := &authenticator{
+		secretKey: "sekrit",
+		nonces:    newNonceCache(SignatureWindow),
+	}
+	body := []byte(`{"ttl":60,"object_id":"abc"}`)
+
+	ctx := signedContext(c, "sekrit", body)
+	caller, err := auth.authenticate(ctx, body, &commonlib.UploadRequest{})
+	c.Assert(err, IsNil)
+	c.Assert(caller.Method, Equals, "signature")
+
+	// The same request again is a replay.
+	_, err = auth.authenticate(ctx, body, &commonlib.UploadRequest{})
+	c.Assert(err, Equals, ErrReplayedNonce)
+
+	// A different body doesn't match the signature.
+	ctx = signedContext(c, "sekrit", body)
+	_, err = auth.authenticate(ctx, []byte(`{"ttl":9999,"object_id":"abc"}`), &commonlib.UploadRequest{})
+	c.Assert(err, Equals, commonlib.BadSignatureError)
+
+	// Neither does a different key.
+	ctx = signedContext(c, "wrong", body)
+	_, err = auth.authenticate(ctx, body, &commonlib.UploadRequest{})
+	c.Assert(err, Equals, commonlib.BadSignatureError)
+}
+
+func (s *SignatureSuite) TestStaleSignature(c *C) {
+	auth := &authenticator{
+		secretKey: "sekrit",
+		nonces:    newNonceCache(SignatureWindow),
+	}
+	body := []byte(`{}`)
+	ctx := signedContext(c, "sekrit", body)
+	sig, _, err := commonlib.ParseSignatureHeader(ctx.GetHeader("Authorization"))
+	c.Assert(err, IsNil)
+	sig.Timestamp -= int64((SignatureWindow + time.Minute) / time.Second)
+	_, err = auth.verifySignature(ctx, sig, body)
+	c.Assert(err, Equals, ErrStaleSignature)
+}
+
+func (s *SignatureSuite) TestLegacyAuth(c *C) {
+	auth := &authenticator{
+		secretKey: "sekrit",
+		nonces:    newNonceCache(SignatureWindow),
+	}
+	req, err := http.NewRequest("POST", "http://localhost/upload", nil)
+	c.Assert(err, IsNil)
+	ctx := &gin.Context{Request: req}
+
+	_, err = auth.authenticate(ctx, nil, &commonlib.UploadRequest{SecretKey: "sekrit"})
+	c.Assert(err, Equals, ErrLegacyAuth)
+
+	auth.allowLegacyAuth = true
+	caller, err := auth.authenticate(ctx, nil, &commonlib.UploadRequest{SecretKey: "sekrit"})
+	c.Assert(err, IsNil)
+	c.Assert(caller.Method, Equals, "legacy_secret_key")
+	_, err = auth.authenticate(ctx, nil, &commonlib.UploadRequest{SecretKey: "wrong"})
+	c.Assert(err, Equals, ErrBadSecretKey)
+}
+
+func (s *SignatureSuite) TestAdmin(c *C) {
+	auth := &authenticator{
+		secretKey:   "sekrit",
+		nonces:      newNonceCache(SignatureWindow),
+		clientCerts: []clientCertRule{{SubjectCN: "alice"}, {SubjectCN: "bob"}},
+		adminKey:    "admin-sekrit",
+		admins:      []string{"alice"},
+	}
+
+	ctx := signedContext(c, "admin-sekrit", nil)
+	caller, err := auth.authenticateAdmin(ctx, nil)
+	c.Assert(err, IsNil)
+	c.Assert(caller.Method, Equals, "admin_signature")
+
+	// The pre-shared key that every user has is no good.
+	ctx = signedContext(c, "sekrit", nil)
+	_, err = auth.authenticateAdmin(ctx, nil)
+	c.Assert(err, Equals, commonlib.BadSignatureError)
+
+	// Users who aren't listed as admins are turned away.
+	req, err := http.NewRequest("GET", "http://localhost/admin/secrets", nil)
+	c.Assert(err, IsNil)
+	ctx = &gin.Context{Request: req}
+	ctx.Request.TLS = &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "bob"}}}},
+	}
+	_, err = auth.authenticateAdmin(ctx, nil)
+	c.Assert(err, Equals, ErrNotAdmin)
+
+	ctx.Request.TLS.VerifiedChains[0][0].Subject.CommonName = "alice"
+	caller, err = auth.authenticateAdmin(ctx, nil)
+	c.Assert(err, IsNil)
+	c.Assert(caller.Name, Equals, "alice")
+}
+
+func (s *SignatureSuite) TestNonceExpiry(c *C) {
+	nonces := newNonceCache(time.Minute)
+	now := time.Now()
+	c.Assert(nonces.check("a", now), Equals, true)
+	c.Assert(nonces.check("b", now.Add(time.Minute)), Equals, true)
+	c.Assert(nonces.check("a", now.Add(time.Minute)), Equals, false)
+
+	// Nonces are forgotten two windows after they were seen, oldest first.
+	c.Assert(nonces.check("c", now.Add(2*time.Minute+time.Second)), Equals, true)
+	c.Assert(nonces.seen, HasLen, 2)
+	c.Assert(nonces.queue, HasLen, 2)
+	c.Assert(nonces.check("a", now.Add(2*time.Minute+time.Second)), Equals, true)
+	c.Assert(nonces.check("b", now.Add(2*time.Minute+time.Second)), Equals, false)
+}
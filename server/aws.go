@@ -0,0 +1,67 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// AssumeRoleSessionName identifies the server in CloudTrail when it assumes a role.
+const AssumeRoleSessionName = "secretshare-server"
+
+// newAWSSession creates the session used to talk to S3.
+//
+// If aws_access_key_id and aws_secret_access_key are set, they are used.  Otherwise,
+// the SDK's default credential chain is used: environment variables, the shared
+// credentials file and profile (AWS_PROFILE), web identity tokens (e.g. IAM roles for
+// service accounts on EKS), and finally the ECS task role or EC2 instance profile.
+// If assume_role_arn is set, the credentials found that way are used to assume it.
+func newAWSSession(config *serverConfig) (*session.Session, error) {
+	awsConfig := aws.Config{
+		Region: aws.String(config.BucketRegion),
+	}
+	if config.AwsAccessKeyId != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(config.AwsAccessKeyId, config.AwsSecretAccessKey, "")
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            awsConfig,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if config.AssumeRoleArn != "" {
+		roleCreds := stscreds.NewCredentials(sess, config.AssumeRoleArn, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = AssumeRoleSessionName
+		})
+		sess = sess.Copy(&aws.Config{Credentials: roleCreds})
+	}
+	return sess, nil
+}
+
+// credentialSource returns the name of the provider that supplied the session's
+// credentials, fetching them if necessary.
+func credentialSource(sess *session.Session) (string, error) {
+	creds, err := sess.Config.Credentials.Get()
+	if err != nil {
+		return "", err
+	}
+	return creds.ProviderName, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	. "gopkg.in/check.v1"
+)
+
+type AWSSuite struct {
+	savedEnv map[string]string
+}
+
+var _ = Suite(&AWSSuite{})
+
+var awsEnvVars = []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_PROFILE", "AWS_SHARED_CREDENTIALS_FILE", "AWS_CONFIG_FILE"}
+
+func (s *AWSSuite) SetUpTest(c *C) {
+	s.savedEnv = make(map[string]string)
+	for _, name := range awsEnvVars {
+		if value, ok := os.LookupEnv(name); ok {
+			s.savedEnv[name] = value
+		}
+		os.Unsetenv(name)
+	}
+	// Keep the SDK away from any real credentials on this machine.
+	os.Setenv("AWS_SHARED_CREDENTIALS_FILE", "/nonexistent")
+	os.Setenv("AWS_CONFIG_FILE", "/nonexistent")
+}
+
+func (s *AWSSuite) TearDownTest(c *C) {
+	for _, name := range awsEnvVars {
+		os.Unsetenv(name)
+	}
+	for name, value := range s.savedEnv {
+		os.Setenv(name, value)
+	}
+}
+
+func (s *AWSSuite) TestStaticKeys(c *C) {
+	sess, err := newAWSSession(&serverConfig{
+		BucketRegion:       "us-east-1",
+		AwsAccessKeyId:     "AKIAEXAMPLE",
+		AwsSecretAccessKey: "hunter2",
+	})
+	c.Assert(err, IsNil)
+	source, err := credentialSource(sess)
+	c.Assert(err, IsNil)
+	c.Assert(source, Equals, credentials.StaticProviderName)
+}
+
+func (s *AWSSuite) TestDefaultChain(c *C) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKIAENV")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "hunter2")
+	sess, err := newAWSSession(&serverConfig{BucketRegion: "us-east-1"})
+	c.Assert(err, IsNil)
+	source, err := credentialSource(sess)
+	c.Assert(err, IsNil)
+	// The session reads environment variables itself rather than using EnvProvider.
+	c.Assert(source, Equals, "EnvConfigCredentials")
+}
@@ -0,0 +1,134 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+var ErrNoSuchSecret = errors.New("No such secret")
+
+// expiresMetadataKey is the S3 user metadata key, recorded by generateSignedURL, that
+// holds the time (RFC 3339) at which a secret should be deleted.
+//
+// Secrets are public-read, so nothing identifying the uploader goes in the metadata;
+// the owner is kept in the store instead.
+const expiresMetadataKey = "Secretshare-Expires"
+
+// secretInfo describes a secret stored in the bucket.
+type secretInfo struct {
+	ObjectId string     `json:"object_id"`
+	Size     int64      `json:"size"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	Owner    string     `json:"owner,omitempty"`
+	Tenant   string     `json:"tenant"`
+	// Retrievals is the number of times clients have reported receiving the secret.
+	Retrievals int `json:"retrievals"`
+	// Verified is set once the uploader has confirmed that both objects arrived.
+	Verified bool `json:"verified,omitempty"`
+}
+
+// secretBucket knows how secrets are laid out in S3: the encrypted data is stored
+// under the object ID, and the encrypted metadata under "meta/" plus the object ID.
+type secretBucket struct {
+	svc  *s3.S3
+	name string
+}
+
+// list returns every secret in the bucket.  Only the ID, size, and creation time are
+// filled in; use describe for the rest.
+func (self *secretBucket) list() ([]*secretInfo, error) {
+	secrets := make([]*secretInfo, 0)
+	err := self.svc.ListObjectsPages(&s3.ListObjectsInput{
+		Bucket: aws.String(self.name),
+	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			if obj.Key == nil || strings.HasPrefix(*obj.Key, "meta/") {
+				continue
+			}
+			secrets = append(secrets, &secretInfo{
+				ObjectId: *obj.Key,
+				Size:     aws.Int64Value(obj.Size),
+				Created:  aws.TimeValue(obj.LastModified),
+			})
+		}
+		return true
+	})
+	return secrets, err
+}
+
+// describe fills in the size, creation time, and expiry time recorded on a secret.
+func (self *secretBucket) describe(info *secretInfo) error {
+	head, err := self.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(self.name),
+		Key:    aws.String(info.ObjectId),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == http.StatusNotFound {
+			return ErrNoSuchSecret
+		}
+		return err
+	}
+	info.Size = aws.Int64Value(head.ContentLength)
+	info.Created = aws.TimeValue(head.LastModified)
+	for k, v := range head.Metadata {
+		if v == nil || http.CanonicalHeaderKey(k) != expiresMetadataKey {
+			continue
+		}
+		if expires, err := time.Parse(time.RFC3339, *v); err == nil {
+			info.Expires = &expires
+		}
+	}
+	return nil
+}
+
+// size returns the size of an object, or ErrNoSuchSecret if there isn't one.
+func (self *secretBucket) size(key string) (int64, error) {
+	head, err := self.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(self.name),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == http.StatusNotFound {
+			return 0, ErrNoSuchSecret
+		}
+		return 0, err
+	}
+	return aws.Int64Value(head.ContentLength), nil
+}
+
+// delete removes both the data and the metadata for an object ID.
+func (self *secretBucket) delete(id string) error {
+	for _, key := range []string{id, "meta/" + id} {
+		_, err := self.svc.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(self.name),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
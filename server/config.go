@@ -0,0 +1,422 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli"
+	"sigs.k8s.io/yaml"
+)
+
+// EnvPrefix is the prefix of environment variables that override the config file.
+// SECRETSHARE_BUCKET sets "bucket", SECRETSHARE_OIDC_ISSUER sets "issuer" in the
+// "oidc" section, and so on.
+const EnvPrefix = "SECRETSHARE_"
+
+const redacted = "REDACTED"
+
+// envAliases maps the environment variable names used by the old Docker wrapper
+// script to the names they correspond to now.
+var envAliases = map[string]string{
+	"SECRETSHARE_AWS_KEY_ID":     "SECRETSHARE_AWS_ACCESS_KEY_ID",
+	"SECRETSHARE_AWS_SECRET_KEY": "SECRETSHARE_AWS_SECRET_ACCESS_KEY",
+}
+
+func defaultConfig() *serverConfig {
+	return &serverConfig{
+		ListenAddr: "0.0.0.0",
+		ListenPort: 5000,
+	}
+}
+
+// loadConfig builds the effective configuration.  Later sources override earlier ones:
+//
+//  1. built-in defaults
+//  2. the config file (JSON, or YAML if the name ends in .yaml or .yml)
+//  3. SECRETSHARE_* environment variables
+//  4. command-line flags
+//
+// If --config isn't given and the default config file doesn't exist, step 2 is skipped
+// so that the server can be configured entirely from the environment.  The returned
+// warnings are problems that aren't serious enough to refuse to start.
+func loadConfig(c *cli.Context) (*serverConfig, []string, error) {
+	config := defaultConfig()
+
+	configPath := c.GlobalString("config")
+	if configPath == "" {
+		configPath = DefaultConfigPath
+	}
+	err := readConfigFile(configPath, config)
+	if os.IsNotExist(err) && !c.GlobalIsSet("config") {
+		err = nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	warnings, err := applyEnv(config, os.Environ())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if c.GlobalIsSet("addr") {
+		config.ListenAddr = c.GlobalString("addr")
+	}
+	if c.GlobalIsSet("port") {
+		config.ListenPort = c.GlobalInt("port")
+	}
+	if c.GlobalIsSet("bucket") {
+		config.Bucket = c.GlobalString("bucket")
+	}
+	if c.GlobalIsSet("bucket-region") {
+		config.BucketRegion = c.GlobalString("bucket-region")
+	}
+	if config.DeleteExpired && config.SweepInterval <= 0 {
+		warnings = append(warnings, "delete_expired does nothing unless sweep_interval is set")
+	}
+	return config, warnings, nil
+}
+
+// readConfigFile decodes a config file over the top of config.  Unknown keys are an
+// error, since they're almost always typos.
+func readConfigFile(path string, config *serverConfig) error {
+	configData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".yaml" || ext == ".yml" {
+		configData, err = yaml.YAMLToJSONStrict(configData)
+		if err != nil {
+			return fmt.Errorf(`Config file "%s" is not valid YAML: %s`, path, err.Error())
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(configData))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(config)
+	if err != nil {
+		switch jsonErr := err.(type) {
+		case *json.SyntaxError:
+			return fmt.Errorf(`Config file "%s" is not valid JSON (line %d): %s`, path, lineOf(configData, jsonErr.Offset), err.Error())
+		case *json.UnmarshalTypeError:
+			return fmt.Errorf(`Config file "%s": "%s" should be a %s, not a %s`, path, jsonErr.Field, jsonErr.Type.String(), jsonErr.Value)
+		}
+		return fmt.Errorf(`Config file "%s": %s`, path, strings.TrimPrefix(err.Error(), "json: "))
+	}
+	if decoder.More() {
+		return fmt.Errorf(`Config file "%s" has extra data after the configuration`, path)
+	}
+	return nil
+}
+
+// lineOf returns the line number of a byte offset into data.
+func lineOf(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// applyEnv applies SECRETSHARE_* variables from environ to config.
+func applyEnv(config *serverConfig, environ []string) ([]string, error) {
+	env := make(map[string]string)
+	for _, kv := range environ {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 && strings.HasPrefix(parts[0], EnvPrefix) {
+			env[parts[0]] = parts[1]
+		}
+	}
+	used := make(map[string]bool)
+	for oldName, newName := range envAliases {
+		if value, ok := env[oldName]; ok {
+			if _, exists := env[newName]; !exists {
+				env[newName] = value
+			}
+			used[oldName] = true
+		}
+	}
+
+	if err := setFromEnv(reflect.ValueOf(config).Elem(), EnvPrefix, env, used); err != nil {
+		return nil, err
+	}
+
+	warnings := make([]string, 0)
+	for name := range env {
+		if used[name] || isServiceLinkVar(name) {
+			continue
+		}
+		warnings = append(warnings, fmt.Sprintf("Ignoring unknown environment variable %s", name))
+	}
+	return warnings, nil
+}
+
+// isServiceLinkVar reports whether name looks like one of the variables that
+// Kubernetes sets for a service named "secretshare".
+func isServiceLinkVar(name string) bool {
+	return strings.HasPrefix(name, EnvPrefix+"SERVICE_") || strings.HasPrefix(name, EnvPrefix+"PORT_")
+}
+
+// setFromEnv sets the fields of the struct v from env, using the upper-cased JSON key
+// of each field after prefix as the variable name.
+func setFromEnv(v reflect.Value, prefix string, env map[string]string, used map[string]bool) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		name := prefix + strings.ToUpper(key)
+		field := v.Field(i)
+
+		if field.Kind() == reflect.Ptr && field.Type().Elem().Kind() == reflect.Struct {
+			if !hasVarWithPrefix(env, name+"_") {
+				continue
+			}
+			if field.IsNil() {
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+			if err := setFromEnv(field.Elem(), name+"_", env, used); err != nil {
+				return err
+			}
+			continue
+		}
+
+		raw, ok := env[name]
+		if !ok {
+			continue
+		}
+		used[name] = true
+		// Kubernetes sets SECRETSHARE_PORT=tcp://<ip>:<port> for a service named
+		// "secretshare", which has nothing to do with us.
+		if name == EnvPrefix+"PORT" && strings.Contains(raw, "://") {
+			continue
+		}
+
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(raw)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				return fmt.Errorf(`%s must be a number, not "%s"`, name, raw)
+			}
+			field.SetInt(n)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(raw)
+			if err != nil {
+				return fmt.Errorf(`%s must be true or false, not "%s"`, name, raw)
+			}
+			field.SetBool(b)
+		case reflect.Slice:
+			if field.Type().Elem().Kind() != reflect.String {
+				return fmt.Errorf("%s can only be set in the config file", name)
+			}
+			items := make([]string, 0)
+			for _, item := range strings.Split(raw, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			field.Set(reflect.ValueOf(items))
+		default:
+			return fmt.Errorf("%s can only be set in the config file", name)
+		}
+	}
+	return nil
+}
+
+func hasVarWithPrefix(env map[string]string, prefix string) bool {
+	for name := range env {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate returns every problem with the configuration, including files that are
+// named in it but can't be loaded.
+func (self *serverConfig) validate() []string {
+	problems := make([]string, 0)
+	if self.Bucket == "" {
+		problems = append(problems, "bucket must be set")
+	}
+	if self.BucketRegion == "" {
+		problems = append(problems, "bucket_region must be set")
+	}
+	if self.ListenPort < 1 || self.ListenPort > 65535 {
+		problems = append(problems, fmt.Sprintf("port %d is out of range", self.ListenPort))
+	}
+	if (self.AwsAccessKeyId == "") != (self.AwsSecretAccessKey == "") {
+		problems = append(problems, "aws_access_key_id and aws_secret_access_key must be set together")
+	}
+	if self.SessionTTL < 0 {
+		problems = append(problems, "session_ttl must not be negative")
+	}
+	if self.DefaultTTL < 0 || self.MaxTTL < 0 {
+		problems = append(problems, "default_ttl and max_ttl must not be negative")
+	}
+	if self.MaxSize < 0 {
+		problems = append(problems, "max_size must not be negative")
+	}
+	if self.UploadRateLimit < 0 || self.UploadRateBurst < 0 {
+		problems = append(problems, "upload_rate_limit and upload_rate_burst must not be negative")
+	}
+	if self.ShutdownTimeout < 0 {
+		problems = append(problems, "shutdown_timeout must not be negative")
+	}
+	for _, proxy := range self.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			problems = append(problems, fmt.Sprintf(`trusted_proxies entry "%s" is not an IP address or CIDR range`, proxy))
+		}
+	}
+	if self.SweepInterval < 0 {
+		problems = append(problems, "sweep_interval must be 0 (disabled, the default) or a number of seconds")
+	}
+
+	tenantKeys := false
+	for _, tenant := range self.Tenants {
+		tenantKeys = tenantKeys || tenant.SecretKey != ""
+	}
+	if self.SecretKey == "" && !tenantKeys && self.OIDC == nil && self.SSHKeysFile == "" && len(self.ClientCerts) == 0 {
+		problems = append(problems, "No authentication method configured; set secret_key, oidc, ssh_keys_file, and/or client_certs")
+	}
+	problems = append(problems, self.validateTenants()...)
+	if self.CORS != nil {
+		problems = append(problems, self.CORS.validate()...)
+	}
+	if self.OIDC != nil {
+		if self.OIDC.Issuer == "" {
+			problems = append(problems, "oidc.issuer must be set")
+		}
+		if self.OIDC.Audience == "" {
+			problems = append(problems, "oidc.audience must be set")
+		}
+	}
+	if self.SSHKeysFile != "" {
+		if _, err := loadSSHKeys(self.SSHKeysFile); err != nil {
+			problems = append(problems, fmt.Sprintf(`Failed to load SSH keys from "%s": %s`, self.SSHKeysFile, err.Error()))
+		}
+	}
+	if self.DBFile != "" {
+		if info, err := os.Stat(filepath.Dir(self.DBFile)); err != nil || !info.IsDir() {
+			problems = append(problems, fmt.Sprintf(`The directory for db_file "%s" does not exist`, self.DBFile))
+		}
+	}
+	if self.AuditLog != nil && self.AuditLog.File == "" && !self.AuditLog.Syslog {
+		problems = append(problems, "audit_log needs file and/or syslog")
+	}
+
+	if self.tlsEnabled() {
+		if self.TLSCertFile == "" || self.TLSKeyFile == "" {
+			problems = append(problems, "tls_cert_file and tls_key_file must both be set")
+		} else if _, err := tls.LoadX509KeyPair(self.TLSCertFile, self.TLSKeyFile); err != nil {
+			problems = append(problems, fmt.Sprintf("Failed to load TLS certificate: %s", err.Error()))
+		}
+		if _, ok := tlsVersions[self.TLSMinVersion]; self.TLSMinVersion != "" && !ok {
+			problems = append(problems, fmt.Sprintf(`Unknown tls_min_version "%s"; use 1.0, 1.1, 1.2, or 1.3`, self.TLSMinVersion))
+		}
+	} else {
+		if self.HTTPRedirectPort != 0 {
+			problems = append(problems, "http_redirect_port requires tls_cert_file and tls_key_file")
+		}
+		if self.ClientCAFile != "" {
+			problems = append(problems, "client_ca_file requires tls_cert_file and tls_key_file")
+		}
+	}
+	if len(self.ClientCerts) > 0 && self.ClientCAFile == "" {
+		problems = append(problems, "client_certs requires client_ca_file")
+	}
+	if self.ClientCAFile != "" {
+		caBytes, err := ioutil.ReadFile(self.ClientCAFile)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf(`Failed to read client CA file "%s": %s`, self.ClientCAFile, err.Error()))
+		} else if !x509.NewCertPool().AppendCertsFromPEM(caBytes) {
+			problems = append(problems, ErrNoClientCAs.Error())
+		}
+	}
+	return problems
+}
+
+// redacted returns a copy of the configuration that is safe to print.
+func (self *serverConfig) redacted() *serverConfig {
+	safe := *self
+	if safe.SecretKey != "" {
+		safe.SecretKey = redacted
+	}
+	if safe.AdminKey != "" {
+		safe.AdminKey = redacted
+	}
+	if safe.AwsSecretAccessKey != "" {
+		safe.AwsSecretAccessKey = redacted
+	}
+	if len(self.Tenants) > 0 {
+		safe.Tenants = make([]*tenantConfig, len(self.Tenants))
+	}
+	for i, tenant := range self.Tenants {
+		safeTenant := *tenant
+		if safeTenant.SecretKey != "" {
+			safeTenant.SecretKey = redacted
+		}
+		if safeTenant.AwsSecretAccessKey != "" {
+			safeTenant.AwsSecretAccessKey = redacted
+		}
+		safe.Tenants[i] = &safeTenant
+	}
+	return &safe
+}
+
+// checkConfig validates the configuration and prints the effective configuration
+// with secrets redacted.
+func checkConfig(c *cli.Context) error {
+	config, warnings, err := loadConfig(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "WARNING: %s\n", warning)
+	}
+
+	configBytes, err := json.MarshalIndent(config.redacted(), "", "  ")
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fmt.Println(string(configBytes))
+
+	problems := config.validate()
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", problem)
+		}
+		return cli.NewExitError("Configuration is invalid", 1)
+	}
+	fmt.Fprintln(os.Stderr, "Configuration is valid")
+	return nil
+}
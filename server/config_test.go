@@ -0,0 +1,148 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type ConfigSuite struct {
+	dir string
+}
+
+var _ = Suite(&ConfigSuite{})
+
+func (s *ConfigSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+}
+
+func (s *ConfigSuite) writeFile(c *C, name, contents string) string {
+	path := filepath.Join(s.dir, name)
+	c.Assert(ioutil.WriteFile(path, []byte(contents), 0600), IsNil)
+	return path
+}
+
+func (s *ConfigSuite) TestJSON(c *C) {
+	path := s.writeFile(c, "config.json", `{"bucket": "secrets", "port": 8080, "oidc": {"issuer": "https://idp"}}`)
+	config := defaultConfig()
+	c.Assert(readConfigFile(path, config), IsNil)
+	c.Assert(config.Bucket, Equals, "secrets")
+	c.Assert(config.ListenPort, Equals, 8080)
+	c.Assert(config.ListenAddr, Equals, "0.0.0.0")
+	c.Assert(config.OIDC.Issuer, Equals, "https://idp")
+}
+
+func (s *ConfigSuite) TestYAML(c *C) {
+	path := s.writeFile(c, "config.yaml", "bucket: secrets\nclient_certs:\n  - subject_cn: ci\n")
+	config := defaultConfig()
+	c.Assert(readConfigFile(path, config), IsNil)
+	c.Assert(config.Bucket, Equals, "secrets")
+	c.Assert(config.ClientCerts, HasLen, 1)
+	c.Assert(config.ClientCerts[0].SubjectCN, Equals, "ci")
+}
+
+func (s *ConfigSuite) TestUnknownField(c *C) {
+	path := s.writeFile(c, "config.json", `{"bukket": "secrets"}`)
+	err := readConfigFile(path, defaultConfig())
+	c.Assert(err, ErrorMatches, `.*unknown field "bukket"`)
+
+	path = s.writeFile(c, "config.yml", "oidc:\n  isuer: https://idp\n")
+	err = readConfigFile(path, defaultConfig())
+	c.Assert(err, ErrorMatches, `.*unknown field "isuer"`)
+}
+
+func (s *ConfigSuite) TestBadJSON(c *C) {
+	path := s.writeFile(c, "config.json", "{\n\"bucket\": \"secrets\",\n}")
+	err := readConfigFile(path, defaultConfig())
+	c.Assert(err, ErrorMatches, `.*not valid JSON \(line 3\).*`)
+
+	path = s.writeFile(c, "config.json", `{"port": "80"}`)
+	err = readConfigFile(path, defaultConfig())
+	c.Assert(err, ErrorMatches, `.*"port" should be a int, not a string`)
+}
+
+func (s *ConfigSuite) TestEnv(c *C) {
+	config := defaultConfig()
+	config.Bucket = "from-file"
+	warnings, err := applyEnv(config, []string{
+		"SECRETSHARE_BUCKET=from-env",
+		"SECRETSHARE_ALLOW_LEGACY_AUTH=true",
+		"SECRETSHARE_AWS_KEY_ID=AKIAEXAMPLE",
+		"SECRETSHARE_OIDC_REQUIRED_GROUPS=a, b",
+		"SECRETSHARE_PORT=tcp://172.30.0.1:5000",
+		"SECRETSHARE_SERVICE_HOST=172.30.0.1",
+		"SECRETSHARE_BUKKET=typo",
+		"HOME=/root",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(config.Bucket, Equals, "from-env")
+	c.Assert(config.AllowLegacyAuth, Equals, true)
+	c.Assert(config.AwsAccessKeyId, Equals, "AKIAEXAMPLE")
+	c.Assert(config.OIDC.RequiredGroups, DeepEquals, []string{"a", "b"})
+	c.Assert(config.ListenPort, Equals, 5000)
+	c.Assert(config.AuditLog, IsNil)
+	c.Assert(warnings, DeepEquals, []string{"Ignoring unknown environment variable SECRETSHARE_BUKKET"})
+
+	_, err = applyEnv(config, []string{"SECRETSHARE_SESSION_TTL=forever"})
+	c.Assert(err, ErrorMatches, `SECRETSHARE_SESSION_TTL must be a number.*`)
+	_, err = applyEnv(config, []string{"SECRETSHARE_CLIENT_CERTS=ci"})
+	c.Assert(err, ErrorMatches, `SECRETSHARE_CLIENT_CERTS can only be set in the config file`)
+}
+
+func (s *ConfigSuite) TestValidate(c *C) {
+	config := defaultConfig()
+	config.ClientCerts = []clientCertRule{{SubjectCN: "ci"}}
+	config.HTTPRedirectPort = 80
+	c.Assert(config.validate(), DeepEquals, []string{
+		"bucket must be set",
+		"bucket_region must be set",
+		"http_redirect_port requires tls_cert_file and tls_key_file",
+		"client_certs requires client_ca_file",
+	})
+
+	config = defaultConfig()
+	config.Bucket = "secrets"
+	config.BucketRegion = "us-east-1"
+	config.SecretKey = "sekrit"
+	c.Assert(config.validate(), HasLen, 0)
+
+	config.SweepInterval = -1
+	c.Assert(config.validate(), DeepEquals, []string{
+		"sweep_interval must be 0 (disabled, the default) or a number of seconds",
+	})
+	config.SweepInterval = 0
+
+	config.TrustedProxies = []string{"10.0.0.1", "10.1.0.0/16", "proxy.example.com"}
+	c.Assert(config.validate(), DeepEquals, []string{
+		`trusted_proxies entry "proxy.example.com" is not an IP address or CIDR range`,
+	})
+}
+
+func (s *ConfigSuite) TestRedacted(c *C) {
+	config := defaultConfig()
+	config.SecretKey = "sekrit"
+	config.AwsAccessKeyId = "AKIAEXAMPLE"
+	config.AwsSecretAccessKey = "hunter2"
+	safe := config.redacted()
+	c.Assert(safe.SecretKey, Equals, "REDACTED")
+	c.Assert(safe.AwsSecretAccessKey, Equals, "REDACTED")
+	c.Assert(safe.AwsAccessKeyId, Equals, "AKIAEXAMPLE")
+	c.Assert(config.SecretKey, Equals, "sekrit")
+}
@@ -0,0 +1,268 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gin-gonic/gin"
+	"github.com/urfave/cli"
+)
+
+var (
+	// DefaultCORSMethods and DefaultCORSHeaders are what browsers on other origins may
+	// use if allowed_methods and allowed_headers aren't set.  They are enough to call
+	// /version and /upload.
+	DefaultCORSMethods = []string{"GET", "POST"}
+	DefaultCORSHeaders = []string{"Authorization", "Content-Type"}
+
+	// corsExposedHeaders are the response headers scripts on other origins may read.
+	corsExposedHeaders = []string{"Secretshare-ReqId", "Retry-After"}
+)
+
+// corsConfig says which web pages on other origins may call the server.
+type corsConfig struct {
+	// AllowedOrigins are origins like "https://portal.example.com", or "*" for any.
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods"`
+	AllowedHeaders   []string `json:"allowed_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	// MaxAge is how long, in seconds, browsers may cache a preflight response.
+	MaxAge int `json:"max_age"`
+}
+
+func (self *corsConfig) methods() []string {
+	if len(self.AllowedMethods) == 0 {
+		return DefaultCORSMethods
+	}
+	return self.AllowedMethods
+}
+
+func (self *corsConfig) headers() []string {
+	if len(self.AllowedHeaders) == 0 {
+		return DefaultCORSHeaders
+	}
+	return self.AllowedHeaders
+}
+
+func (self *corsConfig) allowsOrigin(origin string) bool {
+	for _, allowed := range self.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate returns a description of each problem with the CORS settings.
+func (self *corsConfig) validate() []string {
+	problems := make([]string, 0)
+	if len(self.AllowedOrigins) == 0 {
+		problems = append(problems, "cors.allowed_origins must be set")
+	}
+	for _, origin := range self.AllowedOrigins {
+		if origin == "*" {
+			if self.AllowCredentials {
+				problems = append(problems, `cors.allow_credentials can't be used with the origin "*"`)
+			}
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			problems = append(problems, fmt.Sprintf(`cors.allowed_origins: "%s" should look like https://portal.example.com`, origin))
+		}
+	}
+	if self.MaxAge < 0 {
+		problems = append(problems, "cors.max_age must not be negative")
+	}
+	return problems
+}
+
+// middleware returns gin middleware that adds CORS headers for allowed origins and
+// answers preflight requests.
+//
+// Requests from origins that aren't allowed are passed through without CORS headers,
+// so browsers won't let the page see the response; other clients don't care.
+func (self *corsConfig) middleware() gin.HandlerFunc {
+	methods := strings.Join(self.methods(), ", ")
+	headers := strings.Join(self.headers(), ", ")
+	exposed := strings.Join(corsExposedHeaders, ", ")
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			return
+		}
+		c.Writer.Header().Add("Vary", "Origin")
+		preflight := c.Request.Method == "OPTIONS" && c.GetHeader("Access-Control-Request-Method") != ""
+		if !self.allowsOrigin(origin) {
+			if preflight {
+				c.AbortWithStatus(http.StatusForbidden)
+			}
+			return
+		}
+
+		if containsFold(self.AllowedOrigins, "*") && !self.AllowCredentials {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Header("Access-Control-Allow-Origin", origin)
+		}
+		if self.AllowCredentials {
+			c.Header("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			c.Header("Access-Control-Expose-Headers", exposed)
+			return
+		}
+
+		if !containsFold(self.methods(), c.GetHeader("Access-Control-Request-Method")) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		c.Header("Access-Control-Allow-Methods", methods)
+		c.Header("Access-Control-Allow-Headers", headers)
+		if self.MaxAge > 0 {
+			c.Header("Access-Control-Max-Age", strconv.Itoa(self.MaxAge))
+		}
+		c.AbortWithStatus(http.StatusNoContent)
+	}
+}
+
+// CORSRuleID identifies the bucket CORS rule that init-bucket sets up, so that running
+// it again replaces that rule and leaves any others alone.
+const CORSRuleID = "secretshare"
+
+// bucketCORSRule is the bucket CORS rule that lets browsers on the given origins
+// upload to presigned URLs and download secrets.
+func bucketCORSRule(origins []string, maxAge int) *s3.CORSRule {
+	rule := &s3.CORSRule{
+		ID:             aws.String(CORSRuleID),
+		AllowedOrigins: aws.StringSlice(origins),
+		AllowedMethods: aws.StringSlice([]string{"GET", "HEAD", "PUT"}),
+		// Presigned uploads send the headers from the upload response, which include
+		// user metadata, so allow anything.
+		AllowedHeaders: aws.StringSlice([]string{"*"}),
+		ExposeHeaders:  aws.StringSlice([]string{"ETag"}),
+	}
+	if maxAge > 0 {
+		rule.MaxAgeSeconds = aws.Int64(int64(maxAge))
+	}
+	return rule
+}
+
+// corsRules returns the CORS rules already on the bucket.
+func (self *secretBucket) corsRules() ([]*s3.CORSRule, error) {
+	out, err := self.svc.GetBucketCors(&s3.GetBucketCorsInput{
+		Bucket: aws.String(self.name),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NoSuchCORSConfiguration" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return out.CORSRules, nil
+}
+
+// mergeCORSRules returns existing with rule added in place of any earlier rule with
+// the same ID.  PutBucketCors replaces every rule on the bucket, so the others have to
+// be sent back with it.
+func mergeCORSRules(existing []*s3.CORSRule, rule *s3.CORSRule) []*s3.CORSRule {
+	merged := make([]*s3.CORSRule, 0, len(existing)+1)
+	for _, other := range existing {
+		if aws.StringValue(other.ID) != aws.StringValue(rule.ID) {
+			merged = append(merged, other)
+		}
+	}
+	return append(merged, rule)
+}
+
+// initBucket applies a CORS rule to each tenant's bucket.  The rule allows the origins
+// in cors.allowed_origins plus any given with --origin, which should include the
+// server's own URL if the web UI is used.
+func initBucket(c *cli.Context) error {
+	config, warnings, err := loadConfig(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	for _, warning := range warnings {
+		fmt.Printf("WARNING: %s\n", warning)
+	}
+
+	origins := make([]string, 0)
+	maxAge := 0
+	if config.CORS != nil {
+		origins = append(origins, config.CORS.AllowedOrigins...)
+		maxAge = config.CORS.MaxAge
+	}
+	for _, origin := range c.StringSlice("origin") {
+		origins = append(origins, strings.TrimRight(origin, "/"))
+	}
+	if len(origins) == 0 {
+		return cli.NewExitError("No origins to allow; set cors.allowed_origins or use --origin https://secretshare.example.com", 1)
+	}
+
+	tenants, err := newTenantSet(config)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	wanted := c.String("tenant")
+	done := 0
+	for _, t := range tenants.tenants {
+		if wanted != "" && t.name != wanted {
+			continue
+		}
+		existing, err := t.bucket.corsRules()
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Failed to read CORS rules on bucket %s (tenant %s): %s", t.bucket.name, t.name, err.Error()), 1)
+		}
+		rules := mergeCORSRules(existing, bucketCORSRule(origins, maxAge))
+		_, err = t.bucket.svc.PutBucketCors(&s3.PutBucketCorsInput{
+			Bucket: aws.String(t.bucket.name),
+			CORSConfiguration: &s3.CORSConfiguration{
+				CORSRules: rules,
+			},
+		})
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("Failed to set CORS rule on bucket %s (tenant %s): %s", t.bucket.name, t.name, err.Error()), 1)
+		}
+		fmt.Printf("Set CORS rule on bucket %s (tenant %s) allowing %s\n", t.bucket.name, t.name, strings.Join(origins, ", "))
+		if len(rules) > 1 {
+			fmt.Printf("Kept %d other CORS rule(s) on bucket %s\n", len(rules)-1, t.bucket.name)
+		}
+		done++
+	}
+	if done == 0 {
+		return cli.NewExitError(fmt.Sprintf("No tenant named %s", wanted), 1)
+	}
+	return nil
+}
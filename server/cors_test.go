@@ -0,0 +1,153 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gin-gonic/gin"
+	. "gopkg.in/check.v1"
+)
+
+type CORSSuite struct {
+	router *gin.Engine
+}
+
+var _ = Suite(&CORSSuite{})
+
+func (s *CORSSuite) SetUpSuite(c *C) {
+	gin.SetMode(gin.TestMode)
+	cors := &corsConfig{
+		AllowedOrigins: []string{"https://portal.example.com"},
+		MaxAge:         600,
+	}
+	s.router = gin.New()
+	s.router.Use(cors.middleware())
+	s.router.POST("/upload", func(c *gin.Context) {
+		c.Header("Secretshare-ReqId", "abc")
+		c.Status(http.StatusOK)
+	})
+}
+
+func (s *CORSSuite) request(method, origin string, headers map[string]string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, "/upload", nil)
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	s.router.ServeHTTP(w, req)
+	return w
+}
+
+func (s *CORSSuite) TestPreflight(c *C) {
+	w := s.request("OPTIONS", "https://portal.example.com", map[string]string{
+		"Access-Control-Request-Method":  "POST",
+		"Access-Control-Request-Headers": "authorization, content-type",
+	})
+	c.Assert(w.Code, Equals, http.StatusNoContent)
+	c.Assert(w.Header().Get("Access-Control-Allow-Origin"), Equals, "https://portal.example.com")
+	c.Assert(w.Header().Get("Access-Control-Allow-Methods"), Equals, "GET, POST")
+	c.Assert(w.Header().Get("Access-Control-Allow-Headers"), Equals, "Authorization, Content-Type")
+	c.Assert(w.Header().Get("Access-Control-Max-Age"), Equals, "600")
+
+	w = s.request("OPTIONS", "https://portal.example.com", map[string]string{
+		"Access-Control-Request-Method": "DELETE",
+	})
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+
+	w = s.request("OPTIONS", "https://evil.example.com", map[string]string{
+		"Access-Control-Request-Method": "POST",
+	})
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+	c.Assert(w.Header().Get("Access-Control-Allow-Origin"), Equals, "")
+}
+
+func (s *CORSSuite) TestSimpleRequest(c *C) {
+	w := s.request("POST", "https://portal.example.com", nil)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Header().Get("Access-Control-Allow-Origin"), Equals, "https://portal.example.com")
+	c.Assert(w.Header().Get("Access-Control-Expose-Headers"), Equals, "Secretshare-ReqId, Retry-After")
+	c.Assert(w.Header().Get("Vary"), Equals, "Origin")
+
+	// Other origins get an answer, but browsers won't show it to the page.
+	w = s.request("POST", "https://evil.example.com", nil)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Header().Get("Access-Control-Allow-Origin"), Equals, "")
+
+	// So do clients that aren't browsers.
+	w = s.request("POST", "", nil)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Header().Get("Vary"), Equals, "")
+}
+
+func (s *CORSSuite) TestValidate(c *C) {
+	c.Assert((&corsConfig{AllowedOrigins: []string{"https://portal.example.com"}}).validate(), HasLen, 0)
+	c.Assert((&corsConfig{}).validate(), DeepEquals, []string{"cors.allowed_origins must be set"})
+	c.Assert((&corsConfig{AllowedOrigins: []string{"portal.example.com"}}).validate(), HasLen, 1)
+	c.Assert((&corsConfig{AllowedOrigins: []string{"https://portal.example.com/app"}}).validate(), HasLen, 1)
+	c.Assert((&corsConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}).validate(), HasLen, 1)
+}
+
+func (s *CORSSuite) TestBucketRule(c *C) {
+	rule := bucketCORSRule([]string{"https://secretshare.example.com"}, 0)
+	c.Assert(aws.StringValueSlice(rule.AllowedOrigins), DeepEquals, []string{"https://secretshare.example.com"})
+	c.Assert(aws.StringValueSlice(rule.AllowedMethods), DeepEquals, []string{"GET", "HEAD", "PUT"})
+	c.Assert(rule.MaxAgeSeconds, IsNil)
+	c.Assert(aws.StringValue(rule.ID), Equals, CORSRuleID)
+}
+
+func (s *CORSSuite) TestMergeRules(c *C) {
+	other := &s3.CORSRule{ID: aws.String("other"), AllowedOrigins: aws.StringSlice([]string{"https://app.example.com"})}
+	unnamed := &s3.CORSRule{AllowedOrigins: aws.StringSlice([]string{"https://app2.example.com"})}
+	old := bucketCORSRule([]string{"https://old.example.com"}, 0)
+	rule := bucketCORSRule([]string{"https://secretshare.example.com"}, 0)
+
+	c.Assert(mergeCORSRules(nil, rule), DeepEquals, []*s3.CORSRule{rule})
+	// Other rules are kept, and an earlier secretshare rule is replaced.
+	merged := mergeCORSRules([]*s3.CORSRule{other, old, unnamed}, rule)
+	c.Assert(merged, DeepEquals, []*s3.CORSRule{other, unnamed, rule})
+}
+
+func (s *CORSSuite) TestExistingRules(c *C) {
+	configured := true
+	bucket, stop := testBucket(func(w http.ResponseWriter, r *http.Request) {
+		if !configured {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchCORSConfiguration</Code><Message>The CORS configuration does not exist</Message></Error>`)
+			return
+		}
+		fmt.Fprint(w, `<CORSConfiguration><CORSRule><ID>other</ID><AllowedOrigin>https://app.example.com</AllowedOrigin><AllowedMethod>GET</AllowedMethod></CORSRule></CORSConfiguration>`)
+	})
+	defer stop()
+
+	rules, err := bucket.corsRules()
+	c.Assert(err, IsNil)
+	c.Assert(rules, HasLen, 1)
+	c.Assert(aws.StringValue(rules[0].ID), Equals, "other")
+
+	configured = false
+	rules, err = bucket.corsRules()
+	c.Assert(err, IsNil)
+	c.Assert(rules, HasLen, 0)
+}
@@ -0,0 +1,130 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+// ReadyCacheTTL is how long the result of a readiness check is reused.  Probes from
+// several load balancers shouldn't turn into a stream of S3 requests.
+var ReadyCacheTTL = 5 * time.Second
+
+// readyProbeKey is the object key used to check that presigning works.  Nothing is
+// ever uploaded to it.
+const readyProbeKey = "readyz-probe"
+
+type readinessCheck struct {
+	name  string
+	check func() error
+}
+
+type checkResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type readinessResponse struct {
+	Status    string                  `json:"status"`
+	CheckedAt time.Time               `json:"checked_at"`
+	Checks    map[string]*checkResult `json:"checks"`
+}
+
+// readiness runs a set of checks and caches the result for ReadyCacheTTL.
+type readiness struct {
+	mutex  sync.Mutex
+	checks []readinessCheck
+	last   *readinessResponse
+}
+
+func newReadiness(checks ...readinessCheck) *readiness {
+	return &readiness{
+		checks: checks,
+	}
+}
+
+// storageChecks returns the checks that the bucket is reachable and that upload URLs
+// can be presigned.
+func storageChecks(svc *s3.S3, bucket string) []readinessCheck {
+	return []readinessCheck{
+		{
+			name: "storage",
+			check: func() error {
+				_, err := svc.HeadBucket(&s3.HeadBucketInput{
+					Bucket: aws.String(bucket),
+				})
+				return err
+			},
+		},
+		{
+			name: "presign",
+			check: func() error {
+				_, _, err := generateSignedURL(svc, bucket, readyProbeKey, "", time.Minute)
+				return err
+			},
+		},
+	}
+}
+
+// status returns the cached result, running the checks again if it is too old.
+func (self *readiness) status(now time.Time) *readinessResponse {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.last != nil && now.Sub(self.last.CheckedAt) < ReadyCacheTTL {
+		return self.last
+	}
+	resp := &readinessResponse{
+		Status:    "ok",
+		CheckedAt: now,
+		Checks:    make(map[string]*checkResult),
+	}
+	for _, rc := range self.checks {
+		result := &checkResult{OK: true}
+		if err := rc.check(); err != nil {
+			result.OK = false
+			result.Error = err.Error()
+			resp.Status = "unavailable"
+		}
+		resp.Checks[rc.name] = result
+	}
+	self.last = resp
+	return resp
+}
+
+func (self *readiness) handleReadyz(c *gin.Context) {
+	resp := self.status(time.Now())
+	if resp.Status != "ok" {
+		logger(c).Warn("Readiness check failed")
+		c.JSON(http.StatusServiceUnavailable, resp)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// handleHealthz only reports that the process is up and serving requests.
+func handleHealthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type ReadinessSuite struct{}
+
+var _ = Suite(&ReadinessSuite{})
+
+func (s *ReadinessSuite) TestChecks(c *C) {
+	calls := 0
+	var storageErr error
+	ready := newReadiness(
+		readinessCheck{name: "storage", check: func() error { calls++; return storageErr }},
+		readinessCheck{name: "presign", check: func() error { return nil }},
+	)
+
+	now := time.Now()
+	resp := ready.status(now)
+	c.Assert(resp.Status, Equals, "ok")
+	c.Assert(resp.Checks["storage"].OK, Equals, true)
+	c.Assert(calls, Equals, 1)
+
+	// The result is cached.
+	storageErr = errors.New("NoSuchBucket")
+	resp = ready.status(now.Add(ReadyCacheTTL / 2))
+	c.Assert(resp.Status, Equals, "ok")
+	c.Assert(calls, Equals, 1)
+
+	// Until it gets too old.
+	resp = ready.status(now.Add(ReadyCacheTTL))
+	c.Assert(calls, Equals, 2)
+	c.Assert(resp.Status, Equals, "unavailable")
+	c.Assert(resp.Checks["storage"].OK, Equals, false)
+	c.Assert(resp.Checks["storage"].Error, Equals, "NoSuchBucket")
+	c.Assert(resp.Checks["presign"].OK, Equals, true)
+}
@@ -0,0 +1,145 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// DefaultShutdownTimeout is how long in-flight requests get to finish after SIGTERM or
+// SIGINT.  It is a little shorter than the default grace period in Kubernetes and
+// OpenShift.
+var DefaultShutdownTimeout = 20 * time.Second
+
+// configReloader applies a new configuration to a running server.
+//
+// Only the pre-shared key, allow_legacy_auth, client_certs, the SSH keys, admin_key,
+// admins, the upload policy (TTLs and rate limits), and each tenant's keys, identities,
+// and limits are reloaded.  Everything else, such as the listen address, buckets, and
+// OIDC settings, needs a restart.
+type configReloader struct {
+	c        *cli.Context
+	auth     *authenticator
+	policies *policyHolder
+	tenants  *tenantSet
+}
+
+func (self *configReloader) reload() error {
+	config, warnings, err := loadConfig(self.c)
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		log.Warn(warning)
+	}
+	if problems := config.validate(); len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	// Otherwise callers could be sent to a tenant whose bucket isn't set up.
+	if !self.tenants.sameAs(config) {
+		return fmt.Errorf("tenant names, buckets, and regions can only be changed by restarting the server")
+	}
+
+	numKeys := 0
+	if self.auth.sshLogin != nil {
+		keys := &sshKeyStore{keys: make(map[string]*identity)}
+		if config.SSHKeysFile != "" {
+			// validate() has already loaded this once, but it could have changed since.
+			keys, err = loadSSHKeys(config.SSHKeysFile)
+			if err != nil {
+				return err
+			}
+		}
+		self.auth.sshLogin.setKeys(keys)
+		numKeys = self.auth.sshLogin.numKeys()
+	} else if config.SSHKeysFile != "" {
+		log.Warn("ssh_keys_file was not set when the server started; restart it to enable SSH key login")
+	}
+	self.auth.update(config)
+
+	policies := newUploadPolicies(config, self.policies.all())
+	self.policies.set(policies)
+	policy := policies[DefaultTenant]
+
+	log.WithFields(log.Fields{
+		"sshKeys":         numKeys,
+		"clientCerts":     len(config.ClientCerts),
+		"defaultTTL":      policy.defaultTTL.String(),
+		"maxTTL":          policy.maxTTL.String(),
+		"maxSize":         policy.maxSize,
+		"uploadRateLimit": config.UploadRateLimit,
+		"tenants":         len(config.Tenants),
+	}).Info("Reloaded configuration")
+	return nil
+}
+
+// serveUntilSignalled runs srv until it gets SIGTERM or SIGINT, then stops accepting
+// connections and waits up to timeout for in-flight requests to finish.  SIGHUP reloads
+// the configuration and, if certs isn't nil, the TLS certificate.
+func serveUntilSignalled(srv *http.Server, certs *certReloader, reloader *configReloader, timeout time.Duration) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if certs != nil {
+			log.Infof("Listening and serving HTTPS on %s", srv.Addr)
+			serveErr <- srv.ListenAndServeTLS("", "")
+		} else {
+			log.Infof("Listening and serving HTTP on %s", srv.Addr)
+			serveErr <- srv.ListenAndServe()
+		}
+	}()
+
+	for {
+		select {
+		case err := <-serveErr:
+			log.Fatal(err.Error())
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				if err := reloader.reload(); err != nil {
+					log.Errorf("Failed to reload configuration; keeping the old one: %s", err.Error())
+				}
+				if certs != nil {
+					certs.reloadAndLog("SIGHUP")
+				}
+				continue
+			}
+
+			log.Infof("Received %s; waiting up to %s for requests to finish", sig, timeout)
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			err := srv.Shutdown(ctx)
+			cancel()
+			if err != nil {
+				log.Errorf("Requests did not finish in time; closing remaining connections: %s", err.Error())
+				srv.Close()
+			}
+			log.Info("Shut down")
+			return
+		}
+	}
+}
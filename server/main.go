@@ -17,20 +17,18 @@ package main
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
-	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 
 	"github.com/urfave/cli"
@@ -48,24 +46,60 @@ var (
 )
 
 type serverConfig struct {
-	ListenAddr         string `json:"addr"`
-	ListenPort         int    `json:"port"`
-	Bucket             string `json:"bucket"`
-	BucketRegion       string `json:"bucket_region"`
-	SecretKey          string `json:"secret_key"`
-	AwsAccessKeyId     string `json:"aws_access_key_id"`
-	AwsSecretAccessKey string `json:"aws_secret_access_key"`
+	ListenAddr         string          `json:"addr"`
+	ListenPort         int             `json:"port"`
+	Bucket             string          `json:"bucket"`
+	BucketRegion       string          `json:"bucket_region"`
+	SecretKey          string          `json:"secret_key"`
+	AllowLegacyAuth    bool            `json:"allow_legacy_auth"`
+	AwsAccessKeyId     string          `json:"aws_access_key_id"`
+	AwsSecretAccessKey string          `json:"aws_secret_access_key"`
+	AssumeRoleArn      string          `json:"assume_role_arn"`
+	AdminKey           string          `json:"admin_key"`
+	Admins             []string        `json:"admins"`
+	DisableWebUI       bool            `json:"disable_web_ui"`
+	CORS               *corsConfig     `json:"cors"`
+	OIDC               *oidcConfig     `json:"oidc"`
+	SSHKeysFile        string          `json:"ssh_keys_file"`
+	SessionTTL         int             `json:"session_ttl"`
+	MetricsAddr        string          `json:"metrics_addr"`
+	MetricsPublic      bool            `json:"metrics_public"`
+	SweepInterval      int             `json:"sweep_interval"`
+	DeleteExpired      bool            `json:"delete_expired"`
+	AuditLog           *auditConfig    `json:"audit_log"`
+	DBFile             string          `json:"db_file"`
+	Tenants            []*tenantConfig `json:"tenants"`
+	DefaultTTL         int             `json:"default_ttl"`
+	MaxTTL             int             `json:"max_ttl"`
+	MaxSize            int64           `json:"max_size"`
+	UploadRateLimit    int             `json:"upload_rate_limit"`
+	UploadRateBurst    int             `json:"upload_rate_burst"`
+	ShutdownTimeout    int             `json:"shutdown_timeout"`
+	TrustedProxies     []string        `json:"trusted_proxies"`
+
+	TLSCertFile      string           `json:"tls_cert_file"`
+	TLSKeyFile       string           `json:"tls_key_file"`
+	TLSMinVersion    string           `json:"tls_min_version"`
+	HTTPRedirectPort int              `json:"http_redirect_port"`
+	ClientCAFile     string           `json:"client_ca_file"`
+	ClientCerts      []clientCertRule `json:"client_certs"`
 }
 
+// generateSignedURL presigns an upload to prefix+id.  The expiry time is recorded in the
+// object's metadata.
 func generateSignedURL(svc *s3.S3, bucket, id, prefix string, ttl time.Duration) (string, http.Header, error) {
 	s3key := prefix + id
 
+	expires := time.Now().Add(ttl)
 	putObjectInput := &s3.PutObjectInput{
 		Bucket:      &bucket,
 		Key:         &s3key,
-		Expires:     aws.Time(time.Now().Add(ttl)),
+		Expires:     aws.Time(expires),
 		ACL:         aws.String("public-read"),
 		ContentType: aws.String("application/octet-stream"),
+		Metadata: map[string]*string{
+			expiresMetadataKey: aws.String(expires.UTC().Format(time.RFC3339)),
+		},
 	}
 	req, _ := svc.PutObjectRequest(putObjectInput)
 	return req.PresignRequest(time.Minute * 5)
@@ -109,120 +143,284 @@ func main() {
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:  "config",
-			Value: "/etc/secretshare-server.json",
-			Usage: "Server configuration file",
+			Value: DefaultConfigPath,
+			Usage: "Server configuration file (JSON, or YAML if it ends in .yaml or .yml)",
+		},
+		cli.StringFlag{
+			Name:  "addr",
+			Usage: "Address to listen on (overrides addr)",
+		},
+		cli.IntFlag{
+			Name:  "port",
+			Usage: "Port to listen on (overrides port)",
+		},
+		cli.StringFlag{
+			Name:  "bucket",
+			Usage: "S3 bucket to store secrets in (overrides bucket)",
+		},
+		cli.StringFlag{
+			Name:  "bucket-region",
+			Usage: "Region of the S3 bucket (overrides bucket_region)",
+		},
+	}
+	app.Commands = []cli.Command{
+		{
+			Name:   "check-config",
+			Usage:  "Validate the configuration and print it with secrets redacted",
+			Action: checkConfig,
+		},
+		{
+			Name:  "init-bucket",
+			Usage: "Set up the CORS rule that browsers need on each tenant's bucket",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "origin",
+					Usage: "Origin to allow besides cors.allowed_origins, such as the server's own URL (may be repeated)",
+				},
+				cli.StringFlag{
+					Name:  "tenant",
+					Usage: "Only set up this tenant's bucket",
+				},
+			},
+			Action: initBucket,
+		},
+		{
+			Name:  "admin",
+			Usage: "Manage the secrets stored by a running server",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "endpoint",
+					Usage: "URL of the server (default: this machine, on the configured port)",
+				},
+			},
+			Subcommands: []cli.Command{
+				{
+					Name:   "list",
+					Usage:  "List stored secrets",
+					Action: adminList,
+				},
+				{
+					Name:      "delete",
+					Usage:     "Delete secrets",
+					ArgsUsage: "OBJECT_ID...",
+					Action:    adminDelete,
+				},
+				{
+					Name:  "purge",
+					Usage: "Delete every secret older than a given age",
+					Flags: []cli.Flag{
+						cli.DurationFlag{
+							Name:  "older-than",
+							Usage: "Minimum age of secrets to delete (e.g. 24h)",
+						},
+					},
+					Action: adminPurge,
+				},
+				{
+					Name:  "backup",
+					Usage: "Save a copy of the server's database",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "output, o",
+							Usage: "File to write the backup to",
+						},
+					},
+					Action: adminBackup,
+				},
+				{
+					Name:  "export",
+					Usage: "Print every record in the server's database as JSON, one per line",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "output, o",
+							Usage: "File to write to instead of standard output",
+						},
+					},
+					Action: adminExport,
+				},
+			},
+		},
+		{
+			Name:  "audit",
+			Usage: "Work with the audit log",
+			Subcommands: []cli.Command{
+				{
+					Name:      "verify",
+					Usage:     "Check that an audit log has not been tampered with",
+					ArgsUsage: "FILENAME",
+					Action:    auditVerify,
+				},
+			},
 		},
 	}
 	app.Run(os.Args)
 }
 
+// newRouter returns the engine for the main listener.  Client addresses are used for
+// rate limits and the audit log, so X-Forwarded-For is only believed when it comes
+// from one of trusted_proxies; gin would otherwise take it from anyone.
+func newRouter(config *serverConfig) (*gin.Engine, error) {
+	r := gin.Default()
+	if err := r.SetTrustedProxies(config.TrustedProxies); err != nil {
+		return nil, err
+	}
+	r.Use(metricsMiddleware)
+	r.Use(reqIdMiddleware)
+	if config.CORS != nil {
+		r.Use(config.CORS.middleware())
+	}
+	return r, nil
+}
+
 func runServer(c *cli.Context) {
-	var config serverConfig
-	{
-		configPath := c.String("config")
-		if len(configPath) == 0 {
-			configPath = DefaultConfigPath
-		}
-		configFile, err := os.Open(configPath)
-		if err != nil {
-			log.Fatalf(`Failed to open config file "%s"`, configPath)
-		}
-		configData, err := ioutil.ReadAll(configFile)
+	config, warnings, err := loadConfig(c)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	for _, warning := range warnings {
+		log.Warn(warning)
+	}
+	if problems := config.validate(); len(problems) > 0 {
+		log.Fatalf("Invalid configuration (run \"secretshare-server check-config\" for details):\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	tenants, err := newTenantSet(config)
+	if err != nil {
+		log.Fatalf("Failed to set up AWS session: %s", err.Error())
+	}
+
+	auth := &authenticator{
+		secretKey:       config.SecretKey,
+		allowLegacyAuth: config.AllowLegacyAuth,
+		nonces:          newNonceCache(SignatureWindow),
+		clientCerts:     config.ClientCerts,
+		adminKey:        config.AdminKey,
+		admins:          config.Admins,
+		tenants:         config.Tenants,
+	}
+	if config.OIDC != nil {
+		verifier, err := newOIDCVerifier(context.Background(), config.OIDC)
 		if err != nil {
-			log.Fatalf(`Failed to read config file "%s"`, configPath)
+			log.Fatalf("Failed to configure OIDC authentication: %s", err.Error())
 		}
-		err = json.Unmarshal(configData, &config)
+		auth.oidc = verifier
+	}
+	if config.SSHKeysFile != "" {
+		keys, err := loadSSHKeys(config.SSHKeysFile)
 		if err != nil {
-			log.Fatalf(`Config file "%s" is not valid JSON`, configPath)
+			log.Fatalf(`Failed to load SSH keys from "%s": %s`, config.SSHKeysFile, err.Error())
 		}
+		auth.sshLogin = newSSHLogin(keys, time.Minute*time.Duration(config.SessionTTL))
+	}
 
-		if len(config.ListenAddr) == 0 {
-			config.ListenAddr = "0.0.0.0"
+	var audit *auditLogger
+	if config.AuditLog != nil {
+		var err error
+		audit, err = newAuditLogger(config.AuditLog)
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %s", err.Error())
 		}
 	}
 
-	sess := session.New(&aws.Config{
-		Region:      aws.String(config.BucketRegion),
-		Credentials: credentials.NewStaticCredentials(config.AwsAccessKeyId, config.AwsSecretAccessKey, ""),
-	})
-	svc := s3.New(sess)
+	store, err := openStore(config)
+	if err != nil {
+		log.Fatalf(`Failed to open database "%s": %s`, config.DBFile, err.Error())
+	}
+	defer store.close()
+	if config.DBFile != "" {
+		go pruneRecords(store)
+	}
 
-	r := gin.Default()
-	r.Use(reqIdMiddleware)
-	r.GET("/version", func(c *gin.Context) {
-		c.JSON(http.StatusOK, &commonlib.ServerVersionResponse{
-			ServerVersion:        commonlib.Version,
-			APIVersion:           commonlib.APIVersion,
-			ServerSourceLocation: commonlib.GetSourceLocation(),
-		})
-	})
-	r.POST("/upload", func(c *gin.Context) {
-		var requestData commonlib.UploadRequest
-		ttl := time.Minute * 60 * 4
-		err := c.BindJSON(&requestData)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, &commonlib.ErrorResponse{
-				Message: err.Error(),
-			})
-			logger(c).Error(err.Error())
-			return
-		}
-		if requestData.SecretKey != config.SecretKey {
-			c.JSON(http.StatusUnauthorized, &commonlib.ErrorResponse{
-				Message: "Incorrect secret key",
-			})
-			logger(c).Error("401: client provided incorrect secret key")
-			return
-		}
-		if requestData.TTL > 0 {
-			ttl = time.Minute * time.Duration(requestData.TTL)
+	// The sweeper needs s3:ListBucket, which older deployments don't grant, so it
+	// only runs if asked to.
+	if config.SweepInterval > 0 {
+		for _, t := range tenants.tenants {
+			sweep := &sweeper{
+				tenant:        t.name,
+				bucket:        t.bucket,
+				interval:      time.Second * time.Duration(config.SweepInterval),
+				deleteExpired: config.DeleteExpired,
+				audit:         audit,
+				store:         store,
+			}
+			go sweep.run()
 		}
+	}
 
-		if requestData.ObjectId == "" {
-			c.JSON(http.StatusBadRequest, &commonlib.ErrorResponse{
-				Message: "No object ID provided in request",
-			})
-			logger(c).Error("No object ID provided in request")
-			return
-		}
-		_, err = commonlib.DecodeForHuman(requestData.ObjectId)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, &commonlib.ErrorResponse{
-				Message: "Malformed object ID provided in request",
-			})
-			logger(c).Errorf("Malformed object ID provided in request: %s\n", err.Error())
-			return
-		}
-		id := requestData.ObjectId
-		logger(c).WithFields(log.Fields{
-			"objectId": id,
-		}).Info("Creating signed URL")
+	r, err := newRouter(config)
+	if err != nil {
+		log.Fatalf("Invalid trusted_proxies: %s", err.Error())
+	}
+	// Metrics say a lot about who uses the server and how, so they're only on the
+	// public listener if that's asked for.
+	if config.MetricsPublic {
+		r.GET("/metrics", metricsHandler)
+	}
+	if config.MetricsAddr != "" {
+		go func() {
+			admin := gin.New()
+			admin.GET("/metrics", metricsHandler)
+			log.Infof("Serving metrics on %s", config.MetricsAddr)
+			err := admin.Run(config.MetricsAddr)
+			log.Fatalf("Metrics listener failed: %s", err.Error())
+		}()
+	}
+	policies := &policyHolder{policies: newUploadPolicies(config, nil)}
+	reloader := &configReloader{
+		c:        c,
+		auth:     auth,
+		policies: policies,
+		tenants:  tenants,
+	}
 
-		putURL, headers, err := generateSignedURL(svc, config.Bucket, id, "", ttl)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, &commonlib.ErrorResponse{
-				Message: err.Error(),
-			})
-			logger(c).Error(err.Error())
-			return
-		}
+	checks := make([]readinessCheck, 0)
+	for _, t := range tenants.tenants {
+		checks = append(checks, t.storageChecks()...)
+	}
+	endpoints := &apiServer{
+		auth:     auth,
+		tenants:  tenants,
+		policies: policies,
+		store:    store,
+		audit:    audit,
+		ready:    newReadiness(checks...),
+	}
+	endpoints.register(r)
+	if !config.DisableWebUI {
+		registerWebUI(r, config)
+	}
 
-		metaPutURL, metaHeaders, err := generateSignedURL(svc, config.Bucket, id, "meta/", ttl)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, &commonlib.ErrorResponse{
-				Message: err.Error(),
-			})
-			logger(c).Error(err.Error())
-			return
-		}
+	shutdownTimeout := DefaultShutdownTimeout
+	if config.ShutdownTimeout > 0 {
+		shutdownTimeout = time.Second * time.Duration(config.ShutdownTimeout)
+	}
+	srv := &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", config.ListenAddr, config.ListenPort),
+		Handler: r,
+	}
+	if !config.tlsEnabled() {
+		serveUntilSignalled(srv, nil, reloader, shutdownTimeout)
+		return
+	}
 
-		c.JSON(http.StatusOK, &commonlib.UploadResponse{
-			PutURL:      putURL,
-			MetaPutURL:  metaPutURL,
-			Headers:     headers,
-			MetaHeaders: metaHeaders,
-		})
-	})
+	certs, err := newCertReloader(config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		log.Fatalf("Failed to load TLS certificate: %s", err.Error())
+	}
+	srv.TLSConfig, err = buildTLSConfig(config, certs)
+	if err != nil {
+		log.Fatalf("Failed to configure TLS: %s", err.Error())
+	}
+	go certs.watch()
+
+	if config.HTTPRedirectPort != 0 {
+		redirectAddr := fmt.Sprintf("%s:%d", config.ListenAddr, config.HTTPRedirectPort)
+		go func() {
+			log.Infof("Redirecting HTTP on %s to HTTPS", redirectAddr)
+			err := http.ListenAndServe(redirectAddr, httpsRedirect(config.ListenPort))
+			log.Fatalf("HTTP redirect listener failed: %s", err.Error())
+		}()
+	}
 
-	r.Run(fmt.Sprintf("%s:%d", config.ListenAddr, config.ListenPort))
+	serveUntilSignalled(srv, certs, reloader, shutdownTimeout)
 }
@@ -0,0 +1,129 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/waucka/secretshare/commonlib"
+)
+
+// Label values must come from small, fixed sets.  Never use object IDs, keys, or
+// anything else supplied by the client as a label.
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "secretshare_http_requests_total",
+		Help: "HTTP requests handled, by route, method, and status code.",
+	}, []string{"route", "method", "status"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "secretshare_http_request_duration_seconds",
+		Help:    "Time taken to handle HTTP requests, by route, method, and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	presignFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "secretshare_presign_failures_total",
+		Help: "Failures to generate a pre-signed upload URL, by object kind (data or meta).",
+	}, []string{"kind"})
+
+	authFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "secretshare_auth_failures_total",
+		Help: "Failed authentication attempts, by reason.",
+	}, []string{"reason"})
+
+	uploadDeclaredBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "secretshare_upload_declared_bytes_total",
+		Help: "Sum of the file sizes declared by clients requesting uploads.",
+	})
+
+	activeSecrets = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "secretshare_active_secrets",
+		Help: "Secrets in each tenant's bucket as of the last sweep.",
+	}, []string{"tenant"})
+
+	reaperDeletions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "secretshare_reaper_deletions_total",
+		Help: "Expired secrets deleted by the sweeper.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		requestsTotal,
+		requestDuration,
+		presignFailures,
+		authFailures,
+		uploadDeclaredBytes,
+		activeSecrets,
+		reaperDeletions,
+	)
+}
+
+// gin middleware that records request counts and latencies.
+//
+// The route label is the pattern the request matched (e.g. "/upload"), not the path,
+// so it can't be used to smuggle object IDs into the metrics.
+func metricsMiddleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	status := strconv.Itoa(c.Writer.Status())
+	requestsTotal.WithLabelValues(route, c.Request.Method, status).Inc()
+	requestDuration.WithLabelValues(route, c.Request.Method, status).Observe(time.Since(start).Seconds())
+}
+
+// authFailureReason maps an authentication error to a metric label.
+func authFailureReason(err error) string {
+	switch err {
+	case ErrNoCredentials:
+		return "no_credentials"
+	case ErrBadSecretKey:
+		return "bad_secret_key"
+	case ErrLegacyAuth:
+		return "legacy_auth_disabled"
+	case ErrStaleSignature:
+		return "stale_signature"
+	case ErrReplayedNonce:
+		return "replayed_nonce"
+	case commonlib.BadSignatureError, commonlib.MalformedSignatureError:
+		return "bad_signature"
+	case ErrCertNotAllowed:
+		return "cert_not_allowed"
+	case ErrBadSessionToken, ErrSSHLoginDisabled:
+		return "bad_session"
+	case ErrMissingGroup:
+		return "missing_group"
+	case ErrBearerNotConfig:
+		return "bearer_not_configured"
+	default:
+		// Anything else came from verifying an OIDC token.
+		return "bad_token"
+	}
+}
+
+// metricsHandler serves the Prometheus metrics.
+var metricsHandler = gin.WrapH(promhttp.Handler())
@@ -0,0 +1,72 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "gopkg.in/check.v1"
+
+	"github.com/waucka/secretshare/commonlib"
+)
+
+type MetricsSuite struct{}
+
+var _ = Suite(&MetricsSuite{})
+
+func (s *MetricsSuite) TestMiddleware(c *C) {
+	r := gin.New()
+	r.Use(metricsMiddleware)
+	r.GET("/secrets/:id/location", func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+	located := requestsTotal.WithLabelValues("/secrets/:id/location", "GET", "204")
+	unmatched := requestsTotal.WithLabelValues("unmatched", "GET", "404")
+	before, beforeUnmatched := testutil.ToFloat64(located), testutil.ToFloat64(unmatched)
+
+	// Requests are counted by route, not by path, so object IDs stay out of labels.
+	for _, path := range []string{"/secrets/abc/location", "/secrets/def/location", "/nowhere"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	c.Assert(testutil.ToFloat64(located), Equals, before+2)
+	c.Assert(testutil.ToFloat64(unmatched), Equals, beforeUnmatched+1)
+	c.Assert(testutil.CollectAndCount(requestsTotal, "secretshare_http_requests_total") > 0, Equals, true)
+}
+
+func (s *MetricsSuite) TestAuthFailureReason(c *C) {
+	for err, reason := range map[error]string{
+		ErrNoCredentials:                     "no_credentials",
+		ErrBadSecretKey:                      "bad_secret_key",
+		ErrLegacyAuth:                        "legacy_auth_disabled",
+		ErrStaleSignature:                    "stale_signature",
+		ErrReplayedNonce:                     "replayed_nonce",
+		commonlib.BadSignatureError:          "bad_signature",
+		commonlib.MalformedSignatureError:    "bad_signature",
+		ErrCertNotAllowed:                    "cert_not_allowed",
+		ErrBadSessionToken:                   "bad_session",
+		ErrSSHLoginDisabled:                  "bad_session",
+		ErrMissingGroup:                      "missing_group",
+		ErrBearerNotConfig:                   "bearer_not_configured",
+		errors.New("oidc: token is expired"): "bad_token",
+	} {
+		c.Check(authFailureReason(err), Equals, reason, Commentf("%s", err))
+	}
+}
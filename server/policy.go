@@ -0,0 +1,249 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/waucka/secretshare/commonlib"
+)
+
+var (
+	ErrRateLimited     = errors.New("Too many uploads; try again later")
+	ErrTooManyRequests = errors.New("Too many requests; try again later")
+
+	// DefaultTTL is used when neither the client nor default_ttl specifies a TTL.
+	DefaultTTL = 4 * time.Hour
+)
+
+// Limits on requests that don't need authentication, per client address.
+const (
+	// PublicRateLimit is how many requests a minute each address may make.
+	PublicRateLimit = 60
+	// PublicRateBurst is how many requests each address may make at once.
+	PublicRateBurst = 20
+)
+
+// uploadPolicy holds the limits applied to upload requests.  A new one is built each
+// time the configuration is reloaded.
+type uploadPolicy struct {
+	defaultTTL time.Duration
+	// maxTTL is the longest TTL a client may ask for; zero means no limit.
+	maxTTL time.Duration
+	// maxSize is the largest file, in bytes, a client may declare; zero means no limit.
+	maxSize int64
+	// limiter is nil if uploads are not rate-limited.
+	limiter *rateLimiter
+}
+
+func newUploadPolicy(config *serverConfig) *uploadPolicy {
+	policy := &uploadPolicy{
+		defaultTTL: DefaultTTL,
+		maxTTL:     time.Minute * time.Duration(config.MaxTTL),
+		maxSize:    config.MaxSize,
+	}
+	if config.DefaultTTL > 0 {
+		policy.defaultTTL = time.Minute * time.Duration(config.DefaultTTL)
+	}
+	if policy.maxTTL > 0 && policy.defaultTTL > policy.maxTTL {
+		policy.defaultTTL = policy.maxTTL
+	}
+	if config.UploadRateLimit > 0 {
+		policy.limiter = newRateLimiter(float64(config.UploadRateLimit)/60, config.UploadRateBurst)
+	}
+	return policy
+}
+
+// publicRateLimit is gin middleware that limits each client address to
+// PublicRateLimit requests a minute across the routes it is used on.
+func publicRateLimit() gin.HandlerFunc {
+	limiter := newRateLimiter(float64(PublicRateLimit)/60, PublicRateBurst)
+	return func(c *gin.Context) {
+		if ok, wait := limiter.allow(c.ClientIP(), time.Now()); !ok {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, &commonlib.ErrorResponse{
+				Code:    commonlib.CodeRateLimited,
+				Message: ErrTooManyRequests.Error(),
+			})
+			logger(c).Warn("429: request rate limit exceeded")
+		}
+	}
+}
+
+// rateLimitKey returns the key caller's uploads are counted under.  Everyone using a
+// pre-shared key has the same name, so they are told apart by address instead.
+func rateLimitKey(caller *identity, clientIP string) string {
+	switch caller.Method {
+	case commonlib.AuthSignature, commonlib.AuthLegacySecretKey:
+		return caller.Name + "@" + clientIP
+	}
+	return caller.Name
+}
+
+// ttl returns the TTL to use for an upload, given the TTL the client asked for in
+// minutes.
+func (self *uploadPolicy) ttl(requestedMinutes int) (time.Duration, error) {
+	if requestedMinutes <= 0 {
+		return self.defaultTTL, nil
+	}
+	ttl := time.Minute * time.Duration(requestedMinutes)
+	if self.maxTTL > 0 && ttl > self.maxTTL {
+		return 0, fmt.Errorf("TTL of %d minutes is longer than this server allows (%d minutes)", requestedMinutes, int(self.maxTTL/time.Minute))
+	}
+	return ttl, nil
+}
+
+// checkSize returns an error if the client declared a file larger than max_size.
+//
+// The size is whatever the client says it is; S3 does not check it against the upload.
+func (self *uploadPolicy) checkSize(size int64) error {
+	if self.maxSize > 0 && size > self.maxSize {
+		return fmt.Errorf("File of %d bytes is larger than this server allows (%d bytes)", size, self.maxSize)
+	}
+	return nil
+}
+
+// allow reports whether the caller with the given rateLimitKey may upload now and, if
+// not, how long it should wait.
+func (self *uploadPolicy) allow(key string) (bool, time.Duration) {
+	if self.limiter == nil {
+		return true, 0
+	}
+	return self.limiter.allow(key, time.Now())
+}
+
+// newUploadPolicies builds the upload policy for each tenant.  Rate limiters are
+// carried over from previous, which may be nil, so a reload doesn't hand everyone a
+// fresh burst.
+func newUploadPolicies(config *serverConfig, previous map[string]*uploadPolicy) map[string]*uploadPolicy {
+	policies := make(map[string]*uploadPolicy)
+	for name, tenantConfig := range config.tenantConfigs() {
+		policy := newUploadPolicy(tenantConfig)
+		if old := previous[name]; old != nil && old.limiter != nil && policy.limiter != nil {
+			old.limiter.setRate(float64(tenantConfig.UploadRateLimit)/60, tenantConfig.UploadRateBurst)
+			policy.limiter = old.limiter
+		}
+		policies[name] = policy
+	}
+	return policies
+}
+
+// policyHolder holds the current uploadPolicy for each tenant.
+type policyHolder struct {
+	mutex    sync.RWMutex
+	policies map[string]*uploadPolicy
+}
+
+// all returns every tenant's policy.
+func (self *policyHolder) all() map[string]*uploadPolicy {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return self.policies
+}
+
+// current returns the named tenant's policy.
+func (self *policyHolder) current(tenant string) *uploadPolicy {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return self.policies[tenant]
+}
+
+func (self *policyHolder) set(policies map[string]*uploadPolicy) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.policies = policies
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimiter keeps a token bucket for each caller.  Buckets that have filled back up
+// are forgotten.
+type rateLimiter struct {
+	mutex   sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	// pruned is when full buckets were last forgotten.
+	pruned time.Time
+}
+
+// newRateLimiter allows each caller rate requests per second, with bursts of up to
+// burst requests.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	limiter := &rateLimiter{buckets: make(map[string]*tokenBucket)}
+	limiter.setRate(rate, burst)
+	return limiter
+}
+
+// setRate changes the rate and burst without forgetting anyone's bucket, so that
+// reloading the configuration doesn't reset the limits.
+func (self *rateLimiter) setRate(rate float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.rate = rate
+	self.burst = float64(burst)
+}
+
+// refill adds the tokens bucket has earned since it was last updated.
+func (self *rateLimiter) refill(bucket *tokenBucket, now time.Time) {
+	if now.After(bucket.updated) {
+		bucket.tokens = math.Min(self.burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*self.rate)
+		bucket.updated = now
+	}
+}
+
+func (self *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	// An empty bucket takes burst/rate seconds to fill, so there is no point looking
+	// for full ones more often than that.
+	if now.Sub(self.pruned).Seconds()*self.rate >= self.burst {
+		for k, bucket := range self.buckets {
+			self.refill(bucket, now)
+			if bucket.tokens >= self.burst {
+				delete(self.buckets, k)
+			}
+		}
+		self.pruned = now
+	}
+	bucket, ok := self.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: self.burst, updated: now}
+		self.buckets[key] = bucket
+	}
+	self.refill(bucket, now)
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / self.rate * float64(time.Second))
+		return false, wait
+	}
+	bucket.tokens--
+	return true, 0
+}
@@ -0,0 +1,149 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "gopkg.in/check.v1"
+
+	"github.com/waucka/secretshare/commonlib"
+)
+
+type PolicySuite struct{}
+
+var _ = Suite(&PolicySuite{})
+
+func (s *PolicySuite) TestTTL(c *C) {
+	policy := newUploadPolicy(&serverConfig{})
+	ttl, err := policy.ttl(0)
+	c.Assert(err, IsNil)
+	c.Assert(ttl, Equals, DefaultTTL)
+	ttl, err = policy.ttl(60 * 24 * 365)
+	c.Assert(err, IsNil)
+	c.Assert(ttl, Equals, 365*24*time.Hour)
+
+	policy = newUploadPolicy(&serverConfig{DefaultTTL: 30, MaxTTL: 60})
+	ttl, err = policy.ttl(0)
+	c.Assert(err, IsNil)
+	c.Assert(ttl, Equals, 30*time.Minute)
+	ttl, err = policy.ttl(60)
+	c.Assert(err, IsNil)
+	c.Assert(ttl, Equals, time.Hour)
+	_, err = policy.ttl(61)
+	c.Assert(err, ErrorMatches, "TTL of 61 minutes is longer than this server allows \\(60 minutes\\)")
+
+	// The default TTL never exceeds the maximum.
+	policy = newUploadPolicy(&serverConfig{MaxTTL: 60})
+	ttl, err = policy.ttl(0)
+	c.Assert(err, IsNil)
+	c.Assert(ttl, Equals, time.Hour)
+}
+
+func (s *PolicySuite) TestSize(c *C) {
+	c.Assert(newUploadPolicy(&serverConfig{}).checkSize(1<<40), IsNil)
+	policy := newUploadPolicy(&serverConfig{MaxSize: 1024})
+	c.Assert(policy.checkSize(1024), IsNil)
+	c.Assert(policy.checkSize(1025), ErrorMatches, "File of 1025 bytes is larger than this server allows \\(1024 bytes\\)")
+}
+
+func (s *PolicySuite) TestRateLimiter(c *C) {
+	// One request per second, bursts of two.
+	limiter := newRateLimiter(1, 2)
+	now := time.Now()
+
+	ok, _ := limiter.allow("alice", now)
+	c.Assert(ok, Equals, true)
+	ok, _ = limiter.allow("alice", now)
+	c.Assert(ok, Equals, true)
+	ok, wait := limiter.allow("alice", now)
+	c.Assert(ok, Equals, false)
+	c.Assert(wait, Equals, time.Second)
+
+	// Other callers have their own buckets.
+	ok, _ = limiter.allow("bob", now)
+	c.Assert(ok, Equals, true)
+
+	ok, _ = limiter.allow("alice", now.Add(time.Second))
+	c.Assert(ok, Equals, true)
+
+	// Full buckets are forgotten.
+	limiter.allow("alice", now.Add(time.Hour))
+	c.Assert(limiter.buckets, HasLen, 1)
+}
+
+func (s *PolicySuite) TestRateLimitKey(c *C) {
+	c.Assert(rateLimitKey(&identity{Name: "secret_key", Method: commonlib.AuthSignature}, "10.0.0.1"), Equals, "secret_key@10.0.0.1")
+	c.Assert(rateLimitKey(&identity{Name: "secret_key", Method: commonlib.AuthLegacySecretKey}, "10.0.0.2"), Equals, "secret_key@10.0.0.2")
+	c.Assert(rateLimitKey(&identity{Name: "alice", Method: commonlib.AuthOIDC}, "10.0.0.1"), Equals, "alice")
+}
+
+func (s *PolicySuite) TestReloadKeepsLimits(c *C) {
+	config := &serverConfig{UploadRateLimit: 1, UploadRateBurst: 1}
+	policies := newUploadPolicies(config, nil)
+	ok, _ := policies[DefaultTenant].allow("alice")
+	c.Assert(ok, Equals, true)
+
+	config = &serverConfig{UploadRateLimit: 2, UploadRateBurst: 1}
+	reloaded := newUploadPolicies(config, policies)
+	c.Assert(reloaded[DefaultTenant].limiter, Equals, policies[DefaultTenant].limiter)
+	c.Assert(reloaded[DefaultTenant].limiter.rate, Equals, 2.0/60)
+	ok, _ = reloaded[DefaultTenant].allow("alice")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *PolicySuite) TestPublicRateLimit(c *C) {
+	r := gin.New()
+	r.GET("/", publicRateLimit(), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	get := func(addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	for i := 0; i < PublicRateBurst; i++ {
+		c.Assert(get("192.0.2.1:1234").Code, Equals, http.StatusNoContent)
+	}
+	w := get("192.0.2.1:1234")
+	c.Assert(w.Code, Equals, http.StatusTooManyRequests)
+	c.Assert(w.Header().Get("Retry-After"), Equals, "1")
+	c.Assert(get("192.0.2.2:1234").Code, Equals, http.StatusNoContent)
+}
+
+func (s *PolicySuite) TestForwardedFor(c *C) {
+	gin.SetMode(gin.TestMode)
+	caller := &identity{Name: "secret_key", Method: commonlib.AuthSignature}
+	keyFor := func(config *serverConfig) string {
+		r, err := newRouter(config)
+		c.Assert(err, IsNil)
+		var key string
+		r.GET("/", func(c *gin.Context) { key = rateLimitKey(caller, c.ClientIP()) })
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "203.0.113.9:1234"
+		req.Header.Set("X-Forwarded-For", "1.2.3.4")
+		r.ServeHTTP(httptest.NewRecorder(), req)
+		return key
+	}
+	// A client can't pick its own address...
+	c.Assert(keyFor(&serverConfig{}), Equals, "secret_key@203.0.113.9")
+	// ...but a trusted proxy can pass it on.
+	c.Assert(keyFor(&serverConfig{TrustedProxies: []string{"203.0.113.0/24"}}), Equals, "secret_key@1.2.3.4")
+}
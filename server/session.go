@@ -0,0 +1,335 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/waucka/secretshare/commonlib"
+)
+
+var (
+	ErrUnknownSSHKey    = errors.New("SSH key is not registered with this server")
+	ErrBadChallenge     = errors.New("Login challenge is unknown or has expired")
+	ErrBadSSHSignature  = errors.New("Login challenge signature does not match")
+	ErrBadSessionToken  = errors.New("Session token is unknown or has expired")
+	ErrSSHLoginDisabled = errors.New("SSH key login is not enabled on this server")
+	ErrTooManyLogins    = errors.New("Too many logins in progress; try again later")
+
+	ChallengeTTL      = 2 * time.Minute
+	MaxChallenges     = 10000
+	DefaultSessionTTL = 60 * time.Minute
+)
+
+// sshKeyStore holds the SSH public keys that may log in, keyed by their wire encoding.
+type sshKeyStore struct {
+	keys map[string]*identity
+}
+
+// loadSSHKeys reads an authorized_keys-style file.  The comment on each key is used as
+// the identity of whoever holds it, so it should be something like an email address.
+func loadSSHKeys(path string) (*sshKeyStore, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	store := &sshKeyStore{keys: make(map[string]*identity)}
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		pubKey, comment, _, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, lineNum, err.Error())
+		}
+		name := comment
+		if name == "" {
+			name = ssh.FingerprintSHA256(pubKey)
+		}
+		store.keys[string(pubKey.Marshal())] = &identity{
+			Name:   name,
+			Method: commonlib.AuthSSHKey,
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (self *sshKeyStore) lookup(pubKey ssh.PublicKey) (*identity, bool) {
+	caller, ok := self.keys[string(pubKey.Marshal())]
+	return caller, ok
+}
+
+type challenge struct {
+	data    []byte
+	pubKey  ssh.PublicKey
+	caller  *identity
+	expires time.Time
+}
+
+type loginSession struct {
+	caller  *identity
+	key     string
+	expires time.Time
+}
+
+// sshLogin hands out login challenges and session tokens.  Both are kept in memory, so
+// restarting the server logs everyone out.
+type sshLogin struct {
+	mutex      sync.Mutex
+	keys       *sshKeyStore
+	sessionTTL time.Duration
+	challenges map[string]*challenge
+	sessions   map[string]*loginSession
+}
+
+func newSSHLogin(keys *sshKeyStore, sessionTTL time.Duration) *sshLogin {
+	if sessionTTL <= 0 {
+		sessionTTL = DefaultSessionTTL
+	}
+	return &sshLogin{
+		keys:       keys,
+		sessionTTL: sessionTTL,
+		challenges: make(map[string]*challenge),
+		sessions:   make(map[string]*loginSession),
+	}
+}
+
+func randomHex(numBytes int) (string, error) {
+	b := make([]byte, numBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// expire forgets old challenges and sessions.  The caller must hold the mutex.
+func (self *sshLogin) expire(now time.Time) {
+	for id, ch := range self.challenges {
+		if now.After(ch.expires) {
+			delete(self.challenges, id)
+		}
+	}
+	for token, sess := range self.sessions {
+		if now.After(sess.expires) {
+			delete(self.sessions, token)
+		}
+	}
+}
+
+// setKeys replaces the registered keys.  Sessions started with a key that is no longer
+// registered are ended.
+func (self *sshLogin) setKeys(keys *sshKeyStore) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.keys = keys
+	for token, sess := range self.sessions {
+		if _, ok := keys.keys[sess.key]; !ok {
+			delete(self.sessions, token)
+		}
+	}
+}
+
+// numKeys returns the number of registered keys.
+func (self *sshLogin) numKeys() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return len(self.keys.keys)
+}
+
+// newChallenge creates a challenge for a public key.  Keys that aren't registered get
+// one too, so that callers can't find out which keys are; answering it fails.
+func (self *sshLogin) newChallenge(pubKey ssh.PublicKey) (string, []byte, error) {
+	self.mutex.Lock()
+	caller, _ := self.keys.lookup(pubKey)
+	self.mutex.Unlock()
+	id, err := randomHex(16)
+	if err != nil {
+		return "", nil, err
+	}
+	data := make([]byte, 32)
+	if _, err = rand.Read(data); err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.expire(now)
+	if len(self.challenges) >= MaxChallenges {
+		return "", nil, ErrTooManyLogins
+	}
+	self.challenges[id] = &challenge{
+		data:    data,
+		pubKey:  pubKey,
+		caller:  caller,
+		expires: now.Add(ChallengeTTL),
+	}
+	return id, data, nil
+}
+
+// answer checks the signature on a challenge and, if it's good, starts a session.
+// Each challenge can only be answered once, whether or not the answer is right.
+func (self *sshLogin) answer(challengeId string, sig *ssh.Signature) (string, *loginSession, error) {
+	now := time.Now()
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.expire(now)
+
+	ch, ok := self.challenges[challengeId]
+	if !ok {
+		return "", nil, ErrBadChallenge
+	}
+	delete(self.challenges, challengeId)
+
+	if err := ch.pubKey.Verify(commonlib.SSHLoginSignedData(ch.data), sig); err != nil {
+		return "", nil, ErrBadSSHSignature
+	}
+	if ch.caller == nil {
+		return "", nil, ErrUnknownSSHKey
+	}
+
+	suffix, err := randomHex(32)
+	if err != nil {
+		return "", nil, err
+	}
+	token := commonlib.SessionTokenPrefix + suffix
+	sess := &loginSession{
+		caller:  ch.caller,
+		key:     string(ch.pubKey.Marshal()),
+		expires: now.Add(self.sessionTTL),
+	}
+	self.sessions[token] = sess
+	return token, sess, nil
+}
+
+// verifySession returns the identity behind a session token.
+func (self *sshLogin) verifySession(token string) (*identity, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	sess, ok := self.sessions[token]
+	if !ok || time.Now().After(sess.expires) {
+		return nil, ErrBadSessionToken
+	}
+	return sess.caller, nil
+}
+
+func (self *sshLogin) handleChallenge(c *gin.Context) {
+	var requestData commonlib.LoginChallengeRequest
+	if err := c.BindJSON(&requestData); err != nil {
+		logger(c).Error(err.Error())
+		return
+	}
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(requestData.PublicKey))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeBadRequest,
+			Message: "Malformed public key",
+		})
+		logger(c).Errorf("Malformed public key in login challenge request: %s", err.Error())
+		return
+	}
+	id, data, err := self.newChallenge(pubKey)
+	if err == ErrTooManyLogins {
+		c.JSON(http.StatusServiceUnavailable, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeRateLimited,
+			Message: err.Error(),
+		})
+		logger(c).Error("503: too many SSH login challenges outstanding")
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeInternal,
+			Message: err.Error(),
+		})
+		logger(c).Error(err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, &commonlib.LoginChallengeResponse{
+		ChallengeId: id,
+		Challenge:   data,
+	})
+}
+
+func (self *sshLogin) handleLogin(c *gin.Context) {
+	var requestData commonlib.LoginRequest
+	if err := c.BindJSON(&requestData); err != nil {
+		logger(c).Error(err.Error())
+		return
+	}
+	token, sess, err := self.answer(requestData.ChallengeId, &ssh.Signature{
+		Format: requestData.SignatureFormat,
+		Blob:   requestData.Signature,
+	})
+	if err == ErrBadChallenge || err == ErrBadSSHSignature || err == ErrUnknownSSHKey {
+		// An unregistered key looks like a bad signature, so that callers can't
+		// find out which keys are registered.
+		message := err.Error()
+		if err == ErrUnknownSSHKey {
+			message = ErrBadSSHSignature.Error()
+		}
+		c.JSON(http.StatusUnauthorized, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeAuthFailed,
+			Message: message,
+		})
+		logger(c).Errorf("401: SSH login failed: %s", err.Error())
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, &commonlib.ErrorResponse{
+			Code:    commonlib.CodeInternal,
+			Message: err.Error(),
+		})
+		logger(c).Error(err.Error())
+		return
+	}
+	logger(c).WithFields(log.Fields{
+		"caller": sess.caller.Name,
+	}).Info("SSH login succeeded")
+	c.JSON(http.StatusOK, &commonlib.LoginResponse{
+		Token:   token,
+		Expires: sess.expires,
+	})
+}
+
+// isSessionToken reports whether a bearer token was issued by sshLogin.
+func isSessionToken(token string) bool {
+	return strings.HasPrefix(token, commonlib.SessionTokenPrefix)
+}
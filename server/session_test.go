@@ -0,0 +1,211 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/ssh"
+	. "gopkg.in/check.v1"
+
+	"github.com/waucka/secretshare/commonlib"
+)
+
+type SSHLoginSuite struct {
+	signer   ssh.Signer
+	stranger ssh.Signer
+	login    *sshLogin
+}
+
+var _ = Suite(&SSHLoginSuite{})
+
+func newTestSigner(c *C) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, IsNil)
+	signer, err := ssh.NewSignerFromKey(priv)
+	c.Assert(err, IsNil)
+	return signer
+}
+
+func (s *SSHLoginSuite) SetUpTest(c *C) {
+	s.signer = newTestSigner(c)
+	s.stranger = newTestSigner(c)
+
+	keysPath := filepath.Join(c.MkDir(), "authorized_keys")
+	keyLine := ssh.MarshalAuthorizedKey(s.signer.PublicKey())
+	keyLine = append(keyLine[:len(keyLine)-1], []byte(" alice@example.com\n")...)
+	err := ioutil.WriteFile(keysPath, append([]byte("# registered users\n"), keyLine...), os.FileMode(0600))
+	c.Assert(err, IsNil)
+
+	keys, err := loadSSHKeys(keysPath)
+	c.Assert(err, IsNil)
+	s.login = newSSHLogin(keys, 0)
+}
+
+func (s *SSHLoginSuite) TestLogin(c *C) {
+	id, data, err := s.login.newChallenge(s.signer.PublicKey())
+	c.Assert(err, IsNil)
+	sig, err := s.signer.Sign(rand.Reader, commonlib.SSHLoginSignedData(data))
+	c.Assert(err, IsNil)
+
+	token, _, err := s.login.answer(id, sig)
+	c.Assert(err, IsNil)
+	c.Assert(isSessionToken(token), Equals, true)
+
+	caller, err := s.login.verifySession(token)
+	c.Assert(err, IsNil)
+	c.Assert(caller.Name, Equals, "alice@example.com")
+	c.Assert(caller.Method, Equals, "ssh_key")
+
+	// Challenges can only be answered once.
+	_, _, err = s.login.answer(id, sig)
+	c.Assert(err, Equals, ErrBadChallenge)
+}
+
+func (s *SSHLoginSuite) TestUnknownKey(c *C) {
+	// Unregistered keys get a challenge like any other, but can't answer it.
+	id, data, err := s.login.newChallenge(s.stranger.PublicKey())
+	c.Assert(err, IsNil)
+	sig, err := s.stranger.Sign(rand.Reader, commonlib.SSHLoginSignedData(data))
+	c.Assert(err, IsNil)
+	_, _, err = s.login.answer(id, sig)
+	c.Assert(err, Equals, ErrUnknownSSHKey)
+}
+
+func (s *SSHLoginSuite) TestWrongSigner(c *C) {
+	id, data, err := s.login.newChallenge(s.signer.PublicKey())
+	c.Assert(err, IsNil)
+	sig, err := s.stranger.Sign(rand.Reader, commonlib.SSHLoginSignedData(data))
+	c.Assert(err, IsNil)
+	_, _, err = s.login.answer(id, sig)
+	c.Assert(err, Equals, ErrBadSSHSignature)
+}
+
+func (s *SSHLoginSuite) TestBadSession(c *C) {
+	_, err := s.login.verifySession(commonlib.SessionTokenPrefix + "bogus")
+	c.Assert(err, Equals, ErrBadSessionToken)
+}
+
+func (s *SSHLoginSuite) TestKeyRemoved(c *C) {
+	id, data, err := s.login.newChallenge(s.signer.PublicKey())
+	c.Assert(err, IsNil)
+	sig, err := s.signer.Sign(rand.Reader, commonlib.SSHLoginSignedData(data))
+	c.Assert(err, IsNil)
+	token, _, err := s.login.answer(id, sig)
+	c.Assert(err, IsNil)
+
+	// Removing the key ends its sessions.
+	s.login.setKeys(&sshKeyStore{keys: make(map[string]*identity)})
+	_, err = s.login.verifySession(token)
+	c.Assert(err, Equals, ErrBadSessionToken)
+	id, data, err = s.login.newChallenge(s.signer.PublicKey())
+	c.Assert(err, IsNil)
+	sig, err = s.signer.Sign(rand.Reader, commonlib.SSHLoginSignedData(data))
+	c.Assert(err, IsNil)
+	_, _, err = s.login.answer(id, sig)
+	c.Assert(err, Equals, ErrUnknownSSHKey)
+}
+
+// loginOverHTTP logs in with signer through the handlers, returning the status and
+// error from the last step.
+func (s *SSHLoginSuite) loginOverHTTP(c *C, signer ssh.Signer) (int, *commonlib.ErrorResponse) {
+	r := gin.New()
+	r.POST("/login/challenge", s.login.handleChallenge)
+	r.POST("/login", s.login.handleLogin)
+	post := func(path string, request interface{}) *httptest.ResponseRecorder {
+		body, err := json.Marshal(request)
+		c.Assert(err, IsNil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", path, bytes.NewReader(body)))
+		return w
+	}
+
+	w := post("/login/challenge", &commonlib.LoginChallengeRequest{
+		PublicKey: string(ssh.MarshalAuthorizedKey(signer.PublicKey())),
+	})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	var challenge commonlib.LoginChallengeResponse
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &challenge), IsNil)
+	sig, err := signer.Sign(rand.Reader, commonlib.SSHLoginSignedData(challenge.Challenge))
+	c.Assert(err, IsNil)
+	w = post("/login", &commonlib.LoginRequest{
+		ChallengeId:     challenge.ChallengeId,
+		SignatureFormat: sig.Format,
+		Signature:       sig.Blob,
+	})
+	var errResp commonlib.ErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &errResp)
+	return w.Code, &errResp
+}
+
+func (s *SSHLoginSuite) TestHandlersHideUnknownKeys(c *C) {
+	status, _ := s.loginOverHTTP(c, s.signer)
+	c.Assert(status, Equals, http.StatusOK)
+
+	// An unregistered key fails the same way as a bad signature.
+	status, errResp := s.loginOverHTTP(c, s.stranger)
+	c.Assert(status, Equals, http.StatusUnauthorized)
+	c.Assert(errResp.Message, Equals, ErrBadSSHSignature.Error())
+}
+
+func (s *SSHLoginSuite) TestChallengeRateLimit(c *C) {
+	endpoints := &apiServer{
+		auth:     &authenticator{sshLogin: s.login, nonces: newNonceCache(SignatureWindow)},
+		policies: &policyHolder{},
+		store:    nullStore{},
+		ready:    newReadiness(),
+	}
+	r := gin.New()
+	endpoints.register(r)
+	body, err := json.Marshal(&commonlib.LoginChallengeRequest{
+		PublicKey: string(ssh.MarshalAuthorizedKey(s.stranger.PublicKey())),
+	})
+	c.Assert(err, IsNil)
+	post := func() int {
+		req := httptest.NewRequest("POST", "/login/challenge", bytes.NewReader(body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	// One address can't fill the table of challenges.
+	for i := 0; i < PublicRateBurst; i++ {
+		c.Assert(post(), Equals, http.StatusOK)
+	}
+	c.Assert(post(), Equals, http.StatusTooManyRequests)
+	c.Assert(s.login.challenges, HasLen, PublicRateBurst)
+}
+
+func (s *SSHLoginSuite) TestTooManyChallenges(c *C) {
+	defer func(max int) { MaxChallenges = max }(MaxChallenges)
+	MaxChallenges = 2
+	for i := 0; i < 2; i++ {
+		_, _, err := s.login.newChallenge(s.stranger.PublicKey())
+		c.Assert(err, IsNil)
+	}
+	_, _, err := s.login.newChallenge(s.stranger.PublicKey())
+	c.Assert(err, Equals, ErrTooManyLogins)
+}
@@ -0,0 +1,191 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+
+	"github.com/waucka/secretshare/commonlib"
+)
+
+var (
+	ErrNoSuchRecord = errors.New("No record of that secret")
+	ErrNoDatabase   = errors.New("No database is configured; set db_file")
+	ErrSchemaTooNew = errors.New("The database was written by a newer secretshare-server")
+	// ErrReportIgnored means a retrieval report wasn't recorded because it couldn't
+	// have been a real one or adds nothing to what is already known.
+	ErrReportIgnored = errors.New("Retrieval report ignored")
+)
+
+const (
+	// MaxRetrievals is the most retrieval reports kept for one secret.
+	MaxRetrievals = 20
+	// RecordRetention is how long a secret's record is kept after its TTL passes.
+	RecordRetention = 30 * 24 * time.Hour
+	// PruneInterval is how often records older than RecordRetention are removed.
+	PruneInterval = time.Hour
+)
+
+// Flags recorded on a secretRecord.
+const (
+	// secretRevoked means an administrator deleted the secret.
+	secretRevoked uint32 = 1 << iota
+	// secretExpired means the sweeper deleted the secret after its TTL passed.
+	secretExpired
+	// secretVerified means the uploader asked the server to check the secret's
+	// objects, and both were there and the right size.
+	secretVerified
+	// secretPending means the uploader promised to ask for that check, so the secret
+	// can't be received until secretVerified is set too.
+	secretPending
+)
+
+// retrievalEvent records a client reporting that it received a secret.
+type retrievalEvent struct {
+	Time      time.Time `json:"time"`
+	ClientIP  string    `json:"client_ip"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// secretRecord is what the server remembers about a secret after handing out the
+// upload URLs.  The secret itself only ever lives in S3.
+type secretRecord struct {
+	ObjectId   string           `json:"object_id"`
+	Owner      string           `json:"owner"`
+	AuthType   string           `json:"auth_type"`
+	Tenant     string           `json:"tenant,omitempty"`
+	Created    time.Time        `json:"created"`
+	TTL        int64            `json:"ttl_seconds"`
+	Flags      uint32           `json:"flags"`
+	Retrievals []retrievalEvent `json:"retrievals,omitempty"`
+}
+
+func (self *secretRecord) expires() time.Time {
+	return self.Created.Add(time.Second * time.Duration(self.TTL))
+}
+
+// secretStore keeps a secretRecord for each secret the server has handed out upload
+// URLs for.
+type secretStore interface {
+	// create records a new secret, replacing any earlier record with the same ID.
+	create(record *secretRecord) error
+	// get returns ErrNoSuchRecord if the server has no record of the secret.
+	get(id string) (*secretRecord, error)
+	// setFlags adds flags to a secret's record.
+	setFlags(id string, flags uint32) error
+	// addRetrieval records a report that a secret was received.  It returns
+	// ErrReportIgnored if the secret was revoked or has expired, if the client already
+	// reported it, or if MaxRetrievals reports have already been made.
+	addRetrieval(id string, event retrievalEvent) error
+	// prune removes the records of secrets that expired before cutoff and returns how
+	// many there were.
+	prune(cutoff time.Time) (int, error)
+	// forEach calls fn for every record in object ID order, stopping at the first error.
+	forEach(fn func(*secretRecord) error) error
+	// backup writes a consistent copy of the whole store to w.
+	backup(w io.Writer) (int64, error)
+	close() error
+}
+
+// nullStore is used when db_file is not set.  It remembers nothing.
+type nullStore struct{}
+
+func (nullStore) create(*secretRecord) error                { return nil }
+func (nullStore) get(string) (*secretRecord, error)         { return nil, ErrNoSuchRecord }
+func (nullStore) setFlags(string, uint32) error             { return nil }
+func (nullStore) addRetrieval(string, retrievalEvent) error { return ErrNoSuchRecord }
+func (nullStore) prune(time.Time) (int, error)              { return 0, nil }
+func (nullStore) forEach(func(*secretRecord) error) error   { return nil }
+func (nullStore) backup(io.Writer) (int64, error)           { return 0, ErrNoDatabase }
+func (nullStore) close() error                              { return nil }
+
+// openStore opens the store configured by db_file, or returns a nullStore if there
+// isn't one.
+func openStore(config *serverConfig) (secretStore, error) {
+	if config.DBFile == "" {
+		return nullStore{}, nil
+	}
+	return openBoltStore(config.DBFile)
+}
+
+// pruneRecords removes old records from store every PruneInterval.  It never returns.
+func pruneRecords(store secretStore) {
+	for {
+		pruned, err := store.prune(time.Now().Add(-RecordRetention))
+		if err != nil {
+			log.Errorf("Failed to prune old records: %s", err.Error())
+		} else if pruned > 0 {
+			log.WithFields(log.Fields{
+				"records": pruned,
+			}).Info("Pruned old records")
+		}
+		time.Sleep(PruneInterval)
+	}
+}
+
+// retrievalHandler records a client's report that it has received a secret.  Clients
+// download secrets straight from S3, so this is the only way the server finds out.
+// Reports aren't authenticated; anyone who knows the object ID can make one, so ignored
+// reports get the same response as recorded ones and aren't audited.
+func retrievalHandler(store secretStore, audit *auditLogger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		err := store.addRetrieval(id, retrievalEvent{
+			Time:      time.Now(),
+			ClientIP:  c.ClientIP(),
+			UserAgent: c.Request.UserAgent(),
+		})
+		if err == ErrNoSuchRecord {
+			c.JSON(http.StatusNotFound, &commonlib.ErrorResponse{
+				Code:    commonlib.CodeNotFound,
+				Message: err.Error(),
+			})
+			return
+		}
+		if err == ErrReportIgnored {
+			logger(c).WithFields(log.Fields{
+				"objectId": id,
+			}).Debug("Ignored retrieval report")
+			c.Status(http.StatusNoContent)
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, &commonlib.ErrorResponse{
+				Code:    commonlib.CodeInternal,
+				Message: "Failed to record retrieval",
+			})
+			logger(c).Errorf("Failed to record retrieval of %s: %s", id, err.Error())
+			return
+		}
+		logger(c).WithFields(log.Fields{
+			"objectId": id,
+		}).Info("Secret retrieved")
+		audit.record(&auditEntry{
+			Event:    AuditSecretRetrieved,
+			ReqId:    c.GetString("reqId"),
+			ClientIP: c.ClientIP(),
+			ObjectId: id,
+		})
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	metaBucketName    = []byte("meta")
+	secretsBucketName = []byte("secrets")
+	schemaVersionKey  = []byte("schema_version")
+
+	// storeMigrations brings the database up to date.  Migration i takes the schema
+	// from version i to version i+1; the schema version is the number of migrations
+	// applied.  Never change or remove a migration once it has been released; add a
+	// new one instead.
+	storeMigrations = []func(tx *bolt.Tx) error{
+		// 1: secretRecords, JSON-encoded and keyed by object ID.
+		func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(secretsBucketName)
+			return err
+		},
+	}
+)
+
+// boltStore keeps secretRecords in a bbolt database file.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	// bbolt locks the file, so give up quickly if another server already has it open.
+	db, err := bolt.Open(path, os.FileMode(0600), &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	store := &boltStore{db: db}
+	if err = store.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// schemaVersion returns the number of migrations that have been applied.
+func schemaVersion(tx *bolt.Tx) (int, error) {
+	meta := tx.Bucket(metaBucketName)
+	if meta == nil {
+		return 0, nil
+	}
+	raw := meta.Get(schemaVersionKey)
+	if raw == nil {
+		return 0, nil
+	}
+	return strconv.Atoi(string(raw))
+}
+
+// migrate applies any migrations the database hasn't had yet, all in one transaction.
+func (self *boltStore) migrate() error {
+	return self.db.Update(func(tx *bolt.Tx) error {
+		version, err := schemaVersion(tx)
+		if err != nil {
+			return err
+		}
+		if version > len(storeMigrations) {
+			return ErrSchemaTooNew
+		}
+		if version == len(storeMigrations) {
+			return nil
+		}
+		for i := version; i < len(storeMigrations); i++ {
+			if err = storeMigrations[i](tx); err != nil {
+				return err
+			}
+			log.Infof("Migrated %s to schema version %d", self.db.Path(), i+1)
+		}
+		meta, err := tx.CreateBucketIfNotExists(metaBucketName)
+		if err != nil {
+			return err
+		}
+		return meta.Put(schemaVersionKey, []byte(strconv.Itoa(len(storeMigrations))))
+	})
+}
+
+func (self *boltStore) create(record *secretRecord) error {
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return self.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(secretsBucketName).Put([]byte(record.ObjectId), recordBytes)
+	})
+}
+
+func (self *boltStore) get(id string) (*secretRecord, error) {
+	var record secretRecord
+	err := self.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(secretsBucketName).Get([]byte(id))
+		if raw == nil {
+			return ErrNoSuchRecord
+		}
+		return json.Unmarshal(raw, &record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// update applies fn to a record and saves the result, unless fn returns an error.
+func (self *boltStore) update(id string, fn func(record *secretRecord) error) error {
+	return self.db.Update(func(tx *bolt.Tx) error {
+		secrets := tx.Bucket(secretsBucketName)
+		raw := secrets.Get([]byte(id))
+		if raw == nil {
+			return ErrNoSuchRecord
+		}
+		var record secretRecord
+		if err := json.Unmarshal(raw, &record); err != nil {
+			return err
+		}
+		if err := fn(&record); err != nil {
+			return err
+		}
+		recordBytes, err := json.Marshal(&record)
+		if err != nil {
+			return err
+		}
+		return secrets.Put([]byte(id), recordBytes)
+	})
+}
+
+func (self *boltStore) setFlags(id string, flags uint32) error {
+	return self.update(id, func(record *secretRecord) error {
+		record.Flags |= flags
+		return nil
+	})
+}
+
+func (self *boltStore) addRetrieval(id string, event retrievalEvent) error {
+	return self.update(id, func(record *secretRecord) error {
+		if record.Flags&(secretRevoked|secretExpired) != 0 || event.Time.After(record.expires()) {
+			return ErrReportIgnored
+		}
+		if len(record.Retrievals) >= MaxRetrievals {
+			return ErrReportIgnored
+		}
+		for _, earlier := range record.Retrievals {
+			if earlier.ClientIP == event.ClientIP {
+				return ErrReportIgnored
+			}
+		}
+		record.Retrievals = append(record.Retrievals, event)
+		return nil
+	})
+}
+
+func (self *boltStore) prune(cutoff time.Time) (int, error) {
+	pruned := 0
+	err := self.db.Update(func(tx *bolt.Tx) error {
+		secrets := tx.Bucket(secretsBucketName)
+		// Deleting while iterating with ForEach isn't allowed, so collect the keys first.
+		old := make([][]byte, 0)
+		err := secrets.ForEach(func(k, v []byte) error {
+			var record secretRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			if record.expires().Before(cutoff) {
+				old = append(old, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range old {
+			if err := secrets.Delete(k); err != nil {
+				return err
+			}
+		}
+		pruned = len(old)
+		return nil
+	})
+	return pruned, err
+}
+
+func (self *boltStore) forEach(fn func(*secretRecord) error) error {
+	return self.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(secretsBucketName).ForEach(func(k, v []byte) error {
+			var record secretRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			return fn(&record)
+		})
+	})
+}
+
+func (self *boltStore) backup(w io.Writer) (int64, error) {
+	var written int64
+	err := self.db.View(func(tx *bolt.Tx) error {
+		var err error
+		written, err = tx.WriteTo(w)
+		return err
+	})
+	return written, err
+}
+
+func (self *boltStore) close() error {
+	return self.db.Close()
+}
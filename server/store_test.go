@@ -0,0 +1,183 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	. "gopkg.in/check.v1"
+
+	"github.com/waucka/secretshare/api/client"
+)
+
+type StoreSuite struct {
+	path  string
+	store *boltStore
+}
+
+var _ = Suite(&StoreSuite{})
+
+func (s *StoreSuite) SetUpTest(c *C) {
+	s.path = filepath.Join(c.MkDir(), "secretshare.db")
+	var err error
+	s.store, err = openBoltStore(s.path)
+	c.Assert(err, IsNil)
+}
+
+func (s *StoreSuite) TearDownTest(c *C) {
+	s.store.close()
+}
+
+func (s *StoreSuite) TestRecords(c *C) {
+	created := time.Now().UTC().Truncate(time.Second)
+	err := s.store.create(&secretRecord{
+		ObjectId: "abc",
+		Owner:    "alice@example.com",
+		AuthType: "oidc",
+		Created:  created,
+		TTL:      3600,
+	})
+	c.Assert(err, IsNil)
+
+	record, err := s.store.get("abc")
+	c.Assert(err, IsNil)
+	c.Assert(record.Owner, Equals, "alice@example.com")
+	c.Assert(record.expires().Equal(created.Add(time.Hour)), Equals, true)
+
+	c.Assert(s.store.addRetrieval("abc", retrievalEvent{Time: created, ClientIP: "192.0.2.1"}), IsNil)
+	c.Assert(s.store.setFlags("abc", secretRevoked), IsNil)
+	record, err = s.store.get("abc")
+	c.Assert(err, IsNil)
+	c.Assert(record.Flags, Equals, secretRevoked)
+	c.Assert(record.Retrievals, HasLen, 1)
+	c.Assert(record.Retrievals[0].ClientIP, Equals, "192.0.2.1")
+
+	_, err = s.store.get("nope")
+	c.Assert(err, Equals, ErrNoSuchRecord)
+	c.Assert(s.store.setFlags("nope", secretExpired), Equals, ErrNoSuchRecord)
+
+	ids := make([]string, 0)
+	c.Assert(s.store.create(&secretRecord{ObjectId: "ABC"}), IsNil)
+	err = s.store.forEach(func(record *secretRecord) error {
+		ids = append(ids, record.ObjectId)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(ids, DeepEquals, []string{"ABC", "abc"})
+}
+
+// The typed client exposes the flags to administrators.
+func (s *StoreSuite) TestFlagValues(c *C) {
+	c.Assert(secretRevoked, Equals, client.FlagRevoked)
+	c.Assert(secretExpired, Equals, client.FlagExpired)
+	c.Assert(secretVerified, Equals, client.FlagVerified)
+	c.Assert(secretPending, Equals, client.FlagPending)
+}
+
+func (s *StoreSuite) TestRetrievalReports(c *C) {
+	created := time.Now()
+	c.Assert(s.store.create(&secretRecord{ObjectId: "abc", Created: created, TTL: 3600}), IsNil)
+	report := func(ip string, at time.Time) error {
+		return s.store.addRetrieval("abc", retrievalEvent{Time: at, ClientIP: ip})
+	}
+
+	c.Assert(report("192.0.2.1", created), IsNil)
+	// Each client is only counted once.
+	c.Assert(report("192.0.2.1", created), Equals, ErrReportIgnored)
+	// Nobody can receive a secret after it expires.
+	c.Assert(report("192.0.2.2", created.Add(2*time.Hour)), Equals, ErrReportIgnored)
+	for i := 2; i <= MaxRetrievals; i++ {
+		c.Assert(report(fmt.Sprintf("192.0.2.%d", i), created), IsNil)
+	}
+	c.Assert(report("198.51.100.1", created), Equals, ErrReportIgnored)
+	record, err := s.store.get("abc")
+	c.Assert(err, IsNil)
+	c.Assert(record.Retrievals, HasLen, MaxRetrievals)
+
+	c.Assert(s.store.create(&secretRecord{ObjectId: "def", Created: created, TTL: 3600}), IsNil)
+	c.Assert(s.store.setFlags("def", secretRevoked), IsNil)
+	c.Assert(s.store.addRetrieval("def", retrievalEvent{Time: created, ClientIP: "192.0.2.1"}), Equals, ErrReportIgnored)
+}
+
+func (s *StoreSuite) TestPrune(c *C) {
+	now := time.Now()
+	c.Assert(s.store.create(&secretRecord{ObjectId: "a", Created: now.Add(-RecordRetention - 2*time.Hour), TTL: 3600}), IsNil)
+	c.Assert(s.store.create(&secretRecord{ObjectId: "b", Created: now.Add(-RecordRetention), TTL: 3600}), IsNil)
+	c.Assert(s.store.create(&secretRecord{ObjectId: "c", Created: now.Add(-RecordRetention - 3*time.Hour), TTL: 3600}), IsNil)
+
+	pruned, err := s.store.prune(now.Add(-RecordRetention))
+	c.Assert(err, IsNil)
+	c.Assert(pruned, Equals, 2)
+	_, err = s.store.get("a")
+	c.Assert(err, Equals, ErrNoSuchRecord)
+	_, err = s.store.get("b")
+	c.Assert(err, IsNil)
+	_, err = s.store.get("c")
+	c.Assert(err, Equals, ErrNoSuchRecord)
+}
+
+func (s *StoreSuite) TestBackup(c *C) {
+	c.Assert(s.store.create(&secretRecord{ObjectId: "abc", Owner: "bob"}), IsNil)
+	var buf bytes.Buffer
+	written, err := s.store.backup(&buf)
+	c.Assert(err, IsNil)
+	c.Assert(written, Equals, int64(buf.Len()))
+
+	backupPath := filepath.Join(c.MkDir(), "backup.db")
+	c.Assert(ioutil.WriteFile(backupPath, buf.Bytes(), os.FileMode(0600)), IsNil)
+	restored, err := openBoltStore(backupPath)
+	c.Assert(err, IsNil)
+	defer restored.close()
+	record, err := restored.get("abc")
+	c.Assert(err, IsNil)
+	c.Assert(record.Owner, Equals, "bob")
+}
+
+func (s *StoreSuite) TestSchemaVersion(c *C) {
+	err := s.store.db.View(func(tx *bolt.Tx) error {
+		version, err := schemaVersion(tx)
+		c.Assert(version, Equals, len(storeMigrations))
+		return err
+	})
+	c.Assert(err, IsNil)
+
+	// Reopening doesn't run the migrations again.
+	c.Assert(s.store.create(&secretRecord{ObjectId: "abc"}), IsNil)
+	s.store.close()
+	s.store, err = openBoltStore(s.path)
+	c.Assert(err, IsNil)
+	_, err = s.store.get("abc")
+	c.Assert(err, IsNil)
+
+	// A database from a newer server is left alone.
+	err = s.store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucketName).Put(schemaVersionKey, []byte("99"))
+	})
+	c.Assert(err, IsNil)
+	s.store.close()
+	_, err = openBoltStore(s.path)
+	c.Assert(err, Equals, ErrSchemaTooNew)
+	db, err := bolt.Open(s.path, os.FileMode(0600), nil)
+	c.Assert(err, IsNil)
+	s.store = &boltStore{db: db}
+}
@@ -0,0 +1,100 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// sweeper periodically counts the secrets in the bucket and, if enabled, deletes the
+// ones whose TTL has passed.  Objects uploaded without expiresMetadataKey are left for
+// the bucket's lifecycle rules to deal with.
+type sweeper struct {
+	tenant        string
+	bucket        *secretBucket
+	interval      time.Duration
+	deleteExpired bool
+	audit         *auditLogger
+	store         secretStore
+}
+
+// sweep makes one pass over the bucket.
+func (self *sweeper) sweep() error {
+	now := time.Now()
+	secrets, err := self.bucket.list()
+	if err != nil {
+		return err
+	}
+
+	active := len(secrets)
+	if self.deleteExpired {
+		for _, info := range secrets {
+			id := info.ObjectId
+			err := self.bucket.describe(info)
+			if err == ErrNoSuchSecret {
+				active--
+				continue
+			}
+			if err != nil {
+				log.WithFields(log.Fields{
+					"objectId": id,
+					"tenant":   self.tenant,
+				}).Errorf("Sweeper failed to read object metadata: %s", err.Error())
+				continue
+			}
+			if info.Expires == nil || now.Before(*info.Expires) {
+				continue
+			}
+			if err = self.bucket.delete(id); err != nil {
+				log.WithFields(log.Fields{
+					"objectId": id,
+				}).Errorf("Sweeper failed to delete expired secret: %s", err.Error())
+				continue
+			}
+			log.WithFields(log.Fields{
+				"objectId": id,
+			}).Info("Deleted expired secret")
+			if err = self.store.setFlags(id, secretExpired); err != nil && err != ErrNoSuchRecord {
+				log.WithFields(log.Fields{
+					"objectId": id,
+				}).Errorf("Sweeper failed to record expiry: %s", err.Error())
+			}
+			self.audit.record(&auditEntry{
+				Event:    AuditSecretExpired,
+				Caller:   "sweeper",
+				Tenant:   self.tenant,
+				ObjectId: id,
+			})
+			reaperDeletions.Inc()
+			active--
+		}
+	}
+	activeSecrets.WithLabelValues(self.tenant).Set(float64(active))
+	return nil
+}
+
+// run sweeps the bucket every interval.  It never returns.
+func (self *sweeper) run() {
+	for {
+		if err := self.sweep(); err != nil {
+			log.Errorf("Failed to sweep bucket %s: %s", self.bucket.name, err.Error())
+		}
+		time.Sleep(self.interval)
+	}
+}
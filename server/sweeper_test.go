@@ -0,0 +1,106 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "gopkg.in/check.v1"
+)
+
+type SweeperSuite struct{}
+
+var _ = Suite(&SweeperSuite{})
+
+func (s *SweeperSuite) TestSweep(c *C) {
+	now := time.Now().UTC()
+	var mutex sync.Mutex
+	objects := map[string]string{
+		"fresh":   now.Add(time.Hour).Format(time.RFC3339),
+		"stale":   now.Add(-time.Hour).Format(time.RFC3339),
+		"ancient": "",
+	}
+	deleted := make([]string, 0)
+	bucket, stop := testBucket(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		key := strings.TrimPrefix(r.URL.Path, "/secrets/")
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/secrets":
+			fmt.Fprint(w, `<ListBucketResult><IsTruncated>false</IsTruncated>`)
+			for id := range objects {
+				fmt.Fprintf(w, `<Contents><Key>%s</Key><Size>10</Size></Contents><Contents><Key>meta/%s</Key><Size>5</Size></Contents>`, id, id)
+			}
+			// Listed, but gone by the time it's examined.
+			fmt.Fprint(w, `<Contents><Key>vanished</Key><Size>10</Size></Contents></ListBucketResult>`)
+		case r.Method == "HEAD":
+			expires, ok := objects[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if expires != "" {
+				w.Header().Set("X-Amz-Meta-Secretshare-Expires", expires)
+			}
+		case r.Method == "DELETE":
+			deleted = append(deleted, key)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+	defer stop()
+
+	store, err := openBoltStore(filepath.Join(c.MkDir(), "secretshare.db"))
+	c.Assert(err, IsNil)
+	defer store.close()
+	c.Assert(store.create(&secretRecord{ObjectId: "stale", Created: now.Add(-2 * time.Hour), TTL: 3600}), IsNil)
+
+	auditPath := filepath.Join(c.MkDir(), "audit.log")
+	audit, err := newAuditLogger(&auditConfig{File: auditPath})
+	c.Assert(err, IsNil)
+	defer audit.file.Close()
+
+	// Without delete_expired, the sweeper only counts.
+	sweep := &sweeper{tenant: "sweeptest", bucket: bucket, store: store, audit: audit}
+	c.Assert(sweep.sweep(), IsNil)
+	c.Assert(deleted, HasLen, 0)
+	c.Assert(testutil.ToFloat64(activeSecrets.WithLabelValues("sweeptest")), Equals, float64(4))
+
+	// With it, expired secrets and their metadata go, and objects without an expiry
+	// are left for the lifecycle rule.
+	before := testutil.ToFloat64(reaperDeletions)
+	sweep.deleteExpired = true
+	c.Assert(sweep.sweep(), IsNil)
+	c.Assert(deleted, DeepEquals, []string{"stale", "meta/stale"})
+	c.Assert(testutil.ToFloat64(reaperDeletions), Equals, before+1)
+	c.Assert(testutil.ToFloat64(activeSecrets.WithLabelValues("sweeptest")), Equals, float64(2))
+	record, err := store.get("stale")
+	c.Assert(err, IsNil)
+	c.Assert(record.Flags&secretExpired, Equals, uint32(secretExpired))
+	last, err := lastAuditEntry(auditPath)
+	c.Assert(err, IsNil)
+	c.Assert(last.Event, Equals, AuditSecretExpired)
+	c.Assert(last.ObjectId, Equals, "stale")
+	c.Assert(last.Tenant, Equals, "sweeptest")
+}
@@ -0,0 +1,400 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gin-gonic/gin"
+
+	"github.com/waucka/secretshare/commonlib"
+)
+
+// DefaultTenant is the name of the tenant defined by the top-level bucket settings.
+// Callers who don't belong to any other tenant use it.
+const DefaultTenant = "default"
+
+// tenantConfig is an entry in the "tenants" section of the server config.  Each tenant
+// has its own bucket.  Settings that a tenant leaves unset are taken from the top
+// level, except for secret_key.
+type tenantConfig struct {
+	Name               string `json:"name"`
+	Bucket             string `json:"bucket"`
+	BucketRegion       string `json:"bucket_region"`
+	AwsAccessKeyId     string `json:"aws_access_key_id"`
+	AwsSecretAccessKey string `json:"aws_secret_access_key"`
+	AssumeRoleArn      string `json:"assume_role_arn"`
+	// SecretKey is a pre-shared key for this tenant.  Requests signed with it go to
+	// this tenant.
+	SecretKey string `json:"secret_key"`
+	// Identities are patterns (as in path.Match, e.g. "*@finance.example.com") for
+	// the names of callers who log in some other way and belong to this tenant.
+	Identities []string `json:"identities"`
+	DefaultTTL int      `json:"default_ttl"`
+	MaxTTL     int      `json:"max_ttl"`
+	MaxSize    int64    `json:"max_size"`
+}
+
+// matches reports whether a caller with the given name belongs to the tenant.
+func (self *tenantConfig) matches(name string) bool {
+	for _, pattern := range self.Identities {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// forTenant returns the settings that apply to a tenant: the top-level settings,
+// overridden by whatever the tenant sets.  If tenant is nil, it returns the settings
+// for the default tenant.
+func (self *serverConfig) forTenant(tenant *tenantConfig) *serverConfig {
+	config := *self
+	config.Tenants = nil
+	if tenant == nil {
+		return &config
+	}
+	config.Bucket = tenant.Bucket
+	config.BucketRegion = tenant.BucketRegion
+	if tenant.AwsAccessKeyId != "" {
+		config.AwsAccessKeyId = tenant.AwsAccessKeyId
+		config.AwsSecretAccessKey = tenant.AwsSecretAccessKey
+	}
+	if tenant.AssumeRoleArn != "" {
+		config.AssumeRoleArn = tenant.AssumeRoleArn
+	}
+	config.SecretKey = tenant.SecretKey
+	if tenant.DefaultTTL > 0 {
+		config.DefaultTTL = tenant.DefaultTTL
+	}
+	if tenant.MaxTTL > 0 {
+		config.MaxTTL = tenant.MaxTTL
+	}
+	if tenant.MaxSize > 0 {
+		config.MaxSize = tenant.MaxSize
+	}
+	return &config
+}
+
+// tenantNames returns the name of every tenant, starting with the default one.
+func (self *serverConfig) tenantNames() []string {
+	names := []string{DefaultTenant}
+	for _, tenant := range self.Tenants {
+		names = append(names, tenant.Name)
+	}
+	return names
+}
+
+// tenantConfigs returns the settings for every tenant, keyed by name.
+func (self *serverConfig) tenantConfigs() map[string]*serverConfig {
+	configs := map[string]*serverConfig{
+		DefaultTenant: self.forTenant(nil),
+	}
+	for _, tenant := range self.Tenants {
+		configs[tenant.Name] = self.forTenant(tenant)
+	}
+	return configs
+}
+
+// validateTenants returns a description of each problem with the tenants section.
+func (self *serverConfig) validateTenants() []string {
+	problems := make([]string, 0)
+	names := map[string]bool{DefaultTenant: true}
+	buckets := map[string]string{self.Bucket: DefaultTenant}
+	keys := map[string]string{}
+	if self.SecretKey != "" {
+		keys[self.SecretKey] = DefaultTenant
+	}
+	for i, tenant := range self.Tenants {
+		if tenant.Name == "" {
+			problems = append(problems, fmt.Sprintf("tenants[%d] needs a name", i))
+			continue
+		}
+		if names[tenant.Name] {
+			problems = append(problems, fmt.Sprintf(`tenant name "%s" is used more than once (or is reserved)`, tenant.Name))
+		}
+		names[tenant.Name] = true
+		if tenant.Bucket == "" || tenant.BucketRegion == "" {
+			problems = append(problems, fmt.Sprintf("tenant %s needs bucket and bucket_region", tenant.Name))
+		} else if other, ok := buckets[tenant.Bucket]; ok {
+			problems = append(problems, fmt.Sprintf("tenants %s and %s share bucket %s", other, tenant.Name, tenant.Bucket))
+		} else {
+			buckets[tenant.Bucket] = tenant.Name
+		}
+		if (tenant.AwsAccessKeyId == "") != (tenant.AwsSecretAccessKey == "") {
+			problems = append(problems, fmt.Sprintf("tenant %s must set aws_access_key_id and aws_secret_access_key together", tenant.Name))
+		}
+		if tenant.SecretKey != "" {
+			if other, ok := keys[tenant.SecretKey]; ok {
+				problems = append(problems, fmt.Sprintf("tenants %s and %s have the same secret_key", other, tenant.Name))
+			}
+			keys[tenant.SecretKey] = tenant.Name
+		}
+		for _, pattern := range tenant.Identities {
+			if _, err := path.Match(pattern, ""); err != nil {
+				problems = append(problems, fmt.Sprintf(`tenant %s has a malformed identity pattern "%s"`, tenant.Name, pattern))
+			}
+		}
+		if tenant.SecretKey == "" && len(tenant.Identities) == 0 {
+			problems = append(problems, fmt.Sprintf("tenant %s needs secret_key or identities, or nobody can use it", tenant.Name))
+		}
+		if tenant.DefaultTTL < 0 || tenant.MaxTTL < 0 || tenant.MaxSize < 0 {
+			problems = append(problems, fmt.Sprintf("tenant %s: default_ttl, max_ttl, and max_size must not be negative", tenant.Name))
+		}
+	}
+	// Otherwise receiving clients couldn't be told which bucket a secret is in without
+	// looking in every one.
+	if len(self.Tenants) > 0 && self.DBFile == "" {
+		problems = append(problems, "tenants needs db_file to be set")
+	}
+	return problems
+}
+
+// tenant is one tenant's bucket.
+type tenant struct {
+	name   string
+	region string
+	bucket *secretBucket
+}
+
+// tenantSet holds every tenant's bucket.  Buckets and AWS credentials can't be
+// changed without restarting the server.
+type tenantSet struct {
+	// tenants is in config order, starting with the default tenant.
+	tenants []*tenant
+	byName  map[string]*tenant
+}
+
+func newTenantSet(config *serverConfig) (*tenantSet, error) {
+	set := &tenantSet{
+		byName: make(map[string]*tenant),
+	}
+	configs := config.tenantConfigs()
+	for _, name := range config.tenantNames() {
+		tenantConfig := configs[name]
+		sess, err := newAWSSession(tenantConfig)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %s", name, err.Error())
+		}
+		if source, err := credentialSource(sess); err != nil {
+			log.WithFields(log.Fields{
+				"tenant": name,
+			}).Errorf("Failed to get AWS credentials; uploads will fail until this is fixed: %s", err.Error())
+		} else {
+			log.WithFields(log.Fields{
+				"tenant":        name,
+				"assumeRoleArn": tenantConfig.AssumeRoleArn,
+			}).Infof("Using AWS credentials from %s", source)
+		}
+		t := &tenant{
+			name:   name,
+			region: tenantConfig.BucketRegion,
+			bucket: &secretBucket{
+				svc:  s3.New(sess),
+				name: tenantConfig.Bucket,
+			},
+		}
+		set.tenants = append(set.tenants, t)
+		set.byName[name] = t
+	}
+	return set, nil
+}
+
+// get returns the named tenant, or nil if there isn't one by that name.  An empty name
+// means the default tenant.
+func (self *tenantSet) get(name string) *tenant {
+	if name == "" {
+		name = DefaultTenant
+	}
+	return self.byName[name]
+}
+
+// sameAs reports whether config defines the same tenants with the same buckets.
+func (self *tenantSet) sameAs(config *serverConfig) bool {
+	names := config.tenantNames()
+	if len(names) != len(self.tenants) {
+		return false
+	}
+	configs := config.tenantConfigs()
+	for i, name := range names {
+		t := self.tenants[i]
+		if t.name != name || t.bucket.name != configs[name].Bucket || t.region != configs[name].BucketRegion {
+			return false
+		}
+	}
+	return true
+}
+
+// lookup returns the tenant a secret was uploaded to, going only by the database.  With
+// a single tenant there's only one place the secret can be, so no database is needed.
+// It doesn't check that the secret is still there.
+//
+// Unlike locate, it makes no S3 requests.  locationHandler still checks the secret with
+// checkReceivable, which avoids S3 when the database has a record of it.
+func (self *tenantSet) lookup(id string, store secretStore) (*tenant, error) {
+	if record, err := store.get(id); err == nil {
+		if t := self.get(record.Tenant); t != nil {
+			return t, nil
+		}
+	} else if err != ErrNoSuchRecord {
+		return nil, err
+	}
+	if len(self.tenants) == 1 {
+		return self.tenants[0], nil
+	}
+	return nil, ErrNoSuchSecret
+}
+
+// locate finds the tenant whose bucket holds a secret.  The database says where
+// secrets went if it is enabled; otherwise, each bucket is checked in turn.
+func (self *tenantSet) locate(id string, store secretStore) (*tenant, error) {
+	if record, err := store.get(id); err == nil {
+		if t := self.get(record.Tenant); t != nil {
+			return t, nil
+		}
+	}
+	for _, t := range self.tenants {
+		err := t.bucket.describe(&secretInfo{ObjectId: id})
+		if err == ErrNoSuchSecret {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+	return nil, ErrNoSuchSecret
+}
+
+// ErrUploadUnconfirmed means the uploader promised to confirm the upload (see
+// secretPending) and hasn't yet.
+var ErrUploadUnconfirmed = errors.New("The sender hasn't finished uploading the secret")
+
+// secretGone explains why a secret that did exist can no longer be received.
+type secretGone struct {
+	code    string
+	message string
+}
+
+func (self *secretGone) Error() string {
+	return self.message
+}
+
+// checkReceivable returns a *secretGone if the secret in t's bucket has been revoked,
+// has expired, or was retrieved and then deleted, and ErrNoSuchSecret if there's no
+// sign it ever existed.  It returns ErrUploadUnconfirmed if the sender hasn't confirmed
+// the upload yet.  The database is consulted first; without it, the expiry time
+// recorded on the S3 object is the only clue.
+//
+// The location endpoint calls this without authentication, so S3 is only asked about
+// secrets the database has no record of, or that have been received and so might
+// have been deleted since.
+func checkReceivable(id string, t *tenant, store secretStore, now time.Time) error {
+	record, err := store.get(id)
+	if err == ErrNoSuchRecord {
+		record = nil
+	} else if err != nil {
+		return err
+	}
+	if record != nil && record.Flags&secretRevoked != 0 {
+		return &secretGone{commonlib.CodeRevoked, "The secret was revoked by an administrator"}
+	}
+	if record != nil && (record.Flags&secretExpired != 0 || (record.TTL > 0 && now.After(record.expires()))) {
+		return &secretGone{commonlib.CodeExpired, fmt.Sprintf("The secret expired at %s", record.expires().Format(time.RFC3339))}
+	}
+	if record != nil && record.Flags&secretPending != 0 && record.Flags&secretVerified == 0 {
+		return ErrUploadUnconfirmed
+	}
+	if record != nil && len(record.Retrievals) == 0 {
+		return nil
+	}
+
+	info := &secretInfo{ObjectId: id}
+	err = t.bucket.describe(info)
+	if err == ErrNoSuchSecret && record != nil && len(record.Retrievals) > 0 {
+		retrieved := record.Retrievals[len(record.Retrievals)-1].Time
+		return &secretGone{commonlib.CodeRetrieved, fmt.Sprintf("The secret was already retrieved at %s and has since been deleted", retrieved.Format(time.RFC3339))}
+	}
+	if err != nil {
+		return err
+	}
+	if info.Expires != nil && now.After(*info.Expires) {
+		return &secretGone{commonlib.CodeExpired, fmt.Sprintf("The secret expired at %s", info.Expires.Format(time.RFC3339))}
+	}
+	return nil
+}
+
+// storageChecks returns the readiness checks for the tenant's bucket.  Checks for
+// tenants other than the default one are suffixed with the tenant's name.
+func (self *tenant) storageChecks() []readinessCheck {
+	checks := storageChecks(self.bucket.svc, self.bucket.name)
+	if self.name != DefaultTenant {
+		for i := range checks {
+			checks[i].name += ":" + self.name
+		}
+	}
+	return checks
+}
+
+// locationHandler tells receiving clients which bucket holds a secret.
+func locationHandler(tenants *tenantSet, store secretStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		t, err := tenants.lookup(c.Param("id"), store)
+		if err == nil {
+			err = checkReceivable(c.Param("id"), t, store, time.Now())
+		}
+		if gone, ok := err.(*secretGone); ok {
+			c.JSON(http.StatusGone, &commonlib.ErrorResponse{
+				Code:    gone.code,
+				Message: gone.message,
+			})
+			return
+		}
+		if err == ErrNoSuchSecret {
+			c.JSON(http.StatusNotFound, &commonlib.ErrorResponse{
+				Code:    commonlib.CodeNotFound,
+				Message: "No such secret; check the key for typos",
+			})
+			return
+		}
+		if err == ErrUploadUnconfirmed {
+			c.JSON(http.StatusConflict, &commonlib.ErrorResponse{
+				Code:    commonlib.CodeIncompleteUpload,
+				Message: err.Error(),
+			})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, &commonlib.ErrorResponse{
+				Code:    commonlib.CodeInternal,
+				Message: "Failed to look up secret",
+			})
+			logger(c).Errorf("Failed to locate %s: %s", c.Param("id"), err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, &commonlib.SecretLocation{
+			Bucket:       t.bucket.name,
+			BucketRegion: t.region,
+		})
+	}
+}
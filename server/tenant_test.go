@@ -0,0 +1,212 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	. "gopkg.in/check.v1"
+
+	"github.com/waucka/secretshare/commonlib"
+)
+
+type TenantSuite struct {
+	config *serverConfig
+}
+
+var _ = Suite(&TenantSuite{})
+
+func (s *TenantSuite) SetUpTest(c *C) {
+	s.config = &serverConfig{
+		Bucket:         "shared-secrets",
+		BucketRegion:   "us-east-1",
+		SecretKey:      "sekrit",
+		AwsAccessKeyId: "AKIDEXAMPLE",
+		MaxTTL:         60,
+		DBFile:         "/var/lib/secretshare/secretshare.db",
+		Tenants: []*tenantConfig{
+			{
+				Name:         "finance",
+				Bucket:       "finance-secrets",
+				BucketRegion: "eu-west-1",
+				SecretKey:    "finance-sekrit",
+				Identities:   []string{"*@finance.example.com"},
+				MaxSize:      1024,
+			},
+		},
+	}
+}
+
+func (s *TenantSuite) TestForTenant(c *C) {
+	configs := s.config.tenantConfigs()
+	c.Assert(configs, HasLen, 2)
+	c.Assert(configs[DefaultTenant].Bucket, Equals, "shared-secrets")
+
+	finance := configs["finance"]
+	c.Assert(finance.Bucket, Equals, "finance-secrets")
+	c.Assert(finance.BucketRegion, Equals, "eu-west-1")
+	c.Assert(finance.SecretKey, Equals, "finance-sekrit")
+	c.Assert(finance.MaxSize, Equals, int64(1024))
+	// Unset settings come from the top level.
+	c.Assert(finance.MaxTTL, Equals, 60)
+	c.Assert(finance.AwsAccessKeyId, Equals, "AKIDEXAMPLE")
+	c.Assert(finance.Tenants, IsNil)
+}
+
+func (s *TenantSuite) TestValidate(c *C) {
+	c.Assert(s.config.validateTenants(), HasLen, 0)
+
+	s.config.Tenants = append(s.config.Tenants,
+		&tenantConfig{Name: "finance", Bucket: "shared-secrets", BucketRegion: "us-east-1", SecretKey: "sekrit"},
+		&tenantConfig{Name: "research", Bucket: "research-secrets", BucketRegion: "us-east-1"},
+	)
+	problems := strings.Join(s.config.validateTenants(), "\n")
+	c.Assert(problems, Matches, `(?s).*tenant name "finance" is used more than once.*`)
+	c.Assert(problems, Matches, `(?s).*tenants default and finance share bucket shared-secrets.*`)
+	c.Assert(problems, Matches, `(?s).*tenants default and finance have the same secret_key.*`)
+	c.Assert(problems, Matches, `(?s).*tenant research needs secret_key or identities.*`)
+
+	s.config.DBFile = ""
+	problems = strings.Join(s.config.validateTenants(), "\n")
+	c.Assert(problems, Matches, `(?s).*tenants needs db_file to be set.*`)
+}
+
+func (s *TenantSuite) TestRouting(c *C) {
+	auth := &authenticator{
+		nonces: newNonceCache(SignatureWindow),
+	}
+	auth.update(s.config)
+	body := []byte(`{"ttl":60,"object_id":"abc"}`)
+
+	// The key that signed the request picks the tenant.
+	caller, err := auth.authenticate(signedContext(c, "finance-sekrit", body), body, &commonlib.UploadRequest{})
+	c.Assert(err, IsNil)
+	c.Assert(auth.tenantFor(caller), Equals, "finance")
+	caller, err = auth.authenticate(signedContext(c, "sekrit", body), body, &commonlib.UploadRequest{})
+	c.Assert(err, IsNil)
+	c.Assert(auth.tenantFor(caller), Equals, DefaultTenant)
+
+	// Otherwise, the caller's name does.
+	c.Assert(auth.tenantFor(&identity{Name: "alice@finance.example.com"}), Equals, "finance")
+	c.Assert(auth.tenantFor(&identity{Name: "bob@example.com"}), Equals, DefaultTenant)
+
+	c.Assert(auth.schemes(), DeepEquals, []string{commonlib.AuthSignature})
+}
+
+// testBucket returns a bucket whose S3 requests go to handler, and a function that
+// stops the fake S3.
+func testBucket(handler http.HandlerFunc) (*secretBucket, func()) {
+	s3Server := httptest.NewServer(handler)
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:         aws.String(s3Server.URL),
+		Region:           aws.String("us-east-1"),
+		Credentials:      credentials.NewStaticCredentials("AKIDEXAMPLE", "hunter2", ""),
+		S3ForcePathStyle: aws.Bool(true),
+	}))
+	return &secretBucket{svc: s3.New(sess), name: "secrets"}, s3Server.Close
+}
+
+func (s *TenantSuite) TestReceivable(c *C) {
+	now := time.Now().UTC().Truncate(time.Second)
+	heads := 0
+	bucket, stop := testBucket(func(w http.ResponseWriter, r *http.Request) {
+		heads++
+		switch r.URL.Path {
+		case "/secrets/fresh":
+			w.Header().Set("X-Amz-Meta-Secretshare-Expires", now.Add(time.Hour).Format(time.RFC3339))
+		case "/secrets/stale":
+			w.Header().Set("X-Amz-Meta-Secretshare-Expires", now.Add(-time.Hour).Format(time.RFC3339))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	defer stop()
+	t := &tenant{name: DefaultTenant, bucket: bucket}
+
+	store, err := openBoltStore(filepath.Join(c.MkDir(), "secretshare.db"))
+	c.Assert(err, IsNil)
+	defer store.close()
+	for _, record := range []*secretRecord{
+		{ObjectId: "revoked", Created: now, TTL: 3600, Flags: secretRevoked},
+		{ObjectId: "expired", Created: now.Add(-2 * time.Hour), TTL: 3600},
+		{ObjectId: "retrieved", Created: now, TTL: 3600},
+		{ObjectId: "deleted", Created: now, TTL: 3600},
+		{ObjectId: "pending", Created: now, TTL: 3600, Flags: secretPending},
+		{ObjectId: "fresh", Created: now, TTL: 3600, Flags: secretPending | secretVerified},
+	} {
+		c.Assert(store.create(record), IsNil)
+	}
+	c.Assert(store.addRetrieval("retrieved", retrievalEvent{Time: now, ClientIP: "192.0.2.1"}), IsNil)
+
+	gone := func(id string) string {
+		err := checkReceivable(id, t, store, now)
+		c.Assert(err, FitsTypeOf, &secretGone{}, Commentf("%s", id))
+		return err.(*secretGone).code
+	}
+	c.Check(gone("revoked"), Equals, commonlib.CodeRevoked)
+	c.Check(gone("expired"), Equals, commonlib.CodeExpired)
+	c.Check(gone("retrieved"), Equals, commonlib.CodeRetrieved)
+	// A secret can't be received until its sender confirms the upload.
+	c.Check(checkReceivable("pending", t, store, now), Equals, ErrUploadUnconfirmed)
+	// Otherwise the record is enough, and S3 isn't asked.
+	heads = 0
+	c.Check(checkReceivable("deleted", t, store, now), IsNil)
+	c.Check(checkReceivable("fresh", t, store, now), IsNil)
+	c.Check(heads, Equals, 0)
+
+	// Without a record, the expiry time on the object is all there is to go on.
+	c.Check(gone("stale"), Equals, commonlib.CodeExpired)
+	c.Check(checkReceivable("fresh", t, nullStore{}, now), IsNil)
+	c.Check(checkReceivable("nope", t, nullStore{}, now), Equals, ErrNoSuchSecret)
+}
+
+func (s *TenantSuite) TestLookup(c *C) {
+	shared := &tenant{name: DefaultTenant, bucket: &secretBucket{name: "shared-secrets"}}
+	finance := &tenant{name: "finance", bucket: &secretBucket{name: "finance-secrets"}}
+	tenants := &tenantSet{
+		tenants: []*tenant{shared, finance},
+		byName:  map[string]*tenant{DefaultTenant: shared, "finance": finance},
+	}
+	store, err := openBoltStore(filepath.Join(c.MkDir(), "secretshare.db"))
+	c.Assert(err, IsNil)
+	defer store.close()
+	c.Assert(store.create(&secretRecord{ObjectId: "abc", Tenant: "finance"}), IsNil)
+
+	t, err := tenants.lookup("abc", store)
+	c.Assert(err, IsNil)
+	c.Assert(t, Equals, finance)
+	// Buckets aren't searched for secrets the database doesn't know about.
+	_, err = tenants.lookup("def", store)
+	c.Assert(err, Equals, ErrNoSuchSecret)
+
+	// With one tenant, there's nowhere else to look.
+	tenants = &tenantSet{
+		tenants: []*tenant{shared},
+		byName:  map[string]*tenant{DefaultTenant: shared},
+	}
+	t, err = tenants.lookup("def", nullStore{})
+	c.Assert(err, IsNil)
+	c.Assert(t, Equals, shared)
+}
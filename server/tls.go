@@ -0,0 +1,192 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	ErrNoClientCAs = errors.New("No certificates found in client_ca_file")
+
+	// CertPollInterval is how often the certificate and key files are checked for changes.
+	CertPollInterval = 30 * time.Second
+
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+)
+
+// tlsEnabled reports whether secretshare-server should terminate TLS itself.
+func (self *serverConfig) tlsEnabled() bool {
+	return self.TLSCertFile != "" || self.TLSKeyFile != ""
+}
+
+// certReloader serves the certificate from tls_cert_file and tls_key_file, reloading
+// it when the files change or when the server gets SIGHUP.  Connections that are
+// already established keep using whichever certificate they started with.
+type certReloader struct {
+	mutex    sync.RWMutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (self *certReloader) fileModTimes() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+	for i, path := range []string{self.certFile, self.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// reload loads the certificate and key.  If they can't be loaded, the old certificate
+// stays in use.
+func (self *certReloader) reload() error {
+	modTimes, err := self.fileModTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(self.certFile, self.keyFile)
+	if err != nil {
+		return err
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.cert = &cert
+	self.modTimes = modTimes
+	return nil
+}
+
+// changed reports whether either file has been modified since the last reload.
+func (self *certReloader) changed() bool {
+	modTimes, err := self.fileModTimes()
+	if err != nil {
+		return false
+	}
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return modTimes != self.modTimes
+}
+
+func (self *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return self.cert, nil
+}
+
+func (self *certReloader) reloadAndLog(reason string) {
+	if err := self.reload(); err != nil {
+		log.Errorf("Failed to reload TLS certificate (%s); keeping the old one: %s", reason, err.Error())
+		return
+	}
+	log.Infof("Reloaded TLS certificate from %s (%s)", self.certFile, reason)
+}
+
+// watch reloads the certificate when the files change.  It never returns.  Reloading
+// on SIGHUP is handled by serveUntilSignalled.
+func (self *certReloader) watch() {
+	ticker := time.NewTicker(CertPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if self.changed() {
+			self.reloadAndLog("files changed")
+		}
+	}
+}
+
+// buildTLSConfig returns the TLS settings for the listener.
+//
+// If a client CA is configured, clients may present a certificate signed by it.
+// Presenting one is optional at the TLS layer so that clients using other
+// authentication methods can still connect; authenticator decides what to do with it.
+func buildTLSConfig(config *serverConfig, reloader *certReloader) (*tls.Config, error) {
+	var minVersion uint16 = tls.VersionTLS12
+	if config.TLSMinVersion != "" {
+		v, ok := tlsVersions[config.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf(`Unknown tls_min_version "%s"; use 1.0, 1.1, 1.2, or 1.3`, config.TLSMinVersion)
+		}
+		minVersion = v
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: reloader.getCertificate,
+	}
+
+	if config.ClientCAFile != "" {
+		caBytes, err := ioutil.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf(`Failed to read client CA file "%s": %s`, config.ClientCAFile, err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return nil, ErrNoClientCAs
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsConfig, nil
+}
+
+// httpsRedirect returns a handler that sends every request to the same URL on the
+// HTTPS listener.  It uses 308 rather than 301 so that clients repeat a POST as a POST.
+func httpsRedirect(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
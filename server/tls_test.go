@@ -0,0 +1,134 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type TLSSuite struct{}
+
+var _ = Suite(&TLSSuite{})
+
+// writeTestCert writes a self-signed certificate for commonName and its key to dir,
+// returning their paths.
+func writeTestCert(c *C, dir, commonName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	c.Assert(ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600), IsNil)
+	c.Assert(ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600), IsNil)
+	return certPath, keyPath
+}
+
+func servedName(c *C, reloader *certReloader) string {
+	cert, err := reloader.getCertificate(&tls.ClientHelloInfo{})
+	c.Assert(err, IsNil)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	c.Assert(err, IsNil)
+	return leaf.Subject.CommonName
+}
+
+func (s *TLSSuite) TestCertReloader(c *C) {
+	dir := c.MkDir()
+	certPath, keyPath := writeTestCert(c, dir, "old.example.com")
+	reloader, err := newCertReloader(certPath, keyPath)
+	c.Assert(err, IsNil)
+	c.Assert(servedName(c, reloader), Equals, "old.example.com")
+	c.Assert(reloader.changed(), Equals, false)
+
+	// A new certificate is noticed and served.
+	writeTestCert(c, dir, "new.example.com")
+	later := time.Now().Add(time.Minute)
+	c.Assert(os.Chtimes(certPath, later, later), IsNil)
+	c.Assert(reloader.changed(), Equals, true)
+	c.Assert(reloader.reload(), IsNil)
+	c.Assert(servedName(c, reloader), Equals, "new.example.com")
+	c.Assert(reloader.changed(), Equals, false)
+
+	// A broken one isn't, and the old one stays.
+	c.Assert(ioutil.WriteFile(keyPath, []byte("garbage"), 0600), IsNil)
+	c.Assert(reloader.reload(), NotNil)
+	c.Assert(servedName(c, reloader), Equals, "new.example.com")
+
+	_, err = newCertReloader(certPath, filepath.Join(dir, "missing.pem"))
+	c.Assert(err, NotNil)
+}
+
+func (s *TLSSuite) TestMinVersion(c *C) {
+	dir := c.MkDir()
+	reloader, err := newCertReloader(writeTestCert(c, dir, "example.com"))
+	c.Assert(err, IsNil)
+
+	tlsConfig, err := buildTLSConfig(&serverConfig{}, reloader)
+	c.Assert(err, IsNil)
+	c.Assert(tlsConfig.MinVersion, Equals, uint16(tls.VersionTLS12))
+	c.Assert(tlsConfig.ClientAuth, Equals, tls.NoClientCert)
+
+	tlsConfig, err = buildTLSConfig(&serverConfig{TLSMinVersion: "1.3"}, reloader)
+	c.Assert(err, IsNil)
+	c.Assert(tlsConfig.MinVersion, Equals, uint16(tls.VersionTLS13))
+
+	_, err = buildTLSConfig(&serverConfig{TLSMinVersion: "1.4"}, reloader)
+	c.Assert(err, ErrorMatches, `Unknown tls_min_version "1.4".*`)
+
+	// A client CA makes certificates optional, not required.
+	caPath := filepath.Join(dir, "cert.pem")
+	tlsConfig, err = buildTLSConfig(&serverConfig{ClientCAFile: caPath}, reloader)
+	c.Assert(err, IsNil)
+	c.Assert(tlsConfig.ClientAuth, Equals, tls.VerifyClientCertIfGiven)
+	_, err = buildTLSConfig(&serverConfig{ClientCAFile: filepath.Join(dir, "key.pem")}, reloader)
+	c.Assert(err, Equals, ErrNoClientCAs)
+}
+
+func (s *TLSSuite) TestHTTPSRedirect(c *C) {
+	w := httptest.NewRecorder()
+	httpsRedirect(443).ServeHTTP(w, httptest.NewRequest("POST", "http://secretshare.example.com:80/upload?x=1", nil))
+	c.Assert(w.Code, Equals, http.StatusPermanentRedirect)
+	c.Assert(w.Header().Get("Location"), Equals, "https://secretshare.example.com/upload?x=1")
+
+	w = httptest.NewRecorder()
+	httpsRedirect(8443).ServeHTTP(w, httptest.NewRequest("GET", "http://secretshare.example.com/version", nil))
+	c.Assert(w.Code, Equals, http.StatusPermanentRedirect)
+	c.Assert(w.Header().Get("Location"), Equals, "https://secretshare.example.com:8443/version")
+}
@@ -0,0 +1,69 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/waucka/secretshare/commonlib"
+)
+
+// capabilities describes what the server currently supports.  TTL and size limits
+// and the accepted authentication schemes can change when the configuration is
+// reloaded, so this is worked out for each request.
+//
+// The caller's tenant isn't known yet, so the limits are the loosest of any tenant's;
+// the upload request is checked against the caller's own tenant.
+func capabilities(auth *authenticator, policies *policyHolder) *commonlib.Capabilities {
+	caps := &commonlib.Capabilities{
+		Formats:      []string{commonlib.FormatAES256CBC},
+		AuthSchemes:  auth.schemes(),
+		Storage:      commonlib.StorageS3,
+		Once:         false,
+		MaxDownloads: false,
+		Complete:     true,
+	}
+	policies.mutex.RLock()
+	defer policies.mutex.RUnlock()
+	caps.DefaultTTL = int(policies.policies[DefaultTenant].defaultTTL / time.Minute)
+	first := true
+	for _, policy := range policies.policies {
+		maxTTL := int(policy.maxTTL / time.Minute)
+		if first || (caps.MaxTTL != 0 && (maxTTL == 0 || maxTTL > caps.MaxTTL)) {
+			caps.MaxTTL = maxTTL
+		}
+		if first || (caps.MaxSize != 0 && (policy.maxSize == 0 || policy.maxSize > caps.MaxSize)) {
+			caps.MaxSize = policy.maxSize
+		}
+		first = false
+	}
+	return caps
+}
+
+func versionHandler(auth *authenticator, policies *policyHolder) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, &commonlib.ServerVersionResponse{
+			ServerVersion:        commonlib.Version,
+			APIVersion:           commonlib.APIVersion,
+			ServerSourceLocation: commonlib.GetSourceLocation(),
+			Capabilities:         capabilities(auth, policies),
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	. "gopkg.in/check.v1"
+
+	"github.com/waucka/secretshare/commonlib"
+)
+
+type VersionSuite struct{}
+
+var _ = Suite(&VersionSuite{})
+
+func (s *VersionSuite) TestCapabilities(c *C) {
+	config := &serverConfig{
+		SecretKey:       "hunter2",
+		AllowLegacyAuth: true,
+		MaxTTL:          60,
+		MaxSize:         1 << 20,
+	}
+	auth := &authenticator{}
+	auth.update(config)
+	caps := capabilities(auth, &policyHolder{policies: newUploadPolicies(config, nil)})
+	c.Assert(caps.Formats, DeepEquals, []string{commonlib.FormatAES256CBC})
+	c.Assert(caps.AuthSchemes, DeepEquals, []string{commonlib.AuthSignature, commonlib.AuthLegacySecretKey})
+	c.Assert(caps.DefaultTTL, Equals, 60)
+	c.Assert(caps.MaxTTL, Equals, 60)
+	c.Assert(caps.MaxSize, Equals, int64(1<<20))
+	c.Assert(caps.Storage, Equals, commonlib.StorageS3)
+	c.Assert(caps.Once, Equals, false)
+
+	// A client using the pre-shared key signs its requests.
+	features, err := commonlib.Negotiate(caps, &commonlib.Credentials{SecretKey: "hunter2"})
+	c.Assert(err, IsNil)
+	c.Assert(features.AuthScheme, Equals, commonlib.AuthSignature)
+
+	// With tenants, the loosest limits are advertised.
+	config.Tenants = []*tenantConfig{
+		{Name: "finance", MaxTTL: 120, MaxSize: 1 << 10},
+		{Name: "research", MaxSize: 1 << 30},
+	}
+	caps = capabilities(auth, &policyHolder{policies: newUploadPolicies(config, nil)})
+	c.Assert(caps.MaxTTL, Equals, 120)
+	c.Assert(caps.MaxSize, Equals, int64(1<<30))
+	config.Tenants[0].MaxTTL = 0
+	config.MaxTTL = 0
+	caps = capabilities(auth, &policyHolder{policies: newUploadPolicies(config, nil)})
+	c.Assert(caps.MaxTTL, Equals, 0)
+}
@@ -0,0 +1,74 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed webui
+var webuiFiles embed.FS
+
+// webUIContentSecurityPolicy only lets the pages talk to this server and to S3, where
+// the encrypted objects are stored.
+const webUIContentSecurityPolicy = "default-src 'self'; connect-src 'self' https://*.amazonaws.com; img-src 'self' blob:; object-src 'none'; frame-ancestors 'none'; base-uri 'none'"
+
+type webUIConfig struct {
+	Bucket       string `json:"bucket"`
+	BucketRegion string `json:"bucket_region"`
+}
+
+// webUIHeaders is gin middleware that sets security headers on web UI responses.
+func webUIHeaders(c *gin.Context) {
+	c.Header("Content-Security-Policy", webUIContentSecurityPolicy)
+	c.Header("Referrer-Policy", "no-referrer")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Cache-Control", "no-store")
+}
+
+// registerWebUI serves the browser-based send page at / and the receive page at /r.
+// Receive links look like /r#<key>; browsers never send the part after the #, so the
+// key doesn't reach the server.
+func registerWebUI(r *gin.Engine, config *serverConfig) {
+	static, err := fs.Sub(webuiFiles, "webui")
+	if err != nil {
+		// The files are compiled in, so this can't happen.
+		panic(err)
+	}
+	page := func(name string) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			c.FileFromFS(name, http.FS(static))
+		}
+	}
+
+	r.GET("/", webUIHeaders, page("/"))
+	r.GET("/r", webUIHeaders, page("r.html"))
+	ui := r.Group("/ui", webUIHeaders)
+	ui.GET("/config.json", func(c *gin.Context) {
+		c.JSON(http.StatusOK, &webUIConfig{
+			Bucket:       config.Bucket,
+			BucketRegion: config.BucketRegion,
+		})
+	})
+	for _, name := range []string{"secretshare.js", "send.js", "receive.js", "style.css"} {
+		ui.GET("/"+name, page(name))
+	}
+}
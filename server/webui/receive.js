@@ -0,0 +1,52 @@
+// secretshare web UI - send and receive secrets in the browser
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+"use strict";
+
+(function() {
+    var status = document.getElementById("status");
+    var button = document.getElementById("receive");
+    var keystr = location.hash.slice(1);
+
+    function setStatus(message) {
+        status.textContent = message;
+    }
+
+    if (!keystr) {
+        button.disabled = true;
+        setStatus("This link is incomplete.  Make sure you copied all of it, including the part after #.");
+        return;
+    }
+
+    // Downloading only happens when the recipient asks, so link previews and scanners
+    // that load the page don't fetch the secret.
+    button.addEventListener("click", function() {
+        button.disabled = true;
+        secretshare.receive(keystr, setStatus).then(function(secret) {
+            var url = URL.createObjectURL(new Blob([secret.data], { type: "application/octet-stream" }));
+            var link = document.getElementById("download");
+            link.href = url;
+            link.download = secret.filename;
+            link.textContent = "Save " + secret.filename;
+            document.getElementById("result").hidden = false;
+            setStatus("Decrypted " + secret.data.length + " bytes.");
+            link.click();
+        }, function(err) {
+            setStatus(err.message);
+            button.disabled = false;
+        });
+    });
+})();
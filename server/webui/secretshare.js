@@ -0,0 +1,352 @@
+// secretshare web UI - send and receive secrets in the browser
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// This is a port of the object format in commonlib (encrypter.go, decrypter.go, and
+// api.go); anything uploaded here can be received with the CLI and vice versa.
+//
+// An object is one byte giving the number of padding bytes, a 16-byte IV, and the
+// AES-256-CBC encryption of the plaintext followed by that many padding bytes, each
+// equal to the padding length.  Unlike PKCS#7, a plaintext that fills its last block
+// gets no padding at all.  WebCrypto only does PKCS#7, so encrypt() drops the extra
+// block WebCrypto adds and decrypt() adds a block that WebCrypto will accept.
+
+"use strict";
+
+var secretshare = (function() {
+    var BLOCK_SIZE = 16;
+    var SIGNATURE_SCHEME = "Secretshare-HMAC-SHA256";
+    // commonlib.Encoding: URL-safe-ish base64 with "y" and "z" swapped, no padding.
+    var ALPHABET = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxzy0123456789+_";
+
+    function encodeForHuman(bytes) {
+        var out = "";
+        var i;
+        for (i = 0; i + 2 < bytes.length; i += 3) {
+            var n = (bytes[i] << 16) | (bytes[i + 1] << 8) | bytes[i + 2];
+            out += ALPHABET[(n >> 18) & 63] + ALPHABET[(n >> 12) & 63] + ALPHABET[(n >> 6) & 63] + ALPHABET[n & 63];
+        }
+        var rest = bytes.length - i;
+        if (rest === 1) {
+            var n1 = bytes[i] << 16;
+            out += ALPHABET[(n1 >> 18) & 63] + ALPHABET[(n1 >> 12) & 63];
+        } else if (rest === 2) {
+            var n2 = (bytes[i] << 16) | (bytes[i + 1] << 8);
+            out += ALPHABET[(n2 >> 18) & 63] + ALPHABET[(n2 >> 12) & 63] + ALPHABET[(n2 >> 6) & 63];
+        }
+        return out;
+    }
+
+    function decodeForHuman(str) {
+        if (str.length % 4 === 1) {
+            throw new Error("Malformed key");
+        }
+        var out = new Uint8Array(Math.floor(str.length * 3 / 4));
+        var bits = 0;
+        var value = 0;
+        var pos = 0;
+        for (var i = 0; i < str.length; i++) {
+            var digit = ALPHABET.indexOf(str[i]);
+            if (digit < 0) {
+                throw new Error("Malformed key");
+            }
+            value = (value << 6) | digit;
+            bits += 6;
+            if (bits >= 8) {
+                bits -= 8;
+                out[pos++] = (value >> bits) & 0xff;
+            }
+        }
+        return out;
+    }
+
+    function hex(bytes) {
+        return Array.prototype.map.call(new Uint8Array(bytes), function(b) {
+            return ("0" + b.toString(16)).slice(-2);
+        }).join("");
+    }
+
+    function concat(arrays) {
+        var total = arrays.reduce(function(sum, a) { return sum + a.length; }, 0);
+        var out = new Uint8Array(total);
+        var pos = 0;
+        arrays.forEach(function(a) {
+            out.set(a, pos);
+            pos += a.length;
+        });
+        return out;
+    }
+
+    function importKey(key) {
+        return crypto.subtle.importKey("raw", key, { name: "AES-CBC" }, false, ["encrypt", "decrypt"]);
+    }
+
+    // deriveId returns the object ID for a key (commonlib.deriveId).
+    function deriveId(key) {
+        return crypto.subtle.digest("SHA-256", key).then(function(sum) {
+            return encodeForHuman(new Uint8Array(sum));
+        });
+    }
+
+    function generateKey() {
+        return crypto.getRandomValues(new Uint8Array(32));
+    }
+
+    // encrypt returns the object for a plaintext (commonlib.Encrypter).
+    function encrypt(key, plaintext) {
+        var paddingLen = plaintext.length % BLOCK_SIZE;
+        if (paddingLen > 0) {
+            paddingLen = BLOCK_SIZE - paddingLen;
+        }
+        var padded = new Uint8Array(plaintext.length + paddingLen);
+        padded.set(plaintext);
+        padded.fill(paddingLen, plaintext.length);
+        var iv = crypto.getRandomValues(new Uint8Array(BLOCK_SIZE));
+        return importKey(key).then(function(cryptoKey) {
+            return crypto.subtle.encrypt({ name: "AES-CBC", iv: iv }, cryptoKey, padded);
+        }).then(function(ciphertext) {
+            // Drop the block of PKCS#7 padding that WebCrypto added.
+            var body = new Uint8Array(ciphertext, 0, padded.length);
+            return concat([new Uint8Array([paddingLen]), iv, body]);
+        });
+    }
+
+    // decrypt returns the plaintext of an object.  If size is given, the plaintext is
+    // cut to that length, as commonlib.Decrypter does; otherwise, the padding length in
+    // the header is used, as commonlib's decrypt() does.
+    function decrypt(key, object, size) {
+        if (object.length < 1 + BLOCK_SIZE || (object.length - 1) % BLOCK_SIZE !== 0) {
+            return Promise.reject(new Error("Data is malformed"));
+        }
+        var paddingLen = object[0];
+        var iv = object.slice(1, 1 + BLOCK_SIZE);
+        var body = object.slice(1 + BLOCK_SIZE);
+        var cryptoKey;
+        return importKey(key).then(function(k) {
+            cryptoKey = k;
+            // Encrypting a block of PKCS#7 padding with the last ciphertext block as the
+            // IV gives the block that would have followed it.
+            var lastBlock = body.length > 0 ? body.slice(body.length - BLOCK_SIZE) : iv;
+            var pad = new Uint8Array(BLOCK_SIZE).fill(BLOCK_SIZE);
+            return crypto.subtle.encrypt({ name: "AES-CBC", iv: lastBlock }, cryptoKey, pad);
+        }).then(function(extra) {
+            var full = concat([body, new Uint8Array(extra, 0, BLOCK_SIZE)]);
+            return crypto.subtle.decrypt({ name: "AES-CBC", iv: iv }, cryptoKey, full);
+        }).then(function(plaintext) {
+            var bytes = new Uint8Array(plaintext);
+            var length = size === undefined ? bytes.length - paddingLen : size;
+            if (length < 0 || length > bytes.length) {
+                throw new Error("Data is malformed");
+            }
+            return bytes.slice(0, length);
+        });
+    }
+
+    // signRequest returns the Authorization header for a request signed with the
+    // pre-shared key (commonlib.SignRequest).
+    function signRequest(secretKey, method, path, body) {
+        var enc = new TextEncoder();
+        var timestamp = Math.floor(Date.now() / 1000);
+        var nonce = hex(crypto.getRandomValues(new Uint8Array(16)));
+        var hmacKey;
+        return crypto.subtle.importKey("raw", enc.encode(secretKey), { name: "HMAC", hash: "SHA-256" }, false, ["sign"]).then(function(k) {
+            hmacKey = k;
+            return crypto.subtle.digest("SHA-256", body);
+        }).then(function(bodySum) {
+            var canonical = [SIGNATURE_SCHEME, method.toUpperCase(), path, String(timestamp), nonce, hex(bodySum)].join("\n");
+            return crypto.subtle.sign("HMAC", hmacKey, enc.encode(canonical));
+        }).then(function(sig) {
+            var sigStr = btoa(String.fromCharCode.apply(null, new Uint8Array(sig)));
+            return SIGNATURE_SCHEME + " ts=" + timestamp + ",nonce=" + nonce + ",sig=" + sigStr;
+        });
+    }
+
+    function checkResponse(resp, what) {
+        if (resp.ok) {
+            return resp;
+        }
+        return resp.json().then(function(body) {
+            throw new Error(what + ": " + (body.message || ("HTTP " + resp.status)));
+        }, function() {
+            throw new Error(what + ": HTTP " + resp.status);
+        });
+    }
+
+    function put(url, headers, body) {
+        var h = new Headers();
+        Object.keys(headers || {}).forEach(function(name) {
+            headers[name].forEach(function(value) {
+                h.append(name, value);
+            });
+        });
+        return fetch(url, { method: "PUT", headers: h, body: body }).then(function(resp) {
+            return checkResponse(resp, "Upload failed");
+        });
+    }
+
+    // send encrypts and uploads a File, resolving to the key string.
+    function send(file, ttl, secretKey, progress) {
+        var key = generateKey();
+        var keystr = encodeForHuman(key);
+        var plaintext;
+        var uploadInfo;
+        var objectId;
+        var size;
+        var metaSize;
+        progress("Reading file...");
+        return file.arrayBuffer().then(function(buf) {
+            plaintext = new Uint8Array(buf);
+            return deriveId(key);
+        }).then(function(id) {
+            objectId = id;
+            var body = new TextEncoder().encode(JSON.stringify({
+                ttl: ttl,
+                object_id: id,
+                filesize: plaintext.length,
+                complete: true
+            }));
+            var headers = { "Content-Type": "application/json" };
+            var signed = secretKey ? signRequest(secretKey, "POST", "/upload", body) : Promise.resolve("");
+            return signed.then(function(auth) {
+                if (auth) {
+                    headers.Authorization = auth;
+                }
+                return fetch("/upload", { method: "POST", headers: headers, body: body, credentials: "same-origin" });
+            });
+        }).then(function(resp) {
+            return checkResponse(resp, "The secretshare server refused the upload");
+        }).then(function(resp) {
+            return resp.json();
+        }).then(function(info) {
+            uploadInfo = info;
+            progress("Encrypting...");
+            return encrypt(key, plaintext);
+        }).then(function(object) {
+            progress("Uploading...");
+            size = object.length;
+            return put(uploadInfo.put_url, uploadInfo.headers, object);
+        }).then(function() {
+            var meta = new TextEncoder().encode(JSON.stringify({
+                filename: file.name,
+                filesize: plaintext.length
+            }));
+            return encrypt(key, meta);
+        }).then(function(object) {
+            metaSize = object.length;
+            return put(uploadInfo.meta_put_url, uploadInfo.meta_headers, object);
+        }).then(function() {
+            // Make sure both objects arrived before handing out the key.
+            progress("Verifying...");
+            var body = new TextEncoder().encode(JSON.stringify({
+                size: size,
+                meta_size: metaSize
+            }));
+            var headers = { "Content-Type": "application/json" };
+            // The server checks the signature against the decoded path, as the Go
+            // client signs it, so sign the ID as it is but fetch it escaped.
+            var signed = secretKey ? signRequest(secretKey, "POST", "/secrets/" + objectId + "/complete", body) : Promise.resolve("");
+            return signed.then(function(auth) {
+                if (auth) {
+                    headers.Authorization = auth;
+                }
+                return fetch("/secrets/" + encodeURIComponent(objectId) + "/complete", { method: "POST", headers: headers, body: body, credentials: "same-origin" });
+            });
+        }).then(function(resp) {
+            return checkResponse(resp, "The upload could not be verified");
+        }).then(function() {
+            return keystr;
+        });
+    }
+
+    function fetchObject(url, what) {
+        return fetch(url).then(function(resp) {
+            if (resp.status === 403 || resp.status === 404) {
+                throw new Error("This secret does not exist.  It may have expired or been deleted.");
+            }
+            return checkResponse(resp, what);
+        }).then(function(resp) {
+            return resp.arrayBuffer();
+        }).then(function(buf) {
+            return new Uint8Array(buf);
+        });
+    }
+
+    // receive downloads and decrypts a secret, resolving to { filename, data }.
+    function receive(keystr, progress) {
+        var key = decodeForHuman(keystr);
+        var config;
+        var meta;
+        var id;
+        return deriveId(key).then(function(objectId) {
+            id = objectId;
+            // Each tenant has its own bucket, so ask the server which one to use.
+            return fetch("/secrets/" + encodeURIComponent(id) + "/location").then(function(resp) {
+                if (resp.ok) {
+                    return resp;
+                }
+                return resp.json().catch(function() {
+                    return {};
+                }).then(function(body) {
+                    // The server knows why the secret can't be received: it may be
+                    // held back, gone, or asked for too often.
+                    if (body.code === "not_found") {
+                        throw new Error("This secret does not exist.  It may have expired or been deleted.");
+                    }
+                    if (body.code) {
+                        throw new Error(body.message || ("HTTP " + resp.status));
+                    }
+                    // Older servers don't have the endpoint, and only use one bucket.
+                    return fetch("/ui/config.json").then(function(resp) {
+                        return checkResponse(resp, "Failed to get server configuration");
+                    });
+                });
+            });
+        }).then(function(resp) {
+            return resp.json();
+        }).then(function(c) {
+            config = c;
+            progress("Downloading...");
+            return fetchObject(objectURL(config, "meta/" + id), "Failed to download metadata");
+        }).then(function(object) {
+            return decrypt(key, object);
+        }).then(function(plaintext) {
+            meta = JSON.parse(new TextDecoder().decode(plaintext));
+            return fetchObject(objectURL(config, id), "Failed to download file");
+        }).then(function(object) {
+            progress("Decrypting...");
+            return decrypt(key, object, meta.filesize);
+        }).then(function(data) {
+            // Let the server know; failing to is not worth bothering the user about.
+            fetch("/secrets/" + encodeURIComponent(id) + "/retrieved", { method: "POST" }).catch(function() {});
+            return { filename: meta.filename, data: data };
+        });
+    }
+
+    // objectURL matches the URLs used by commonlib.RecvSecret.
+    function objectURL(config, key) {
+        return "https://s3-" + encodeURIComponent(config.bucket_region) + ".amazonaws.com/" +
+            encodeURIComponent(config.bucket) + "/" + key.split("/").map(encodeURIComponent).join("/");
+    }
+
+    return {
+        encodeForHuman: encodeForHuman,
+        decodeForHuman: decodeForHuman,
+        deriveId: deriveId,
+        encrypt: encrypt,
+        decrypt: decrypt,
+        send: send,
+        receive: receive
+    };
+})();
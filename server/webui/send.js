@@ -0,0 +1,58 @@
+// secretshare web UI - send and receive secrets in the browser
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+"use strict";
+
+(function() {
+    var form = document.getElementById("send-form");
+    var status = document.getElementById("status");
+
+    function setStatus(message) {
+        status.textContent = message;
+    }
+
+    form.addEventListener("submit", function(event) {
+        event.preventDefault();
+        var file = document.getElementById("file").files[0];
+        if (!file) {
+            return;
+        }
+        var ttl = parseInt(document.getElementById("ttl").value, 10);
+        var secretKey = document.getElementById("secret-key").value;
+        document.getElementById("send").disabled = true;
+        document.getElementById("result").hidden = true;
+
+        secretshare.send(file, ttl, secretKey, setStatus).then(function(keystr) {
+            var link = location.origin + "/r#" + keystr;
+            document.getElementById("link").value = link;
+            document.getElementById("command").textContent = "secretshare receive " + keystr;
+            document.getElementById("result").hidden = false;
+            setStatus("File uploaded!");
+        }, function(err) {
+            setStatus(err.message);
+        }).then(function() {
+            document.getElementById("send").disabled = false;
+        });
+    });
+
+    document.getElementById("copy").addEventListener("click", function() {
+        var link = document.getElementById("link");
+        link.select();
+        navigator.clipboard.writeText(link.value).then(function() {
+            setStatus("Link copied.");
+        });
+    });
+})();
@@ -0,0 +1,73 @@
+package main
+
+// secretshare server - mediate access to Amazon S3 by secretshare client
+// Copyright (C) 2016  Alexander Wauck
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	. "gopkg.in/check.v1"
+)
+
+type WebUISuite struct {
+	router *gin.Engine
+}
+
+var _ = Suite(&WebUISuite{})
+
+func (s *WebUISuite) SetUpSuite(c *C) {
+	gin.SetMode(gin.TestMode)
+	s.router = gin.New()
+	registerWebUI(s.router, &serverConfig{
+		Bucket:       "secrets",
+		BucketRegion: "us-west-2",
+	})
+}
+
+func (s *WebUISuite) get(path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", path, nil)
+	s.router.ServeHTTP(w, req)
+	return w
+}
+
+func (s *WebUISuite) TestPages(c *C) {
+	w := s.get("/")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(strings.Contains(w.Body.String(), "Send a secret"), Equals, true)
+	c.Assert(w.Header().Get("Content-Security-Policy"), Equals, webUIContentSecurityPolicy)
+
+	w = s.get("/r")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(strings.Contains(w.Body.String(), "Receive a secret"), Equals, true)
+
+	w = s.get("/ui/secretshare.js")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(strings.HasPrefix(w.Header().Get("Content-Type"), "text/javascript"), Equals, true)
+}
+
+func (s *WebUISuite) TestConfig(c *C) {
+	w := s.get("/ui/config.json")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	var config webUIConfig
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &config), IsNil)
+	c.Assert(config.Bucket, Equals, "secrets")
+	c.Assert(config.BucketRegion, Equals, "us-west-2")
+}
@@ -80,7 +80,7 @@ if [ "$client_version" != "$SECRETSHARE_VERSION" ]; then
     exit 1
 fi
 
-if [ "$client_api_version" != "3" ]; then
+if [ "$client_api_version" != "4" ]; then
     kill $server_pid
     echo "Wrong client API version: $client_api_version"
     echo -e $version_out
@@ -96,7 +96,7 @@ if [ "$server_version" != "$SECRETSHARE_VERSION" ]; then
     exit 1
 fi
 
-if [ "$server_api_version" != "3" ]; then
+if [ "$server_api_version" != "4" ]; then
     kill $server_pid
     echo "Wrong server API version: $server_api_version"
     echo -e $version_out